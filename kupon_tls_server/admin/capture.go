@@ -0,0 +1,43 @@
+package admin
+
+import (
+	"github.com/go-kit/kit/log/level"
+	"net/http"
+	"nexusws/cmd/kupon_tls_server/capture"
+	"strings"
+)
+
+// HandleCapture serves the capture list:
+//
+//	GET    /capture              the EcrSerials captured
+//	PUT    /capture/<EcrSerial>  start capturing a register
+//	DELETE /capture/<EcrSerial>  stop capturing it
+//
+// Changes last until the config is reloaded.
+func (s *Server) HandleCapture(c *capture.Capturer) {
+	s.Handle("/capture", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, c.List())
+	}))
+	s.Handle("/capture/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ecr := strings.TrimPrefix(r.URL.Path, "/capture/")
+		if ecr == "" {
+			http.Error(w, "missing EcrSerial", http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			c.Add(ecr)
+		case http.MethodDelete:
+			c.Remove(ecr)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		level.Info(s.l).Log("msg", "capture list changed", "ecr_serial", ecr, "method", r.Method, "remote", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
@@ -0,0 +1,33 @@
+package admin
+
+import (
+	"net/http"
+	"nexusws/cmd/kupon_tls_server/inventory"
+	"strings"
+)
+
+// HandleDevices serves the inventory:
+//
+//	GET /devices              every device
+//	GET /devices/<EcrSerial>  one device
+func (s *Server) HandleDevices(inv *inventory.Inventory) {
+	s.Handle("/devices", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, inv.Devices())
+	}))
+	s.Handle("/devices/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		d, ok := inv.Device(strings.TrimPrefix(r.URL.Path, "/devices/"))
+		if !ok {
+			http.Error(w, "unknown device", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, d)
+	}))
+}
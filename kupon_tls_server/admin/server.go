@@ -0,0 +1,62 @@
+// Package admin serves the admin HTTP API. Every request must carry the
+// configured token as "Authorization: Bearer <token>", so plain HTTP is
+// only served on a loopback address, see Loopback.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type Server struct {
+	l     log.Logger
+	token string
+	mux   *http.ServeMux
+}
+
+func New(l log.Logger, token string) *Server {
+	return &Server{l: l, token: token, mux: http.NewServeMux()}
+}
+
+// Handle registers h for pattern, behind the token check.
+func (s *Server) Handle(pattern string, h http.Handler) {
+	s.mux.Handle(pattern, h)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(s.token)) != 1 {
+		level.Warn(s.l).Log("msg", "admin request refused", "remote", r.RemoteAddr, "path", r.URL.Path)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// Loopback reports whether the listen address addr only accepts local
+// connections. An empty host listens on every interface.
+func Loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,104 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"nexusws/cmd/kupon_tls_server/eventsink"
+	"nexusws/cmd/kupon_tls_server/inventory"
+	"nexusws/cmd/kupon_tls_server/session"
+	"path/filepath"
+	"testing"
+)
+
+func TestDevices(t *testing.T) {
+	inv, err := inventory.New(log.NewNopLogger(), filepath.Join(t.TempDir(), "inventory.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	inv.Write(ctx, eventsink.NewEvent(ctx, eventsink.EventSlipValidation, "ECR0000001", nil, nil))
+
+	s := New(log.NewNopLogger(), "secret")
+	s.HandleDevices(inv)
+
+	get := func(path string, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if rec := get("/devices", token); rec.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: status %d", token, rec.Code)
+		}
+	}
+
+	rec := get("/devices", "secret")
+	var devices []inventory.Device
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &devices) != nil || len(devices) != 1 {
+		t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+	}
+	if rec = get("/devices/ECR0000001", "secret"); rec.Code != http.StatusOK {
+		t.Errorf("device: status %d", rec.Code)
+	}
+	if rec = get("/devices/ECR0000009", "secret"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown device: status %d", rec.Code)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	m := session.NewManager()
+	server, client := net.Pipe()
+	defer client.Close()
+	m.Open("trace-1", server)
+
+	s := New(log.NewNopLogger(), "secret")
+	s.HandleSessions(m)
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodGet, "/sessions")
+	var sessions []session.Info
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &sessions) != nil || len(sessions) != 1 || sessions[0].ID != "trace-1" {
+		t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+	}
+	if rec = do(http.MethodDelete, "/sessions/trace-2"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown session: status %d", rec.Code)
+	}
+	if rec = do(http.MethodDelete, "/sessions/trace-1"); rec.Code != http.StatusNoContent {
+		t.Errorf("close: status %d", rec.Code)
+	}
+	if _, err := client.Write([]byte("G")); err == nil {
+		t.Error("write after close")
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:9091": true,
+		"[::1]:9091":     true,
+		"localhost:9091": true,
+		":9091":          false,
+		"0.0.0.0:9091":   false,
+		"10.0.0.7:9091":  false,
+		"127.0.0.1":      false,
+	} {
+		if got := Loopback(addr); got != want {
+			t.Errorf("%s: got %v", addr, got)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package admin
+
+import (
+	"encoding/json"
+	"github.com/go-kit/kit/log/level"
+	"net/http"
+	"nexusws/cmd/kupon_tls_server/session"
+	"strings"
+)
+
+// HandleSessions serves the open connections:
+//
+//	GET    /sessions                             every session
+//	DELETE /sessions/<trace id>                  close the connection
+//	GET    /sessions/events[?ecr_serial=<ecr>]   stream lifecycle events
+//
+// Events are streamed as one JSON object per line until the client goes
+// away.
+func (s *Server) HandleSessions(m *session.Manager) {
+	s.Handle("/sessions", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, m.List())
+	}))
+	s.Handle("/sessions/events", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.streamEvents(w, r, m)
+	}))
+	s.Handle("/sessions/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/sessions/")
+		err := m.Kill(id)
+		if err == session.ErrUnknownSession {
+			http.Error(w, "unknown session", http.StatusNotFound)
+			return
+		}
+		level.Info(s.l).Log("msg", "session closed by admin", "session", id, "remote", r.RemoteAddr, "err", err)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request, m *session.Manager) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	events, cancel := m.Subscribe(r.URL.Query().Get("ecr_serial"))
+	defer cancel()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-events:
+			err := enc.Encode(e)
+			if err != nil {
+				return
+			}
+			f.Flush()
+		}
+	}
+}
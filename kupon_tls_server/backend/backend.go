@@ -0,0 +1,48 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"nexusws/cmd/kupon_tls_server/slipfields"
+	"nexusws/cmd/kupon_tls_server/sliplines"
+	"nexusws/cmd/kupon_tls_server/zreport/zfile"
+	v13 "nexusws/pkg/nexushttpclient/v13"
+	"nexusws/pkg/nexushttpclient/zreport"
+)
+
+// Backend persists accepted messages. Every call must have completed before
+// the handler ACKs the message to the register.
+type Backend interface {
+	// InsertSlip stores the raw G frame and its parsed records. typed is the
+	// slipfields.FormatTyped form of msg, nil with the v13 format.
+	InsertSlip(ctx context.Context, msg *sliplines.Message, typed *slipfields.Message, raw []byte) error
+	// InsertSlipValidation stores an E message and returns the QR code url for
+	// the H response.
+	InsertSlipValidation(ctx context.Context, req *v13.SlipValidationInsertReq) (string, error)
+	// InsertZReport stores a W message. summary is nil when the file content
+	// was not parsed.
+	InsertZReport(ctx context.Context, report *zreport.ZReport, summary *zfile.Summary) error
+}
+
+// Error carries the NACK code the register receives for a failed call.
+type Error struct {
+	Code int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// NackCode returns the code carried by err, or def when err has none.
+func NackCode(err error, def int) int {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return def
+}
@@ -0,0 +1,58 @@
+CREATE TABLE slip_messages (
+    id               BIGSERIAL PRIMARY KEY,
+    ecr_serial       VARCHAR(10)  NOT NULL,
+    protocol_version VARCHAR(2)   NOT NULL,
+    type_identifier  VARCHAR(1)   NOT NULL,
+    checksum         VARCHAR(2)   NOT NULL,
+    raw_message      BYTEA        NOT NULL,
+    trace_id         VARCHAR(36)  NOT NULL,
+    received_at      TIMESTAMPTZ  NOT NULL DEFAULT now()
+);
+CREATE INDEX slip_messages_ecr_serial_idx ON slip_messages (ecr_serial, received_at);
+
+CREATE TABLE slip_records (
+    id                           BIGSERIAL PRIMARY KEY,
+    message_id                   BIGINT      NOT NULL REFERENCES slip_messages (id),
+    ecr_serial                   VARCHAR(10) NOT NULL,
+    mac                          VARCHAR(16) NOT NULL,
+    z_report                     VARCHAR(16) NOT NULL,
+    slip_serial                  VARCHAR(16) NOT NULL,
+    daily_slip_no                VARCHAR(16) NOT NULL,
+    is_transmitted_in_background BOOLEAN     NOT NULL
+);
+CREATE INDEX slip_records_key_idx ON slip_records (ecr_serial, z_report, daily_slip_no);
+CREATE INDEX slip_records_message_id_idx ON slip_records (message_id);
+
+-- one row per LineA..LineT entry of a record, line_index orders repeated lines (B, C)
+CREATE TABLE slip_lines (
+    record_id  BIGINT     NOT NULL REFERENCES slip_records (id),
+    line_type  VARCHAR(1) NOT NULL,
+    line_index INT        NOT NULL,
+    data       JSONB      NOT NULL,
+    PRIMARY KEY (record_id, line_type, line_index)
+);
+
+CREATE TABLE slip_validations (
+    id            BIGSERIAL PRIMARY KEY,
+    ecr_serial    VARCHAR(10)  NOT NULL,
+    mac           VARCHAR(16)  NOT NULL,
+    z_report      VARCHAR(16)  NOT NULL,
+    daily_slip_no VARCHAR(16)  NOT NULL,
+    slip_serial   VARCHAR(16)  NOT NULL,
+    md5           VARCHAR(32)  NOT NULL,
+    qr_code       VARCHAR(256) NOT NULL,
+    trace_id      VARCHAR(36)  NOT NULL,
+    received_at   TIMESTAMPTZ  NOT NULL DEFAULT now()
+);
+CREATE INDEX slip_validations_key_idx ON slip_validations (ecr_serial, z_report, daily_slip_no);
+
+CREATE TABLE z_reports (
+    id               BIGSERIAL PRIMARY KEY,
+    ecr_serial       VARCHAR(10) NOT NULL,
+    protocol_version VARCHAR(2)  NOT NULL,
+    file_name        VARCHAR(38) NOT NULL,
+    file_content     BYTEA       NOT NULL,
+    trace_id         VARCHAR(36) NOT NULL,
+    received_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX z_reports_ecr_serial_idx ON z_reports (ecr_serial, received_at);
@@ -0,0 +1,2 @@
+-- parsed Z report file, NULL when content parsing is off or the file did not parse
+ALTER TABLE z_reports ADD COLUMN summary JSONB;
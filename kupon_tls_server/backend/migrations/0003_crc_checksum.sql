@@ -0,0 +1,2 @@
+-- CRC32 checksums of v15 frames are 8 chars
+ALTER TABLE slip_messages ALTER COLUMN checksum TYPE VARCHAR(8);
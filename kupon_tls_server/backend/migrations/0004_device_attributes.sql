@@ -0,0 +1,13 @@
+-- attributes of the device in the registry when the message was received,
+-- NULL without a registry
+ALTER TABLE slip_messages ADD COLUMN owner_tin VARCHAR(20);
+ALTER TABLE slip_messages ADD COLUMN business_unit VARCHAR(64);
+ALTER TABLE slip_messages ADD COLUMN location VARCHAR(256);
+
+ALTER TABLE slip_validations ADD COLUMN owner_tin VARCHAR(20);
+ALTER TABLE slip_validations ADD COLUMN business_unit VARCHAR(64);
+ALTER TABLE slip_validations ADD COLUMN location VARCHAR(256);
+
+ALTER TABLE z_reports ADD COLUMN owner_tin VARCHAR(20);
+ALTER TABLE z_reports ADD COLUMN business_unit VARCHAR(64);
+ALTER TABLE z_reports ADD COLUMN location VARCHAR(256);
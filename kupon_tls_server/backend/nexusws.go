@@ -0,0 +1,144 @@
+package backend
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"nexusws/cmd/kupon_tls_server/slipfields"
+	"nexusws/cmd/kupon_tls_server/sliplines"
+	"nexusws/cmd/kupon_tls_server/zreport/zfile"
+	"nexusws/pkg/nexus_errors"
+	"nexusws/pkg/nexushttpclient"
+	v13 "nexusws/pkg/nexushttpclient/v13"
+	"nexusws/pkg/nexushttpclient/zreport"
+)
+
+const (
+	// SlipWriteSequential calls the raw and the JSON insert one after the other
+	// before the ACK. When the JSON insert fails the raw row is already stored,
+	// the register is NACKed and its resend stores the raw row again.
+	SlipWriteSequential = "sequential"
+	// SlipWriteOutbox ACKs once both inserts are durably queued in the local
+	// outbox, see Outbox. Each raw row is written once per G message.
+	SlipWriteOutbox = "outbox"
+)
+
+// NexusWS stores messages through SlipClient. Its requests have no fields
+// for the registry attributes of the device, only the postgres backend and
+// the events carry them.
+type NexusWS struct {
+	nexusCl *nexushttpclient.SlipClient
+	outbox  *Outbox
+	res     *Resilience
+}
+
+// NewNexusWS returns a backend writing slips in SlipWriteSequential mode, or
+// through outbox when it is not nil. Each SlipClient call goes through res.
+func NewNexusWS(nexusCl *nexushttpclient.SlipClient, outbox *Outbox, res *Resilience) *NexusWS {
+	return &NexusWS{nexusCl: nexusCl, outbox: outbox, res: res}
+}
+
+// InsertSlip sends the v13 records of msg, SlipJSONInsert13 has no fields
+// for the lines of package sliplines. They are in the raw row and the events.
+// typed is not sent either: SlipJSONInsert13 takes the v13 strings whatever
+// the JSON format, which only changes the events.
+func (b *NexusWS) InsertSlip(ctx context.Context, msg *sliplines.Message, typed *slipfields.Message, raw []byte) error {
+	slip := msg.V13()
+	sr := &nexushttpclient.SlipDataRawInsertReq{
+		Ecridentificationnumber: msg.Header.EcrSerial,
+		Firstrecordnumber:       "",
+		Lastrecordnumber:        "",
+		Recordtype:              msg.Header.TypeIdentifier,
+		RawSlipData:             hex.EncodeToString(raw),
+	}
+
+	if b.outbox != nil {
+		err := b.outbox.Enqueue(ctx, sr, slip)
+		if err != nil {
+			return &Error{Code: nexus_errors.ErrUnableToSaveSlipData, Err: err}
+		}
+		return nil
+	}
+
+	ctx, cancel := b.res.WithBudget(ctx)
+	defer cancel()
+
+	err := b.res.Do(ctx, "SlipRawInsert", func(ctx context.Context) error {
+		sresp, err := b.nexusCl.SlipRawInsert(ctx, sr)
+		if err != nil {
+			return err
+		}
+		if sresp.ErrorCode != 0 {
+			return &Error{Code: nexus_errors.ErrWSSlipError, Err: errors.New(sresp.ErrorMessage)}
+		}
+		return nil
+	})
+	if err != nil {
+		return withCode(err, nexus_errors.ErrUnableToSaveSlipData)
+	}
+
+	err = b.res.Do(ctx, "SlipJSONInsert13", func(ctx context.Context) error {
+		sresp, err := b.nexusCl.SlipJSONInsert13(ctx, slip)
+		if err != nil {
+			return err
+		}
+		if sresp.ErrorCode != 0 {
+			return &Error{Code: nexus_errors.ErrWSSlipError, Err: errors.New(sresp.ErrorMessage)}
+		}
+		return nil
+	})
+	if err != nil {
+		return withCode(err, nexus_errors.ErrUnableToSaveSlipData)
+	}
+	return nil
+}
+
+func (b *NexusWS) InsertSlipValidation(ctx context.Context, req *v13.SlipValidationInsertReq) (string, error) {
+	ctx, cancel := b.res.WithBudget(ctx)
+	defer cancel()
+
+	var qrCode string
+	err := b.res.Do(ctx, "SlipValidationInsert", func(ctx context.Context) error {
+		res, err := b.nexusCl.SlipValidationInsert(ctx, req)
+		if err != nil {
+			return err
+		}
+		if res.ErrorCode != 0 {
+			return &Error{Code: res.ErrorCode, Err: fmt.Errorf("%v", res)}
+		}
+		qrCode = res.QrCode
+		return nil
+	})
+	if err != nil {
+		return "", withCode(err, nexus_errors.ErrUnableToSaveSlipData)
+	}
+	return qrCode, nil
+}
+
+// InsertZReport accepts the report without storing it, NexusWS has no Z
+// report endpoint yet. The summary is in the zreport event meanwhile.
+func (b *NexusWS) InsertZReport(ctx context.Context, report *zreport.ZReport, summary *zfile.Summary) error {
+	//TODO NexusWS does not implement the zReportInsert endpoint yet
+	//req := nexushttpclient.ZReportReq{}
+	//req.ECRSerial = report.ECRSerial
+	//req.FileName = report.FileName
+	//req.FileContentBase64 = report.FileContentBase64
+	//resp, err := b.nexusCl.ZReportInsert(ctx, &req)
+	//if err != nil {
+	//	return &Error{Code: nexus_errors.ErrErrorSavingZReport, Err: err}
+	//}
+	//if resp.ErrorCode != 0 {
+	//	return &Error{Code: nexus_errors.ErrErrorSavingZReport, Err: fmt.Errorf("%v", resp)}
+	//}
+	return nil
+}
+
+// withCode wraps a transport error in an *Error with code.
+func withCode(err error, code int) error {
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return &Error{Code: code, Err: err}
+}
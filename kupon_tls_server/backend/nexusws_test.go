@@ -0,0 +1,16 @@
+package backend
+
+import (
+	"context"
+	"nexusws/cmd/kupon_tls_server/zreport/zfile"
+	"nexusws/pkg/nexushttpclient/zreport"
+	"testing"
+)
+
+func TestNexusWSZReportSummary(t *testing.T) {
+	b := NewNexusWS(nil, nil, nil)
+	err := b.InsertZReport(context.Background(), &zreport.ZReport{}, &zfile.Summary{})
+	if err != nil {
+		t.Errorf("report with a summary refused: %v", err)
+	}
+}
@@ -0,0 +1,320 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/google/uuid"
+	nxCtx "nexusws/pkg/context"
+	"nexusws/pkg/nexushttpclient"
+	v13 "nexusws/pkg/nexushttpclient/v13"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	outboxFileSuffix  = ".json"
+	outboxFailedDir   = "failed"
+	outboxBackoffMin  = time.Second
+	outboxBackoffMax  = time.Minute
+	outboxIdleRecheck = 30 * time.Second
+)
+
+// Outbox makes the raw and the JSON insert of a G message succeed or fail
+// together. Enqueue durably stores both requests and the register is ACKed
+// once it returns; a single worker then delivers the entries in order. The
+// entry records when the raw insert has been accepted, so a failed JSON
+// insert is retried on its own and never duplicates the raw row. An entry
+// rejected by NexusWS with an error code is moved to failed/ for manual
+// handling instead of blocking the ones behind it. Deliveries go through the
+// same Resilience as the direct calls, an open breaker holds the outbox back.
+type Outbox struct {
+	dir string
+	// insertRaw and insertJSON are the SlipClient calls, an *Error when
+	// NexusWS answers with an error code
+	insertRaw  func(ctx context.Context, req *nexushttpclient.SlipDataRawInsertReq) error
+	insertJSON func(ctx context.Context, slip *v13.MessageG) error
+	res        *Resilience
+	l          log.Logger
+
+	wake chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+type outboxEntry struct {
+	ID          string                                `json:"id"`
+	TraceID     string                                `json:"trace_id"`
+	Created     time.Time                             `json:"created"`
+	Raw         *nexushttpclient.SlipDataRawInsertReq `json:"raw"`
+	Slip        *v13.MessageG                         `json:"slip"`
+	RawInserted bool                                  `json:"raw_inserted"`
+	Attempts    int                                   `json:"attempts"`
+}
+
+func NewOutbox(l log.Logger, nexusCl *nexushttpclient.SlipClient, res *Resilience, dir string) (*Outbox, error) {
+	o, err := newOutbox(l, res, dir)
+	if err != nil {
+		return nil, err
+	}
+	o.insertRaw = func(ctx context.Context, req *nexushttpclient.SlipDataRawInsertReq) error {
+		sresp, err := nexusCl.SlipRawInsert(ctx, req)
+		if err != nil {
+			return err
+		}
+		if sresp.ErrorCode != 0 {
+			return &Error{Code: sresp.ErrorCode, Err: errors.New(sresp.ErrorMessage)}
+		}
+		return nil
+	}
+	o.insertJSON = func(ctx context.Context, slip *v13.MessageG) error {
+		sresp, err := nexusCl.SlipJSONInsert13(ctx, slip)
+		if err != nil {
+			return err
+		}
+		if sresp.ErrorCode != 0 {
+			return &Error{Code: sresp.ErrorCode, Err: errors.New(sresp.ErrorMessage)}
+		}
+		return nil
+	}
+
+	o.wg.Add(1)
+	go o.run()
+
+	return o, nil
+}
+
+// newOutbox returns an outbox without its worker and its SlipClient calls.
+func newOutbox(l log.Logger, res *Resilience, dir string) (*Outbox, error) {
+	if dir == "" {
+		return nil, errors.New("outbox directory is not set")
+	}
+	err := os.MkdirAll(filepath.Join(dir, outboxFailedDir), 0750)
+	if err != nil {
+		return nil, err
+	}
+	return &Outbox{
+		dir:  dir,
+		res:  res,
+		l:    l,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}, nil
+}
+
+func (o *Outbox) Close() {
+	close(o.done)
+	o.wg.Wait()
+}
+
+func (o *Outbox) Enqueue(ctx context.Context, raw *nexushttpclient.SlipDataRawInsertReq, slip *v13.MessageG) error {
+	now := time.Now().UTC()
+	e := &outboxEntry{
+		// the name sorts in arrival order
+		ID:      fmt.Sprintf("%s-%s", now.Format("20060102T150405.000000000"), uuid.New().String()),
+		TraceID: nxCtx.GetTraceId(ctx),
+		Created: now,
+		Raw:     raw,
+		Slip:    slip,
+	}
+	err := o.save(e)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (o *Outbox) run() {
+	defer o.wg.Done()
+
+	backoff := outboxBackoffMin
+	for {
+		delivered, err := o.deliverAll()
+
+		wait := outboxIdleRecheck
+		wake := o.wake
+		if err != nil {
+			level.Error(o.l).Log("outbox", "deliver", "delivered", delivered, "err", err)
+
+			// keep backing off while NexusWS is failing, new entries included
+			wait = backoff
+			wake = nil
+			backoff *= 2
+			if backoff > outboxBackoffMax {
+				backoff = outboxBackoffMax
+			}
+		} else {
+			backoff = outboxBackoffMin
+		}
+
+		select {
+		case <-o.done:
+			return
+		case <-wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// deliverAll delivers pending entries in order and stops at the first one
+// that can be retried later.
+func (o *Outbox) deliverAll() (int, error) {
+	names, err := o.entries()
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, name := range names {
+		select {
+		case <-o.done:
+			return delivered, nil
+		default:
+		}
+
+		e, err := o.load(name)
+		if err != nil {
+			level.Error(o.l).Log("outbox", "load", "entry", name, "err", err)
+			o.moveToFailed(name)
+			continue
+		}
+
+		err = o.deliver(e)
+		if err != nil {
+			var werr *Error
+			if errors.As(err, &werr) && !errors.Is(err, ErrCircuitOpen) {
+				level.Error(o.l).Log("outbox", "rejected", "entry", e.ID, "trace_id", e.TraceID, "err", err)
+				o.moveToFailed(name)
+				continue
+			}
+			e.Attempts++
+			serr := o.save(e)
+			if serr != nil {
+				level.Error(o.l).Log("outbox", "save", "entry", e.ID, "err", serr)
+			}
+			return delivered, err
+		}
+
+		err = os.Remove(filepath.Join(o.dir, name))
+		if err != nil {
+			return delivered, err
+		}
+		delivered++
+	}
+	return delivered, nil
+}
+
+// deliver returns an *Error when NexusWS rejected the entry and a plain error
+// when the call should be retried.
+func (o *Outbox) deliver(e *outboxEntry) error {
+	ctx, cancel := o.res.WithBudget(nxCtx.WithTraceID(context.Background(), e.TraceID))
+	defer cancel()
+
+	if !e.RawInserted {
+		err := o.res.Do(ctx, "SlipRawInsert", func(ctx context.Context) error {
+			return o.insertRaw(ctx, e.Raw)
+		})
+		if err != nil {
+			return err
+		}
+
+		e.RawInserted = true
+		err = o.save(e)
+		if err != nil {
+			return err
+		}
+	}
+
+	return o.res.Do(ctx, "SlipJSONInsert13", func(ctx context.Context) error {
+		return o.insertJSON(ctx, e.Slip)
+	})
+}
+
+func (o *Outbox) entries() ([]string, error) {
+	dirEntries, err := os.ReadDir(o.dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(dirEntries))
+	for _, d := range dirEntries {
+		if d.IsDir() || !strings.HasSuffix(d.Name(), outboxFileSuffix) {
+			continue
+		}
+		names = append(names, d.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (o *Outbox) load(name string) (*outboxEntry, error) {
+	data, err := os.ReadFile(filepath.Join(o.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	e := &outboxEntry{}
+	err = json.Unmarshal(data, e)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// save replaces the entry file atomically: write a temp file, fsync it and
+// rename it over the old one.
+func (o *Outbox) save(e *outboxEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Join(o.dir, e.ID+outboxFileSuffix)
+	tmp := name + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, name)
+	if err != nil {
+		return err
+	}
+
+	d, err := os.Open(o.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (o *Outbox) moveToFailed(name string) {
+	err := os.Rename(filepath.Join(o.dir, name), filepath.Join(o.dir, outboxFailedDir, name))
+	if err != nil {
+		level.Error(o.l).Log("outbox", "move_failed", "entry", name, "err", err)
+	}
+}
@@ -0,0 +1,187 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kit/kit/log"
+	"nexusws/pkg/nexushttpclient"
+	v13 "nexusws/pkg/nexushttpclient/v13"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeNexusWS records the inserts of an outbox by message id, see enqueue,
+// and answers them with the errors set for that id.
+type fakeNexusWS struct {
+	raw     []string
+	json    []string
+	rawErr  map[string]error
+	jsonErr map[string]error
+}
+
+func newTestOutbox(t *testing.T, dir string, ws *fakeNexusWS) *Outbox {
+	o, err := newOutbox(log.NewNopLogger(), nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.insertRaw = func(ctx context.Context, req *nexushttpclient.SlipDataRawInsertReq) error {
+		if err := ws.rawErr[req.RawSlipData]; err != nil {
+			return err
+		}
+		ws.raw = append(ws.raw, req.RawSlipData)
+		return nil
+	}
+	o.insertJSON = func(ctx context.Context, slip *v13.MessageG) error {
+		if err := ws.jsonErr[slip.Checksum]; err != nil {
+			return err
+		}
+		ws.json = append(ws.json, slip.Checksum)
+		return nil
+	}
+	return o
+}
+
+// enqueue queues a message whose raw data and checksum are both id.
+func enqueue(t *testing.T, o *Outbox, ids ...string) {
+	for _, id := range ids {
+		err := o.Enqueue(context.Background(), &nexushttpclient.SlipDataRawInsertReq{RawSlipData: id}, &v13.MessageG{Checksum: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func pending(t *testing.T, o *Outbox) []*outboxEntry {
+	names, err := o.entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make([]*outboxEntry, len(names))
+	for i, name := range names {
+		entries[i], err = o.load(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return entries
+}
+
+func TestOutboxDeliversInOrder(t *testing.T) {
+	ws := &fakeNexusWS{}
+	o := newTestOutbox(t, t.TempDir(), ws)
+	enqueue(t, o, "a", "b", "c")
+
+	delivered, err := o.deliverAll()
+	if err != nil || delivered != 3 {
+		t.Fatalf("delivered %d, err %v", delivered, err)
+	}
+	if strings.Join(ws.raw, "") != "abc" || strings.Join(ws.json, "") != "abc" {
+		t.Errorf("raw %v, json %v", ws.raw, ws.json)
+	}
+	if e := pending(t, o); len(e) != 0 {
+		t.Errorf("%d entries left", len(e))
+	}
+}
+
+func TestOutboxResumesAfterRawInsert(t *testing.T) {
+	dir := t.TempDir()
+	ws := &fakeNexusWS{jsonErr: map[string]error{"a": errors.New("connection reset")}}
+	o := newTestOutbox(t, dir, ws)
+	enqueue(t, o, "a", "b")
+
+	// the JSON insert fails after the raw insert, b waits behind a
+	delivered, err := o.deliverAll()
+	if err == nil || delivered != 0 {
+		t.Fatalf("delivered %d, err %v", delivered, err)
+	}
+	entries := pending(t, o)
+	if len(entries) != 2 || !entries[0].RawInserted || entries[0].Attempts != 1 || entries[1].RawInserted {
+		t.Fatalf("entries after the failed JSON insert %+v %+v", entries[0], entries[1])
+	}
+
+	// after a restart the raw row of a is not inserted again
+	ws.jsonErr = nil
+	o = newTestOutbox(t, dir, ws)
+	delivered, err = o.deliverAll()
+	if err != nil || delivered != 2 {
+		t.Fatalf("delivered %d, err %v", delivered, err)
+	}
+	if strings.Join(ws.raw, "") != "ab" || strings.Join(ws.json, "") != "ab" {
+		t.Errorf("raw %v, json %v", ws.raw, ws.json)
+	}
+}
+
+func TestOutboxRetriesFromDisk(t *testing.T) {
+	dir := t.TempDir()
+	ws := &fakeNexusWS{rawErr: map[string]error{"a": errors.New("connection refused")}}
+	o := newTestOutbox(t, dir, ws)
+	enqueue(t, o, "a", "b")
+
+	if _, err := o.deliverAll(); err == nil {
+		t.Fatal("no error while NexusWS is down")
+	}
+	if len(ws.raw) != 0 {
+		t.Fatalf("raw %v delivered past a failed entry", ws.raw)
+	}
+
+	ws.rawErr = nil
+	o = newTestOutbox(t, dir, ws)
+	delivered, err := o.deliverAll()
+	if err != nil || delivered != 2 || strings.Join(ws.json, "") != "ab" {
+		t.Errorf("delivered %d, json %v, err %v", delivered, ws.json, err)
+	}
+}
+
+func TestOutboxMovesRejectedToFailed(t *testing.T) {
+	dir := t.TempDir()
+	ws := &fakeNexusWS{jsonErr: map[string]error{"b": &Error{Code: 1, Err: errors.New("rejected")}}}
+	o := newTestOutbox(t, dir, ws)
+	enqueue(t, o, "a", "b", "c")
+	// an entry that can not be read goes to failed/ as well
+	err := os.WriteFile(filepath.Join(dir, "20000101T000000.000000000-x"+outboxFileSuffix), []byte("{"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivered, err := o.deliverAll()
+	if err != nil || delivered != 2 || strings.Join(ws.json, "") != "ac" {
+		t.Fatalf("delivered %d, json %v, err %v", delivered, ws.json, err)
+	}
+	failed, err := os.ReadDir(filepath.Join(dir, outboxFailedDir))
+	if err != nil || len(failed) != 2 {
+		t.Fatalf("failed/ %v, err %v", failed, err)
+	}
+	if e := pending(t, o); len(e) != 0 {
+		t.Errorf("%d entries left", len(e))
+	}
+}
+
+func TestOutboxSave(t *testing.T) {
+	dir := t.TempDir()
+	o := newTestOutbox(t, dir, &fakeNexusWS{})
+	enqueue(t, o, "a")
+	// a temp file left by a crash during save is not an entry
+	err := os.WriteFile(filepath.Join(dir, "x"+outboxFileSuffix+".tmp"), []byte("{"), 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := pending(t, o)
+	if len(entries) != 1 {
+		t.Fatalf("%d entries", len(entries))
+	}
+	e := entries[0]
+	e.RawInserted = true
+	if err = o.save(e); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, e.ID+outboxFileSuffix+".tmp")); !os.IsNotExist(err) {
+		t.Errorf("temp file left: %v", err)
+	}
+	entries = pending(t, o)
+	if len(entries) != 1 || !entries[0].RawInserted || entries[0].Slip.Checksum != "a" {
+		t.Errorf("entry after save %+v", entries[0])
+	}
+}
@@ -0,0 +1,326 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/google/uuid"
+	_ "github.com/lib/pq"
+	"nexusws/cmd/kupon_tls_server/registry"
+	"nexusws/cmd/kupon_tls_server/slipfields"
+	"nexusws/cmd/kupon_tls_server/sliplines"
+	"nexusws/cmd/kupon_tls_server/zreport/zfile"
+	nxCtx "nexusws/pkg/context"
+	"nexusws/pkg/nexus_errors"
+	v13 "nexusws/pkg/nexushttpclient/v13"
+	"nexusws/pkg/nexushttpclient/zreport"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// postgresMigrationLock is the pg_advisory_lock key that keeps two servers
+// starting at the same time from migrating concurrently.
+const postgresMigrationLock = 0x6b75706f6e // "kupon"
+
+var slipLineField = regexp.MustCompile(`^Line([A-Z])$`)
+
+// Postgres writes messages straight into the schema in migrations/ instead of
+// going through NexusWS. A G message is stored in a single transaction that
+// has committed by the time InsertSlip returns.
+type Postgres struct {
+	db          *sql.DB
+	qrURLPrefix string
+	l           log.Logger
+}
+
+func NewPostgres(ctx context.Context, l log.Logger, dsn string, qrURLPrefix string) (*Postgres, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	err = db.PingContext(ctx)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	b := &Postgres{db: db, qrURLPrefix: qrURLPrefix, l: l}
+	err = b.migrate(ctx)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *Postgres) Close() error {
+	return b.db.Close()
+}
+
+func (b *Postgres) InsertSlip(ctx context.Context, msg *sliplines.Message, typed *slipfields.Message, raw []byte) error {
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return &Error{Code: nexus_errors.ErrUnableToSaveSlipData, Err: err}
+	}
+	defer tx.Rollback()
+
+	ownerTIN, businessUnit, location := deviceColumns(ctx)
+	var messageID int64
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO slip_messages (ecr_serial, protocol_version, type_identifier, checksum, raw_message, trace_id, owner_tin, business_unit, location)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+		msg.Header.EcrSerial, msg.Header.ProtocolVersion, msg.Header.TypeIdentifier, msg.Checksum, raw, nxCtx.GetTraceId(ctx), ownerTIN, businessUnit, location,
+	).Scan(&messageID)
+	if err != nil {
+		return &Error{Code: nexus_errors.ErrUnableToSaveSlipData, Err: err}
+	}
+
+	for i, sr := range msg.Records {
+		var recordID int64
+		err = tx.QueryRowContext(ctx,
+			`INSERT INTO slip_records (message_id, ecr_serial, mac, z_report, slip_serial, daily_slip_no, is_transmitted_in_background)
+			VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+			messageID, msg.Header.EcrSerial, sr.Mac, sr.ZReport, sr.SlipSerial, sr.DailySlipNo, sr.IsTransmittedInBackground,
+		).Scan(&recordID)
+		if err != nil {
+			return &Error{Code: nexus_errors.ErrUnableToSaveSlipData, Err: err}
+		}
+
+		var lines []slipLine
+		if typed != nil {
+			lines, err = typedSlipLines(&typed.Records[i])
+		} else {
+			lines, err = slipLines(&msg.Records[i])
+		}
+		if err != nil {
+			return &Error{Code: nexus_errors.ErrUnableToSaveSlipData, Err: err}
+		}
+		for _, line := range lines {
+			_, err = tx.ExecContext(ctx,
+				`INSERT INTO slip_lines (record_id, line_type, line_index, data) VALUES ($1, $2, $3, $4)`,
+				recordID, line.lineType, line.index, string(line.data),
+			)
+			if err != nil {
+				return &Error{Code: nexus_errors.ErrUnableToSaveSlipData, Err: err}
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return &Error{Code: nexus_errors.ErrUnableToSaveSlipData, Err: err}
+	}
+	return nil
+}
+
+func (b *Postgres) InsertSlipValidation(ctx context.Context, req *v13.SlipValidationInsertReq) (string, error) {
+	qrCode := b.qrURLPrefix + uuid.New().String()
+
+	ownerTIN, businessUnit, location := deviceColumns(ctx)
+	_, err := b.db.ExecContext(ctx,
+		`INSERT INTO slip_validations (ecr_serial, mac, z_report, daily_slip_no, slip_serial, md5, qr_code, trace_id, owner_tin, business_unit, location)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		req.Identificationnumber, req.Nrmac, req.Nrzreport, req.Dailyslipno, req.Slipserial, req.Md5, qrCode, nxCtx.GetTraceId(ctx), ownerTIN, businessUnit, location,
+	)
+	if err != nil {
+		return "", &Error{Code: nexus_errors.ErrUnableToSaveSlipData, Err: err}
+	}
+	return qrCode, nil
+}
+
+func (b *Postgres) InsertZReport(ctx context.Context, report *zreport.ZReport, summary *zfile.Summary) error {
+	content, err := base64.StdEncoding.DecodeString(report.FileContentBase64)
+	if err != nil {
+		return &Error{Code: nexus_errors.ErrErrorSavingZReport, Err: err}
+	}
+
+	var summaryJSON sql.NullString
+	if summary != nil {
+		data, err := json.Marshal(summary)
+		if err != nil {
+			return &Error{Code: nexus_errors.ErrErrorSavingZReport, Err: err}
+		}
+		summaryJSON = sql.NullString{String: string(data), Valid: true}
+	}
+
+	ownerTIN, businessUnit, location := deviceColumns(ctx)
+	_, err = b.db.ExecContext(ctx,
+		`INSERT INTO z_reports (ecr_serial, protocol_version, file_name, file_content, summary, trace_id, owner_tin, business_unit, location)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		report.ECRSerial, report.ProtocolVersion, report.FileName, content, summaryJSON, nxCtx.GetTraceId(ctx), ownerTIN, businessUnit, location,
+	)
+	if err != nil {
+		return &Error{Code: nexus_errors.ErrErrorSavingZReport, Err: err}
+	}
+	return nil
+}
+
+// deviceColumns returns the registry attributes of the device in ctx, NULL
+// without one.
+func deviceColumns(ctx context.Context) (ownerTIN, businessUnit, location sql.NullString) {
+	d := registry.FromContext(ctx)
+	if d == nil {
+		return
+	}
+	return sql.NullString{String: d.OwnerTIN, Valid: true},
+		sql.NullString{String: d.BusinessUnit, Valid: true},
+		sql.NullString{String: d.Location, Valid: true}
+}
+
+// migrate applies the files in migrations/ that are not yet recorded in
+// schema_migrations, in file name order, each in its own transaction.
+func (b *Postgres) migrate(ctx context.Context) error {
+	conn, err := b.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, postgresMigrationLock)
+	if err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, postgresMigrationLock)
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    VARCHAR(64) PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return err
+	}
+
+	entries, err := migrations.ReadDir("migrations")
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		version := strings.TrimSuffix(name, ".sql")
+
+		var applied bool
+		err = conn.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, version).Scan(&applied)
+		if err != nil {
+			return err
+		}
+		if applied {
+			continue
+		}
+
+		stmts, err := migrations.ReadFile(path.Join("migrations", name))
+		if err != nil {
+			return err
+		}
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, string(stmts))
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %s: %w", name, err)
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		level.Info(b.l).Log("postgres", "migrated", "version", version)
+	}
+	return nil
+}
+
+type slipLine struct {
+	lineType string
+	index    int
+	data     []byte
+}
+
+// slipLines returns the JSON of every line set on sr, see EachLine.
+func slipLines(sr *sliplines.Record) ([]slipLine, error) {
+	lines := make([]slipLine, 0)
+
+	err := sr.EachLine(func(name string, f reflect.Value) error {
+		m := slipLineField.FindStringSubmatch(name)
+		if m == nil {
+			return nil
+		}
+		switch f.Kind() {
+		case reflect.Ptr:
+			if f.IsNil() {
+				return nil
+			}
+			data, err := json.Marshal(f.Interface())
+			if err != nil {
+				return err
+			}
+			lines = append(lines, slipLine{lineType: m[1], index: 0, data: data})
+		case reflect.Slice:
+			for j := 0; j < f.Len(); j++ {
+				data, err := json.Marshal(f.Index(j).Interface())
+				if err != nil {
+					return err
+				}
+				lines = append(lines, slipLine{lineType: m[1], index: j, data: data})
+			}
+		}
+		return nil
+	})
+	return lines, err
+}
+
+// typedSlipLines returns the lines of a typed record like slipLines does for
+// a v13 one, the data holds the typed values.
+func typedSlipLines(r *slipfields.Record) ([]slipLine, error) {
+	names := make([]string, 0, len(r.Lines))
+	for name := range r.Lines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]slipLine, 0)
+	for _, name := range names {
+		m := slipLineField.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		var values []map[string]interface{}
+		switch v := r.Lines[name].(type) {
+		case []map[string]interface{}:
+			values = v
+		case map[string]interface{}:
+			values = []map[string]interface{}{v}
+		default:
+			return nil, fmt.Errorf("%s: unexpected value %T", name, v)
+		}
+		for j, v := range values {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, slipLine{lineType: m[1], index: j, data: data})
+		}
+	}
+	return lines, nil
+}
@@ -0,0 +1,37 @@
+package backend
+
+import (
+	"nexusws/cmd/kupon_tls_server/slipfields"
+	"testing"
+)
+
+func TestTypedSlipLines(t *testing.T) {
+	r := &slipfields.Record{Lines: map[string]interface{}{
+		"LineB": []map[string]interface{}{
+			{"Price": slipfields.Decimal{Units: 120, Scale: 2}},
+			{"Price": slipfields.Decimal{Units: 5, Scale: 2}},
+		},
+		"LineA": map[string]interface{}{"Text": "Kafe"},
+	}}
+	lines, err := typedSlipLines(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		lineType string
+		index    int
+		data     string
+	}{
+		{"A", 0, `{"Text":"Kafe"}`},
+		{"B", 0, `{"Price":1.20}`},
+		{"B", 1, `{"Price":0.05}`},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(lines), len(want))
+	}
+	for i, w := range want {
+		if l := lines[i]; l.lineType != w.lineType || l.index != w.index || string(l.data) != w.data {
+			t.Errorf("line %d: %s %d %s, want %+v", i, l.lineType, l.index, l.data, w)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"math/rand"
+	"nexusws/cmd/kupon_tls_server/kupon_errors"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("backend unavailable, circuit breaker is open")
+
+var (
+	backendCalls = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Namespace: "kupon",
+		Subsystem: "backend",
+		Name:      "calls_total",
+		Help:      "Backend calls by operation and result.",
+	}, []string{"op", "result"})
+	backendRetries = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Namespace: "kupon",
+		Subsystem: "backend",
+		Name:      "retries_total",
+		Help:      "Backend calls retried after a failure.",
+	}, []string{"op"})
+	backendBreakerOpen = kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+		Namespace: "kupon",
+		Subsystem: "backend",
+		Name:      "circuit_breaker_open",
+		Help:      "1 while the backend circuit breaker is open or half open.",
+	}, []string{})
+)
+
+// DefaultBreakerFailures is used when ResilienceConfig.BreakerFailures is not
+// set, a single failed call must not stop every register.
+const DefaultBreakerFailures = 5
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+type ResilienceConfig struct {
+	MaxAttempts int
+	BackoffMin  time.Duration
+	BackoffMax  time.Duration
+	// Budget bounds all calls and retries made for one message.
+	Budget time.Duration
+	// BreakerFailures consecutive failed calls open the breaker for
+	// BreakerOpenFor, after which a single trial call decides whether it
+	// closes again. DefaultBreakerFailures when not set.
+	BreakerFailures int
+	BreakerOpenFor  time.Duration
+}
+
+// Resilience retries failed backend calls with jittered exponential backoff
+// and stops calling the backend while it keeps failing. Only plain errors are
+// retried and counted as failures; an *Error is an answer from the backend
+// and is returned as is. A nil *Resilience calls straight through.
+type Resilience struct {
+	cfg ResilienceConfig
+	l   log.Logger
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+func NewResilience(l log.Logger, cfg ResilienceConfig) *Resilience {
+	if cfg.BreakerFailures <= 0 {
+		cfg.BreakerFailures = DefaultBreakerFailures
+	}
+	r := &Resilience{
+		cfg:   cfg,
+		l:     l,
+		state: breakerClosed,
+	}
+	backendBreakerOpen.Set(0)
+	return r
+}
+
+// WithBudget returns ctx limited to the per-message budget.
+func (r *Resilience) WithBudget(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r == nil || r.cfg.Budget <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, r.cfg.Budget)
+}
+
+// Do runs f until it succeeds, returns an *Error, runs out of attempts or ctx
+// is done. While the breaker is open it fails fast with an *Error carrying
+// kupon_errors.ErrBackendUnavailable.
+func (r *Resilience) Do(ctx context.Context, op string, f func(ctx context.Context) error) error {
+	if r == nil {
+		return f(ctx)
+	}
+
+	backoff := r.cfg.BackoffMin
+	for attempt := 1; ; attempt++ {
+		if !r.allow() {
+			backendCalls.With("op", op, "result", "rejected").Add(1)
+			return &Error{Code: kupon_errors.ErrBackendUnavailable, Err: ErrCircuitOpen}
+		}
+
+		err := f(ctx)
+		var berr *Error
+		if err == nil || errors.As(err, &berr) {
+			r.record(true)
+			if err == nil {
+				backendCalls.With("op", op, "result", "ok").Add(1)
+			} else {
+				backendCalls.With("op", op, "result", "rejected_by_backend").Add(1)
+			}
+			return err
+		}
+		r.record(false)
+		backendCalls.With("op", op, "result", "failed").Add(1)
+
+		if attempt >= r.cfg.MaxAttempts {
+			return err
+		}
+
+		// full jitter keeps registers reconnecting together from retrying in step
+		sleep := time.Duration(rand.Int63n(int64(backoff) + 1))
+		deadline, ok := ctx.Deadline()
+		if ok && time.Until(deadline) < sleep {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(sleep):
+		}
+
+		backendRetries.With("op", op).Add(1)
+		level.Info(r.l).Log("backend", "retry", "op", op, "attempt", attempt, "err", err)
+
+		backoff *= 2
+		if backoff > r.cfg.BackoffMax {
+			backoff = r.cfg.BackoffMax
+		}
+	}
+}
+
+func (r *Resilience) allow() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch r.state {
+	case breakerOpen:
+		if time.Since(r.openedAt) < r.cfg.BreakerOpenFor {
+			return false
+		}
+		r.setState(breakerHalfOpen)
+		r.trial = true
+		return true
+	case breakerHalfOpen:
+		// only the trial call goes through
+		if r.trial {
+			return false
+		}
+		r.trial = true
+		return true
+	}
+	return true
+}
+
+func (r *Resilience) record(success bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if success {
+		r.failures = 0
+		r.trial = false
+		if r.state != breakerClosed {
+			r.setState(breakerClosed)
+		}
+		return
+	}
+
+	r.failures++
+	r.trial = false
+	if r.state == breakerHalfOpen || (r.state == breakerClosed && r.failures >= r.cfg.BreakerFailures) {
+		r.openedAt = time.Now()
+		r.setState(breakerOpen)
+	}
+}
+
+func (r *Resilience) setState(state string) {
+	level.Warn(r.l).Log("backend", "circuit_breaker", "from", r.state, "to", state, "failures", r.failures)
+	r.state = state
+	if state == breakerClosed {
+		backendBreakerOpen.Set(0)
+	} else {
+		backendBreakerOpen.Set(1)
+	}
+}
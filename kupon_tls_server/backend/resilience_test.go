@@ -0,0 +1,92 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kit/kit/log"
+	"nexusws/cmd/kupon_tls_server/kupon_errors"
+	"testing"
+	"time"
+)
+
+func TestResilienceRetriesTransportErrors(t *testing.T) {
+	r := NewResilience(log.NewNopLogger(), ResilienceConfig{
+		MaxAttempts:     3,
+		BackoffMin:      time.Millisecond,
+		BackoffMax:      time.Millisecond,
+		BreakerFailures: 10,
+		BreakerOpenFor:  time.Minute,
+	})
+
+	calls := 0
+	err := r.Do(context.Background(), "test", func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return errors.New("connection reset")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("expected success on third call, got err %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	err = r.Do(context.Background(), "test", func(ctx context.Context) error {
+		calls++
+		return &Error{Code: 1, Err: errors.New("rejected")}
+	})
+	if NackCode(err, 0) != 1 || calls != 1 {
+		t.Fatalf("backend answer must not be retried, got err %v after %d calls", err, calls)
+	}
+}
+
+func TestResilienceCircuitBreaker(t *testing.T) {
+	r := NewResilience(log.NewNopLogger(), ResilienceConfig{
+		MaxAttempts:     1,
+		BreakerFailures: 2,
+		BreakerOpenFor:  20 * time.Millisecond,
+	})
+	fail := func(ctx context.Context) error { return errors.New("timeout") }
+	ok := func(ctx context.Context) error { return nil }
+
+	r.Do(context.Background(), "test", fail)
+	r.Do(context.Background(), "test", fail)
+
+	err := r.Do(context.Background(), "test", ok)
+	if NackCode(err, 0) != kupon_errors.ErrBackendUnavailable {
+		t.Fatalf("expected breaker to be open, got %v", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	err = r.Do(context.Background(), "test", ok)
+	if err != nil {
+		t.Fatalf("expected half open trial to go through, got %v", err)
+	}
+	if r.state != breakerClosed {
+		t.Fatalf("expected breaker closed after successful trial, got %s", r.state)
+	}
+}
+
+func TestResilienceDefaultBreakerFailures(t *testing.T) {
+	r := NewResilience(log.NewNopLogger(), ResilienceConfig{
+		MaxAttempts:    1,
+		BreakerOpenFor: time.Minute,
+	})
+	fail := func(ctx context.Context) error { return errors.New("timeout") }
+	ok := func(ctx context.Context) error { return nil }
+
+	for i := 1; i < DefaultBreakerFailures; i++ {
+		r.Do(context.Background(), "test", fail)
+	}
+	if err := r.Do(context.Background(), "test", ok); err != nil {
+		t.Fatalf("breaker open after %d failures: %v", DefaultBreakerFailures-1, err)
+	}
+
+	for i := 0; i < DefaultBreakerFailures; i++ {
+		r.Do(context.Background(), "test", fail)
+	}
+	err := r.Do(context.Background(), "test", ok)
+	if NackCode(err, 0) != kupon_errors.ErrBackendUnavailable {
+		t.Fatalf("expected breaker to be open, got %v", err)
+	}
+}
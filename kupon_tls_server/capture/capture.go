@@ -0,0 +1,151 @@
+// Package capture records the traffic of selected registers for debugging.
+// For every register on the capture list, each inbound frame, the events it
+// produced and the responses sent back are appended to <dir>/<EcrSerial>.jsonl,
+// one Record per line. The file is read back with ReadFile.
+package capture
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"nexusws/cmd/kupon_tls_server/eventsink"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Record directions.
+const (
+	DirIn    = "in"    // frame received from the register
+	DirEvent = "event" // event written to the sinks for the frame
+	DirOut   = "out"   // response sent to the register
+)
+
+type Record struct {
+	Time      time.Time       `json:"time"`
+	Dir       string          `json:"dir"`
+	Session   string          `json:"session"` // trace ID of the connection
+	EcrSerial string          `json:"ecr_serial"`
+	Frame     string          `json:"frame,omitempty"` // hex, DirIn and DirOut
+	Event     json.RawMessage `json:"event,omitempty"` // eventsink.Event, DirEvent
+}
+
+// Bytes decodes Frame.
+func (r *Record) Bytes() ([]byte, error) {
+	return hex.DecodeString(r.Frame)
+}
+
+// Capturer holds the capture list. A nil Capturer captures nothing.
+type Capturer struct {
+	dir string
+
+	mu   sync.Mutex
+	list map[string]bool
+}
+
+func New(dir string, ecrSerials []string) (*Capturer, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	c := &Capturer{dir: dir}
+	c.Set(ecrSerials)
+	return c, nil
+}
+
+// Set replaces the capture list.
+func (c *Capturer) Set(ecrSerials []string) {
+	list := make(map[string]bool, len(ecrSerials))
+	for _, ecr := range ecrSerials {
+		list[ecr] = true
+	}
+	c.mu.Lock()
+	c.list = list
+	c.mu.Unlock()
+}
+
+func (c *Capturer) Add(ecrSerial string) {
+	c.mu.Lock()
+	c.list[ecrSerial] = true
+	c.mu.Unlock()
+}
+
+func (c *Capturer) Remove(ecrSerial string) {
+	c.mu.Lock()
+	delete(c.list, ecrSerial)
+	c.mu.Unlock()
+}
+
+// List returns the capture list, sorted.
+func (c *Capturer) List() []string {
+	c.mu.Lock()
+	list := make([]string, 0, len(c.list))
+	for ecr := range c.list {
+		list = append(list, ecr)
+	}
+	c.mu.Unlock()
+	sort.Strings(list)
+	return list
+}
+
+func (c *Capturer) Enabled(ecrSerial string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.list[ecrSerial]
+}
+
+// File returns the capture file of ecrSerial.
+func (c *Capturer) File(ecrSerial string) string {
+	return filepath.Join(c.dir, fileName(ecrSerial)+".jsonl")
+}
+
+// fileName keeps EcrSerials made of letters, digits, '-' and '_', others
+// are read from the frame as they are and get hex encoded.
+func fileName(ecrSerial string) string {
+	for _, r := range ecrSerial {
+		if !(r >= '0' && r <= '9' || r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r == '-' || r == '_') {
+			return "x" + hex.EncodeToString([]byte(ecrSerial))
+		}
+	}
+	if ecrSerial == "" {
+		return "x"
+	}
+	return ecrSerial
+}
+
+// Write records e with the frame being handled, see Recorder. It never
+// fails, so that capturing does not change the answer of the frame.
+func (c *Capturer) Write(ctx context.Context, e *eventsink.Event) error {
+	r := fromContext(ctx)
+	if r == nil || !c.Enabled(e.EcrSerial) {
+		return nil
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil
+	}
+	r.add(Record{Time: time.Now().UTC(), Dir: DirEvent, Event: b})
+	return nil
+}
+
+func (c *Capturer) append(ecrSerial string, records []Record) error {
+	f, err := os.OpenFile(c.File(ecrSerial), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for i := range records {
+		records[i].EcrSerial = ecrSerial
+		err = enc.Encode(&records[i])
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
@@ -0,0 +1,70 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"nexusws/cmd/kupon_tls_server/eventsink"
+	"os"
+	"testing"
+)
+
+func TestRecorder(t *testing.T) {
+	c, err := New(t.TempDir(), []string{"ECR0000001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handle := func(ecr string) {
+		var conn bytes.Buffer
+		rec := c.Recorder("trace-1", &conn)
+		ctx := rec.Context(context.Background())
+		c.Write(ctx, eventsink.NewEvent(ctx, eventsink.EventSlipValidation, ecr, nil, nil))
+		rec.Write([]byte("A0000"))
+		if conn.String() != "A0000" {
+			t.Fatalf("written %q", conn.String())
+		}
+		err := rec.Done(ecr, []byte("E14"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	handle("ECR0000001")
+	handle("ECR0000002")
+
+	records, err := ReadFile(c.File("ECR0000001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("records %+v", records)
+	}
+	for i, dir := range []string{DirIn, DirEvent, DirOut} {
+		if records[i].Dir != dir || records[i].Session != "trace-1" || records[i].EcrSerial != "ECR0000001" {
+			t.Errorf("record %d: %+v", i, records[i])
+		}
+	}
+	if b, _ := records[2].Bytes(); string(b) != "A0000" {
+		t.Errorf("response %q", b)
+	}
+	if _, err := os.Stat(c.File("ECR0000002")); !os.IsNotExist(err) {
+		t.Errorf("ECR0000002 captured: %v", err)
+	}
+
+	c.Remove("ECR0000001")
+	c.Add("ECR0000002")
+	if c.Enabled("ECR0000001") || !c.Enabled("ECR0000002") {
+		t.Errorf("list %v", c.List())
+	}
+}
+
+func TestFileName(t *testing.T) {
+	for ecr, want := range map[string]string{
+		"ECR0000001": "ECR0000001",
+		"../x":       "x2e2e2f78",
+		"":           "x",
+	} {
+		if got := fileName(ecr); got != want {
+			t.Errorf("%q: %q, want %q", ecr, got, want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package capture
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Recorder is the connection a frame is handled on. It keeps the responses
+// written and the events of the frame until Done, when the EcrSerial of the
+// frame is known.
+type Recorder struct {
+	io.ReadWriter
+	c       *Capturer
+	session string
+	started time.Time
+
+	mu      sync.Mutex
+	records []Record
+}
+
+// Recorder starts the handling of a frame received on rw by session. Pass
+// the context returned by Context to the handler.
+func (c *Capturer) Recorder(session string, rw io.ReadWriter) *Recorder {
+	return &Recorder{ReadWriter: rw, c: c, session: session, started: time.Now().UTC()}
+}
+
+func (r *Recorder) Write(b []byte) (int, error) {
+	if r.c != nil {
+		r.add(Record{Time: time.Now().UTC(), Dir: DirOut, Frame: hex.EncodeToString(b)})
+	}
+	return r.ReadWriter.Write(b)
+}
+
+func (r *Recorder) add(rec Record) {
+	r.mu.Lock()
+	r.records = append(r.records, rec)
+	r.mu.Unlock()
+}
+
+// Done appends frame, then the events and responses, to the capture file of
+// ecrSerial when it is on the capture list.
+func (r *Recorder) Done(ecrSerial string, frame []byte) error {
+	if !r.c.Enabled(ecrSerial) {
+		return nil
+	}
+	r.mu.Lock()
+	records := append([]Record{{Time: r.started, Dir: DirIn, Frame: hex.EncodeToString(frame)}}, r.records...)
+	r.mu.Unlock()
+	for i := range records {
+		records[i].Session = r.session
+	}
+	return r.c.append(ecrSerial, records)
+}
+
+type contextKey struct{}
+
+// Context returns ctx carrying r, for the events of the frame.
+func (r *Recorder) Context(ctx context.Context) context.Context {
+	if r.c == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKey{}, r)
+}
+
+func fromContext(ctx context.Context) *Recorder {
+	r, _ := ctx.Value(contextKey{}).(*Recorder)
+	return r
+}
+
+// ReadFile reads the records of a capture file.
+func ReadFile(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Read(f)
+}
+
+// Read reads capture records, one JSON object per line.
+func Read(r io.Reader) ([]Record, error) {
+	var records []Record
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 16<<20) // a v14 G frame is up to 1 MiB, hex encoded twice with its event
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var rec Record
+		err := json.Unmarshal(sc.Bytes(), &rec)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, sc.Err()
+}
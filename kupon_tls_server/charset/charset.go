@@ -0,0 +1,119 @@
+// Package charset transcodes text sent by registers in legacy single-byte
+// code pages to UTF-8.
+package charset
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Supported source encodings. UTF8 leaves the bytes as they are.
+const (
+	UTF8        = "utf-8"
+	Windows1250 = "windows-1250"
+	CP852       = "cp852"
+	ISO88592    = "iso-8859-2"
+)
+
+var encodings = map[string]*table{
+	Windows1250: &windows1250,
+	CP852:       &cp852,
+	ISO88592:    &iso88592,
+}
+
+// Config selects the source encoding of a register: by EcrSerial first, then
+// by protocol version, then Default. An empty name is UTF8.
+type Config struct {
+	Default          string            `yaml:"default"`
+	ProtocolVersions map[string]string `yaml:"protocol_versions"`
+	Devices          map[string]string `yaml:"devices"`
+}
+
+// Validate reports encoding names that are not supported.
+func (c *Config) Validate() error {
+	names := []string{c.Default}
+	for _, n := range c.ProtocolVersions {
+		names = append(names, n)
+	}
+	for _, n := range c.Devices {
+		names = append(names, n)
+	}
+	for _, n := range names {
+		_, err := lookup(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// For returns the transcoder of a register.
+func (c *Config) For(ecrSerial string, protocolVersion string) (*Transcoder, error) {
+	name := c.Default
+	if n, ok := c.ProtocolVersions[protocolVersion]; ok {
+		name = n
+	}
+	if n, ok := c.Devices[strings.TrimSpace(ecrSerial)]; ok {
+		name = n
+	}
+	tab, err := lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if tab == nil {
+		return nil, nil
+	}
+	return &Transcoder{name: name, tab: tab}, nil
+}
+
+func lookup(name string) (*table, error) {
+	name = strings.ToLower(name)
+	if name == "" || name == UTF8 {
+		return nil, nil
+	}
+	enc, ok := encodings[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported charset %q", name)
+	}
+	return enc, nil
+}
+
+// Transcoder decodes one register's text to UTF-8. A nil *Transcoder leaves
+// text unchanged. It is not safe for concurrent use.
+type Transcoder struct {
+	name string
+	tab  *table
+}
+
+func (t *Transcoder) Name() string {
+	if t == nil {
+		return UTF8
+	}
+	return t.name
+}
+
+// Bytes returns b in UTF-8. ASCII input is returned as is, without a copy.
+func (t *Transcoder) Bytes(b []byte) ([]byte, error) {
+	if t == nil || isASCII(b) {
+		return b, nil
+	}
+	out := make([]byte, 0, 2*len(b))
+	for _, c := range b {
+		if c < utf8.RuneSelf {
+			out = append(out, c)
+			continue
+		}
+		out = append(out, string(t.tab[c-utf8.RuneSelf])...)
+	}
+	return out, nil
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package charset
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTranscode(t *testing.T) {
+	cfg := &Config{
+		Default:          ISO88592,
+		ProtocolVersions: map[string]string{"13": Windows1250},
+		Devices:          map[string]string{"ECR852": CP852},
+	}
+	err := cfg.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		ecrSerial string
+		version   string
+		in        []byte
+		want      string
+	}{
+		// "Çelës" in each code page
+		{"windows-1250 by protocol version", "ECR1", "13", []byte{0xC7, 'e', 'l', 0xEB, 's'}, "Çelës"},
+		{"cp852 by device", "ECR852", "13", []byte{0x80, 'e', 'l', 0x89, 's'}, "Çelës"},
+		{"iso-8859-2 by default", "ECR1", "14", []byte{0xC7, 'e', 'l', 0xEB, 's'}, "Çelës"},
+		{"ascii", "ECR852", "13", []byte("Buke"), "Buke"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := cfg.For(tt.ecrSerial, tt.version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := tc.Bytes(tt.in)
+			if err != nil || string(got) != tt.want {
+				t.Errorf("got %q %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+
+	var none *Transcoder
+	got, _ := none.Bytes([]byte{0xEB})
+	if string(got) != "\xEB" {
+		t.Errorf("nil transcoder changed the input: %q", got)
+	}
+
+	// a few bytes of the tables, U+FFFD for those windows-1250 leaves undefined
+	for _, tt := range []struct {
+		name string
+		b    byte
+		want rune
+	}{
+		{Windows1250, 0x80, '€'},
+		{Windows1250, 0x81, utf8.RuneError},
+		{Windows1250, 0xA5, 'Ą'},
+		{CP852, 0x80, 'Ç'},
+		{CP852, 0xFF, '\u00A0'},
+		{ISO88592, 0xA1, 'Ą'},
+		{ISO88592, 0xFF, '˙'},
+	} {
+		tc, _ := (&Config{Default: tt.name}).For("ECR1", "13")
+		got, err := tc.Bytes([]byte{tt.b})
+		if err != nil || string(got) != string(tt.want) {
+			t.Errorf("%s %#x: got %q %v, want %q", tt.name, tt.b, got, err, tt.want)
+		}
+	}
+
+	err = (&Config{Devices: map[string]string{"ECR1": "koi8-r"}}).Validate()
+	if err == nil {
+		t.Error("expected an error for an unsupported charset")
+	}
+}
@@ -3,19 +3,104 @@ package main
 import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"nexusws/cmd/kupon_tls_server/charset"
+	"nexusws/cmd/kupon_tls_server/registry"
+	"nexusws/cmd/kupon_tls_server/slipcheck"
 	"path/filepath"
+	"time"
+)
+
+const (
+	BackendNexusWS  = "nexusws"
+	BackendPostgres = "postgres"
 )
 
 type Config struct {
 	Runtime string `yaml:"runtime"`
+	Backend string `yaml:"backend"`
 	NexusWS struct {
-		Host string `yaml:"host"`
-		Port int    `yaml:"port"`
+		Host          string `yaml:"host"`
+		Port          int    `yaml:"port"`
+		SlipWriteMode string `yaml:"slip_write_mode"`
+		OutboxDir     string `yaml:"outbox_dir"`
+		Retry         struct {
+			MaxAttempts int           `yaml:"max_attempts"`
+			BackoffMin  time.Duration `yaml:"backoff_min"`
+			BackoffMax  time.Duration `yaml:"backoff_max"`
+			Budget      time.Duration `yaml:"budget"`
+		} `yaml:"retry"`
+		CircuitBreaker struct {
+			Failures int           `yaml:"failures"`
+			OpenFor  time.Duration `yaml:"open_for"`
+		} `yaml:"circuit_breaker"`
 	} `yaml:"nexusws"`
+	Postgres struct {
+		DSN         string `yaml:"dsn"`
+		QrURLPrefix string `yaml:"qr_url_prefix"`
+	} `yaml:"postgres"`
 	TLSServer struct {
 		ListenPort string `yaml:"listen_port"`
 		ListenIP   string `yaml:"listen_ip"`
 	} `yaml:"tls_server"`
+	SlipRecord struct {
+		Parsing    string            `yaml:"parsing"`
+		JSONFormat string            `yaml:"json_format"`
+		FieldKinds map[string]string `yaml:"field_kinds"`
+		Validation slipcheck.Config  `yaml:"validation"`
+		Charset    charset.Config    `yaml:"charset"`
+	} `yaml:"slip_record"`
+	ZReport struct {
+		ContentParsing   string        `yaml:"content_parsing"`
+		UploadDir        string        `yaml:"upload_dir"`
+		UploadTTL        time.Duration `yaml:"upload_ttl"`
+		ArchiveRoot      string        `yaml:"archive_root"`
+		ArchiveRetention string        `yaml:"archive_retention"`
+		ArchiveMaxAge    time.Duration `yaml:"archive_max_age"`
+	} `yaml:"zreport"`
+	Metrics struct {
+		ListenAddress string `yaml:"listen_address"`
+	} `yaml:"metrics"`
+	FileSink struct {
+		Enabled       bool   `yaml:"enabled"`
+		Root          string `yaml:"root"`
+		MaxFileSizeMB int64  `yaml:"max_file_size_mb"`
+	} `yaml:"file_sink"`
+	Kafka struct {
+		Enabled     bool              `yaml:"enabled"`
+		Brokers     []string          `yaml:"brokers"`
+		Topics      map[string]string `yaml:"topics"`
+		BufferSize  int               `yaml:"buffer_size"`
+		MaxAttempts int               `yaml:"max_attempts"`
+	} `yaml:"kafka"`
+	Sequence struct {
+		Enabled        bool          `yaml:"enabled"`
+		Dir            string        `yaml:"dir"`
+		ResendInterval time.Duration `yaml:"resend_interval"`
+	} `yaml:"sequence"`
+	Reconciliation struct {
+		Enabled bool   `yaml:"enabled"`
+		Dir     string `yaml:"dir"`
+	} `yaml:"reconciliation"`
+	Signing struct {
+		KeyStore string `yaml:"key_store"`
+	} `yaml:"signing"`
+	Registry  registry.Config `yaml:"registry"`
+	Inventory struct {
+		Enabled     bool          `yaml:"enabled"`
+		File        string        `yaml:"file"`
+		SilentAfter time.Duration `yaml:"silent_after"`
+		WebhookURL  string        `yaml:"webhook_url"`
+	} `yaml:"inventory"`
+	Capture struct {
+		Dir        string   `yaml:"dir"`
+		EcrSerials []string `yaml:"ecr_serials"`
+	} `yaml:"capture"`
+	Admin struct {
+		ListenAddress string `yaml:"listen_address"`
+		Token         string `yaml:"token"`
+		CertFile      string `yaml:"cert_file"`
+		KeyFile       string `yaml:"key_file"`
+	} `yaml:"admin"`
 }
 
 func NewFromFile(file string, out interface{}) error {
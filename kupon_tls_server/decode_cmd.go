@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"nexusws/cmd/kupon_tls_server/capture"
+	"nexusws/cmd/kupon_tls_server/replay"
+	"os"
+)
+
+// decodeCmd prints capture files, one line per record:
+//
+//	kupon_tls_server decode [-dump] file...
+func decodeCmd(args []string) int {
+	fs := flag.NewFlagSet("decode", flag.ContinueOnError)
+	dump := fs.Bool("dump", false, "hex dump frames and print events")
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	for _, file := range fs.Args() {
+		records, err := capture.ReadFile(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, rec := range records {
+			fmt.Printf("%s %-5s %s %s %s\n", rec.Time.Format("2006-01-02T15:04:05.000"), rec.Dir, rec.Session, rec.EcrSerial, describe(&rec))
+			if !*dump {
+				continue
+			}
+			if rec.Dir == capture.DirEvent {
+				fmt.Printf("%s\n", rec.Event)
+				continue
+			}
+			b, _ := rec.Bytes()
+			fmt.Print(hex.Dump(b))
+		}
+	}
+	return 0
+}
+
+// describe summarizes a record: the event type, the responses, or the
+// identifier, protocol version and length of an inbound frame.
+func describe(rec *capture.Record) string {
+	if rec.Dir == capture.DirEvent {
+		var e struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal(rec.Event, &e)
+		return e.Type
+	}
+	b, err := rec.Bytes()
+	if err != nil {
+		return "bad frame: " + err.Error()
+	}
+	if rec.Dir == capture.DirOut {
+		return replay.DescribeResponse(b)
+	}
+	switch {
+	case len(b) == 0:
+		return "empty"
+	case len(b) >= 3:
+		return fmt.Sprintf("%c v%s %d bytes", b[0], b[1:3], len(b))
+	}
+	return fmt.Sprintf("%c %d bytes", b[0], len(b))
+}
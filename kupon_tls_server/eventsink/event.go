@@ -0,0 +1,50 @@
+package eventsink
+
+import (
+	"context"
+	"encoding/hex"
+	"nexusws/cmd/kupon_tls_server/registry"
+	nxCtx "nexusws/pkg/context"
+	"time"
+)
+
+// SchemaVersion is bumped whenever a field of Event changes meaning or is removed.
+// Adding fields does not require a new version.
+const SchemaVersion = 1
+
+const (
+	EventSlipRecord     = "slip_record"     // G message accepted
+	EventSlipValidation = "slip_validation" // E message accepted
+	EventZReport        = "zreport"         // W message accepted
+)
+
+type Event struct {
+	SchemaVersion int              `json:"schema_version"`
+	Type          string           `json:"type"`
+	Time          time.Time        `json:"time"`
+	TraceID       string           `json:"trace_id"`
+	EcrSerial     string           `json:"ecr_serial"`
+	Payload       interface{}      `json:"payload"`
+	RawHex        string           `json:"raw_hex,omitempty"`
+	Device        *registry.Device `json:"device,omitempty"` // nil without a registry
+}
+
+// Sink receives every accepted message once the backend has stored it, before
+// the register gets its ACK. A returned error is only logged: a NACK would
+// make the register send the stored message again.
+type Sink interface {
+	Write(ctx context.Context, e *Event) error
+}
+
+func NewEvent(ctx context.Context, eventType string, ecrSerial string, payload interface{}, raw []byte) *Event {
+	return &Event{
+		SchemaVersion: SchemaVersion,
+		Type:          eventType,
+		Time:          time.Now().UTC(),
+		TraceID:       nxCtx.GetTraceId(ctx),
+		EcrSerial:     ecrSerial,
+		Payload:       payload,
+		RawHex:        hex.EncodeToString(raw),
+		Device:        registry.FromContext(ctx),
+	}
+}
@@ -0,0 +1,190 @@
+package eventsink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+)
+
+const (
+	fileSinkDateLayout       = "2006-01-02"
+	fileSinkDefaultMaxSize   = 64 << 20
+	fileSinkUnknownEcrSerial = "unknown"
+)
+
+var ecrSerialUnsafeChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// FileSink appends events as newline-delimited JSON to
+// <root>/<yyyy-mm-dd>/<EcrSerial>/events-<n>.ndjson. A partition rolls over to
+// the next file once it grows past maxSize. Every write is fsynced before
+// Write returns. The register is ACKed even when Write fails, see Sink, so
+// the files can miss an event the backend stored; the error log names it.
+type FileSink struct {
+	root    string
+	maxSize int64
+	l       log.Logger
+
+	mu    sync.Mutex
+	day   string
+	files map[string]*partitionFile
+}
+
+type partitionFile struct {
+	f    *os.File
+	seq  int
+	size int64
+}
+
+func NewFileSink(l log.Logger, root string, maxSize int64) (*FileSink, error) {
+	if root == "" {
+		return nil, fmt.Errorf("file sink root directory is not set")
+	}
+	if maxSize <= 0 {
+		maxSize = fileSinkDefaultMaxSize
+	}
+	err := os.MkdirAll(root, 0750)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{
+		root:    root,
+		maxSize: maxSize,
+		l:       l,
+		files:   make(map[string]*partitionFile),
+	}, nil
+}
+
+func (s *FileSink) Write(ctx context.Context, e *Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	day := e.Time.UTC().Format(fileSinkDateLayout)
+	if day != s.day {
+		// partitions of the previous day will not be written again
+		s.closeAll()
+		s.day = day
+	}
+
+	p, err := s.partition(day, e.EcrSerial, int64(len(line)))
+	if err != nil {
+		return err
+	}
+
+	n, err := p.f.Write(line)
+	p.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return p.f.Sync()
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closeAll()
+	return nil
+}
+
+// partition returns the open file for day/ecrSerial, rotating it when the
+// next write of size bytes would exceed maxSize.
+func (s *FileSink) partition(day string, ecrSerial string, size int64) (*partitionFile, error) {
+	dir := filepath.Join(s.root, day, partitionName(ecrSerial))
+
+	p, ok := s.files[dir]
+	if !ok {
+		err := os.MkdirAll(dir, 0750)
+		if err != nil {
+			return nil, err
+		}
+
+		// continue with the last file left by a previous run
+		seq := 1
+		for {
+			_, err := os.Stat(partitionFileName(dir, seq+1))
+			if err != nil {
+				break
+			}
+			seq++
+		}
+		p, err = s.openFile(dir, seq)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.size > 0 && p.size+size > s.maxSize {
+		err := p.f.Close()
+		if err != nil {
+			level.Error(s.l).Log("file_sink", "close", "err", err)
+		}
+		delete(s.files, dir)
+
+		p, err = s.openFile(dir, p.seq+1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (s *FileSink) openFile(dir string, seq int) (*partitionFile, error) {
+	f, err := os.OpenFile(partitionFileName(dir, seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	syncDir(dir)
+
+	p := &partitionFile{f: f, seq: seq, size: fi.Size()}
+	s.files[dir] = p
+	return p, nil
+}
+
+func (s *FileSink) closeAll() {
+	for dir, p := range s.files {
+		err := p.f.Close()
+		if err != nil {
+			level.Error(s.l).Log("file_sink", "close", "err", err)
+		}
+		delete(s.files, dir)
+	}
+}
+
+func partitionName(ecrSerial string) string {
+	name := ecrSerialUnsafeChars.ReplaceAllString(ecrSerial, "_")
+	if name == "" {
+		return fileSinkUnknownEcrSerial
+	}
+	return name
+}
+
+func partitionFileName(dir string, seq int) string {
+	return filepath.Join(dir, fmt.Sprintf("events-%06d.ndjson", seq))
+}
+
+// syncDir makes a newly created file entry durable.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,138 @@
+package eventsink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var fileSinkDay = time.Date(2024, 3, 1, 23, 59, 0, 0, time.UTC)
+
+func event(ecrSerial string, t time.Time) *Event {
+	return &Event{SchemaVersion: SchemaVersion, Type: EventSlipRecord, Time: t, EcrSerial: ecrSerial, Payload: "x"}
+}
+
+// lines returns the events in name, failing the test when a line is not
+// an event.
+func lines(t *testing.T, name string) []Event {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make([]Event, 0)
+	for _, l := range bytes.Split(bytes.TrimSuffix(b, []byte("\n")), []byte("\n")) {
+		var e Event
+		if err = json.Unmarshal(l, &e); err != nil {
+			t.Fatalf("%s: %q: %v", name, l, err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestFileSinkPartitions(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewFileSink(log.NewNopLogger(), root, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, e := range []*Event{
+		event("ECR0000001", fileSinkDay),
+		event("ECR/2", fileSinkDay),
+		event("", fileSinkDay),
+		// a minute later is the next UTC day
+		event("ECR0000001", fileSinkDay.Add(time.Minute)),
+		event("ECR0000001", fileSinkDay),
+	} {
+		if err = s.Write(context.Background(), e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]int{
+		"2024-03-01/ECR0000001/events-000001.ndjson": 2,
+		"2024-03-01/ECR_2/events-000001.ndjson":      1,
+		"2024-03-01/unknown/events-000001.ndjson":    1,
+		"2024-03-02/ECR0000001/events-000001.ndjson": 1,
+	}
+	for name, n := range want {
+		if got := lines(t, filepath.Join(root, name)); len(got) != n {
+			t.Errorf("%s: %d events, want %d", name, len(got), n)
+		}
+	}
+}
+
+func TestFileSinkRotates(t *testing.T) {
+	root := t.TempDir()
+	line, _ := json.Marshal(event("ECR0000001", fileSinkDay))
+	// two events fit in a file
+	s, err := NewFileSink(log.NewNopLogger(), root, int64(2*(len(line)+1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err = s.Write(context.Background(), event("ECR0000001", fileSinkDay)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := filepath.Join(root, "2024-03-01", "ECR0000001")
+	for seq, n := range map[int]int{1: 2, 2: 2, 3: 1} {
+		if got := lines(t, partitionFileName(dir, seq)); len(got) != n {
+			t.Errorf("file %d: %d events, want %d", seq, len(got), n)
+		}
+	}
+
+	// written and synced before Write returned, the file is still open
+	if got := lines(t, partitionFileName(dir, 3)); got[0].EcrSerial != "ECR0000001" {
+		t.Errorf("event %+v", got[0])
+	}
+
+	// a restart appends to the last file until it is full
+	s.Close()
+	s, err = NewFileSink(log.NewNopLogger(), root, int64(2*(len(line)+1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 2; i++ {
+		if err = s.Write(context.Background(), event("ECR0000001", fileSinkDay)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := lines(t, partitionFileName(dir, 3)); len(got) != 2 {
+		t.Errorf("file 3: %d events after the restart", len(got))
+	}
+	if got := lines(t, partitionFileName(dir, 4)); len(got) != 1 {
+		t.Errorf("file 4: %d events after the restart", len(got))
+	}
+}
+
+func TestFileSinkLargeEvent(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewFileSink(log.NewNopLogger(), root, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// an event larger than maxSize gets a file of its own
+	for i := 0; i < 2; i++ {
+		if err = s.Write(context.Background(), event("ECR0000001", fileSinkDay)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := filepath.Join(root, "2024-03-01", "ECR0000001")
+	for seq := 1; seq <= 2; seq++ {
+		if got := lines(t, partitionFileName(dir, seq)); len(got) != 1 {
+			t.Errorf("file %d: %d events", seq, len(got))
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package eventsink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/segmentio/kafka-go"
+	"sync"
+	"time"
+)
+
+const (
+	kafkaDefaultBufferSize  = 10000
+	kafkaDefaultMaxAttempts = 10
+	kafkaDefaultBatchSize   = 100
+	kafkaRetryBackoffMin    = 500 * time.Millisecond
+	kafkaRetryBackoffMax    = 30 * time.Second
+)
+
+var ErrKafkaBufferFull = errors.New("kafka publish buffer is full")
+
+type KafkaConfig struct {
+	Brokers     []string
+	Topics      map[string]string // event type -> topic
+	BufferSize  int
+	MaxAttempts int
+}
+
+// KafkaSink publishes events to Kafka, keyed by EcrSerial so every register's
+// events stay in order on one partition. Write only places the event in a
+// local buffer; a background loop publishes it waiting for acknowledgement
+// from all in-sync replicas, and keeps retrying a failed batch until it is
+// delivered or the sink is closed. Write fails only when the buffer is full;
+// the event is dropped then and the error logged, the register still gets
+// its ACK as for any sink, see Sink.
+type KafkaSink struct {
+	w      *kafka.Writer
+	topics map[string]string
+	l      log.Logger
+
+	buffer chan kafka.Message
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func NewKafkaSink(l log.Logger, cfg KafkaConfig) (*KafkaSink, error) {
+	if len(cfg.Brokers) == 0 {
+		return nil, errors.New("kafka brokers are not set")
+	}
+	for _, t := range []string{EventSlipRecord, EventSlipValidation, EventZReport} {
+		if cfg.Topics[t] == "" {
+			return nil, fmt.Errorf("kafka topic for %s events is not set", t)
+		}
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = kafkaDefaultBufferSize
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = kafkaDefaultMaxAttempts
+	}
+
+	s := &KafkaSink{
+		w: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.Brokers...),
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			MaxAttempts:  cfg.MaxAttempts,
+			BatchSize:    kafkaDefaultBatchSize,
+			BatchTimeout: 50 * time.Millisecond,
+		},
+		topics: cfg.Topics,
+		l:      l,
+		buffer: make(chan kafka.Message, cfg.BufferSize),
+		done:   make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.publishLoop()
+
+	return s, nil
+}
+
+func (s *KafkaSink) Write(ctx context.Context, e *Event) error {
+	value, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	m := kafka.Message{
+		Topic: s.topics[e.Type],
+		Key:   []byte(e.EcrSerial),
+		Value: value,
+		Time:  e.Time,
+	}
+	if m.Topic == "" {
+		return fmt.Errorf("no kafka topic for event type %s", e.Type)
+	}
+
+	select {
+	case s.buffer <- m:
+		return nil
+	default:
+		return ErrKafkaBufferFull
+	}
+}
+
+// Close stops accepting events and waits up to timeout for the buffer to be
+// published.
+func (s *KafkaSink) Close(timeout time.Duration) error {
+	close(s.done)
+
+	finished := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(timeout):
+		level.Error(s.l).Log("kafka_sink", "close", "err", "timeout", "unpublished", len(s.buffer))
+	}
+	return s.w.Close()
+}
+
+func (s *KafkaSink) publishLoop() {
+	defer s.wg.Done()
+
+	batch := make([]kafka.Message, 0, kafkaDefaultBatchSize)
+	for {
+		batch = batch[:0]
+		select {
+		case m := <-s.buffer:
+			batch = append(batch, m)
+		case <-s.done:
+			// drain what is left before exiting
+			for len(s.buffer) > 0 && len(batch) < kafkaDefaultBatchSize {
+				batch = append(batch, <-s.buffer)
+			}
+			if len(batch) == 0 {
+				return
+			}
+		}
+		for len(batch) < kafkaDefaultBatchSize && len(s.buffer) > 0 {
+			batch = append(batch, <-s.buffer)
+		}
+
+		s.publish(batch)
+	}
+}
+
+// publish retries the batch with exponential backoff until it is delivered.
+// After Close it gives up on the first failure.
+func (s *KafkaSink) publish(batch []kafka.Message) {
+	backoff := kafkaRetryBackoffMin
+	for {
+		err := s.w.WriteMessages(context.Background(), batch...)
+		if err == nil {
+			return
+		}
+		level.Error(s.l).Log("kafka_sink", "publish", "messages", len(batch), "err", err)
+
+		select {
+		case <-s.done:
+			level.Error(s.l).Log("kafka_sink", "publish", "dropped", len(batch))
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > kafkaRetryBackoffMax {
+			backoff = kafkaRetryBackoffMax
+		}
+	}
+}
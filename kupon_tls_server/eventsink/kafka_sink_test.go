@@ -0,0 +1,95 @@
+package eventsink
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"github.com/segmentio/kafka-go"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestKafkaSinkPublish runs against a local broker, see install/kafka-compose.yaml:
+//
+//	docker compose -f install/kafka-compose.yaml up -d
+//	KAFKA_BROKERS=localhost:9092 go test ./eventsink -run Kafka
+func TestKafkaSinkPublish(t *testing.T) {
+	brokers := os.Getenv("KAFKA_BROKERS")
+	if brokers == "" {
+		t.Skip("KAFKA_BROKERS not set")
+	}
+
+	topic := "kupon-test-" + time.Now().Format("20060102150405")
+	topics := map[string]string{
+		EventSlipRecord:     topic,
+		EventSlipValidation: topic,
+		EventZReport:        topic,
+	}
+
+	conn, err := kafka.Dial("tcp", strings.Split(brokers, ",")[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.CreateTopics(kafka.TopicConfig{Topic: topic, NumPartitions: 3, ReplicationFactor: 1})
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewKafkaSink(log.NewNopLogger(), KafkaConfig{
+		Brokers: strings.Split(brokers, ","),
+		Topics:  topics,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	serials := []string{"AB12345678", "AB12345678", "CD87654321"}
+	for i, serial := range serials {
+		err = s.Write(ctx, NewEvent(ctx, EventSlipRecord, serial, i, []byte{'G'}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.Close(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: strings.Split(brokers, ","),
+		GroupID: topic,
+		Topic:   topic,
+	})
+	defer r.Close()
+
+	readCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	lastSeen := map[string]int{}
+	for range serials {
+		m, err := r.ReadMessage(readCtx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := &Event{}
+		err = json.Unmarshal(m.Value, e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(m.Key) != e.EcrSerial {
+			t.Errorf("message key %s, expected %s", m.Key, e.EcrSerial)
+		}
+		if e.SchemaVersion != SchemaVersion || e.Type != EventSlipRecord {
+			t.Errorf("unexpected event %+v", e)
+		}
+		i := int(e.Payload.(float64))
+		if prev, ok := lastSeen[e.EcrSerial]; ok && prev > i {
+			t.Errorf("events for %s out of order: %d after %d", e.EcrSerial, i, prev)
+		}
+		lastSeen[e.EcrSerial] = i
+	}
+}
@@ -0,0 +1,19 @@
+package eventsink
+
+import (
+	"context"
+	"errors"
+)
+
+// Multi writes every event to all of its sinks in order. A failing sink does
+// not keep the event from the ones after it, the errors of the sinks that
+// failed are joined in the order of Multi.
+type Multi []Sink
+
+func (m Multi) Write(ctx context.Context, e *Event) error {
+	var errs []error
+	for _, s := range m {
+		errs = append(errs, s.Write(ctx, e))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,35 @@
+package eventsink
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+type countSink struct {
+	n   int
+	err error
+}
+
+func (s *countSink) Write(ctx context.Context, e *Event) error {
+	s.n++
+	return s.err
+}
+
+func TestMultiWritesAll(t *testing.T) {
+	first := &countSink{err: errors.New("file sink")}
+	second := &countSink{}
+	third := &countSink{err: errors.New("kafka sink")}
+
+	err := Multi{first, second, third}.Write(context.Background(), &Event{})
+	if first.n != 1 || second.n != 1 || third.n != 1 {
+		t.Errorf("writes %d %d %d, want one each", first.n, second.n, third.n)
+	}
+	if !errors.Is(err, first.err) || !errors.Is(err, third.err) || err.Error() != "file sink\nkafka sink" {
+		t.Errorf("err %v", err)
+	}
+
+	if err = (Multi{second}).Write(context.Background(), &Event{}); err != nil {
+		t.Errorf("err %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+// Package framecheck computes frame checksums: the XOR checksum of old
+// firmware and the CRC32 of newer firmware. The protocol version of a frame
+// alone selects the checksum, for G, E and W frames alike.
+package framecheck
+
+import (
+	"fmt"
+	"hash/crc32"
+	"nexusws/pkg/checksum"
+)
+
+// Algorithm is the checksum of a frame. Responses use the algorithm of the
+// frame they answer.
+type Algorithm int
+
+const (
+	XOR   Algorithm = iota // 2 hex digits, what firmware before v15 sends
+	CRC32                  // 8 hex digits, CRC-32/IEEE
+)
+
+// CRC32Length is the length of the CRC32 checksum on the wire.
+const CRC32Length = 8
+
+// ProtocolVersionCRC32 is the first protocol version whose G, E and W frames
+// and their responses carry a CRC32 checksum.
+const ProtocolVersionCRC32 = "15"
+
+// ForProtocolVersion returns the checksum of frames with protocolVersion.
+// Older versions keep XOR.
+func ForProtocolVersion(protocolVersion string) Algorithm {
+	if protocolVersion == ProtocolVersionCRC32 {
+		return CRC32
+	}
+	return XOR
+}
+
+// Length is the number of checksum bytes at the end of a frame.
+func (a Algorithm) Length() int {
+	if a == CRC32 {
+		return CRC32Length
+	}
+	return 2
+}
+
+// Sum returns the checksum of b as it is sent in a frame.
+func (a Algorithm) Sum(b []byte) string {
+	if a == CRC32 {
+		return fmt.Sprintf("%08X", crc32.ChecksumIEEE(b))
+	}
+	return checksum.CalcXorChecksum(b)
+}
+
+func (a Algorithm) String() string {
+	if a == CRC32 {
+		return "crc32"
+	}
+	return "xor"
+}
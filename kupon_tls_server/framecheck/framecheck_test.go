@@ -0,0 +1,30 @@
+package framecheck
+
+import "testing"
+
+func TestSum(t *testing.T) {
+	tests := []struct {
+		a    Algorithm
+		in   string
+		want string
+	}{
+		{CRC32, "123456789", "CBF43926"},
+	}
+	for _, tt := range tests {
+		got := tt.a.Sum([]byte(tt.in))
+		if got != tt.want {
+			t.Errorf("%s(%q) = %s, want %s", tt.a, tt.in, got, tt.want)
+		}
+		if len(got) != tt.a.Length() {
+			t.Errorf("%s length %d, want %d", tt.a, len(got), tt.a.Length())
+		}
+	}
+}
+
+func TestForProtocolVersion(t *testing.T) {
+	for v, want := range map[string]Algorithm{"13": XOR, "14": XOR, "15": CRC32} {
+		if got := ForProtocolVersion(v); got != want {
+			t.Errorf("ForProtocolVersion(%q) = %s, want %s", v, got, want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Package frametest builds register frames and answers them without a
+// register or a NexusWS, for the handler tests, the fuzz targets and the
+// in-process replay. The frame layouts are those of sliprecord,
+// slipvalidation and zreport, written out here so that their tests can
+// import the package.
+package frametest
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"nexusws/cmd/kupon_tls_server/capture"
+	"nexusws/cmd/kupon_tls_server/framecheck"
+	"nexusws/cmd/kupon_tls_server/slipfields"
+	"nexusws/cmd/kupon_tls_server/sliplines"
+	"nexusws/cmd/kupon_tls_server/zreport/zfile"
+	v13 "nexusws/pkg/nexushttpclient/v13"
+	"nexusws/pkg/nexushttpclient/zreport"
+	"path/filepath"
+)
+
+// EcrSerial is the register of the frames built here.
+const EcrSerial = "ECR0000001"
+
+// SlipBody has a line of each kind registers send, N without a header as
+// v13 sends it.
+const SlipBody = "AMAC1;12;100;1;1;20230727;125624;0\n" +
+	"BMAC1;12;100;1;1;Kafe;1;100;100;0;1\n" +
+	"CMAC1;12;100;1;1;100\n" +
+	"DMAC1;12;100;1;100;0;0\n" +
+	"NFalemnderit\n"
+
+// SlipBodyV14 has the header on its N line.
+const SlipBodyV14 = "AMAC1;12;100;1;1;20230727;125624;0\n" +
+	"BMAC1;12;100;1;1;Kafe;1;100;100;0;1\n" +
+	"NMAC1;12;100;1;Falemnderit\n"
+
+// ZReportBody is a Z file in the layout zfile reads.
+const ZReportBody = "Z;42;20230727080000;20230727220000\r\n" +
+	"V;A;20;1000.00;200.00;1200.00\r\n" +
+	"P;CASH;1200.00\r\n" +
+	"S;17;1201;1217\r\n"
+
+// CaptureDir holds capture files whose inbound frames seed the fuzz
+// targets, relative to the package directories of the handlers.
+const CaptureDir = "../testdata/fuzz/captures"
+
+// G13 builds a v13 G frame with its XOR checksum.
+func G13(body string) []byte {
+	msg := []byte("G13\x00\x004" + EcrSerial + body)
+	binary.LittleEndian.PutUint16(msg[3:], uint16(len(body)))
+	return append(msg, framecheck.XOR.Sum(msg)...)
+}
+
+// G14 builds a v14 or v15 frame without header flags.
+func G14(version string, body string) []byte {
+	return G14Flags(version, 0, body)
+}
+
+// G14Flags builds a v14 or v15 frame with the header flags of sliprecord.
+func G14Flags(version string, flags byte, body string) []byte {
+	msg := []byte("G" + version + "\x00\x00\x00\x004" + EcrSerial + string([]byte{flags}) + body)
+	binary.LittleEndian.PutUint32(msg[3:], uint32(len(body)))
+	return append(msg, framecheck.ForProtocolVersion(version).Sum(msg)...)
+}
+
+// E builds an E frame for slip 1 of Z report 12.
+func E(version string) []byte {
+	msg := []byte("E" + version + EcrSerial + "001" + "0012" + "0001" + "00000100" + "82BDEDEDB804269B42760E2974F87416")
+	return append(msg, framecheck.ForProtocolVersion(version).Sum(msg)...)
+}
+
+// W builds a W frame of the given type for Z0042.txt.
+func W(version string, typ byte, content string) []byte {
+	const headerLength = 54
+	check := framecheck.ForProtocolVersion(version)
+	msg := make([]byte, headerLength, headerLength+len(content)+check.Length())
+	copy(msg, "W"+version)
+	binary.LittleEndian.PutUint16(msg[3:], uint16(headerLength-3+len(content)+check.Length()))
+	msg[5] = typ
+	copy(msg[6:], EcrSerial)
+	copy(msg[16:], "Z0042.txt")
+	msg = append(msg, content...)
+	return append(msg, check.Sum(msg)...)
+}
+
+// Captured returns the inbound frames of the capture files in dir that
+// start with one of identifiers. A missing dir has no frames.
+func Captured(dir string, identifiers ...byte) ([][]byte, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	var frames [][]byte
+	for _, file := range files {
+		records, err := capture.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for i := range records {
+			if records[i].Dir != capture.DirIn {
+				continue
+			}
+			frame, err := records[i].Bytes()
+			if err != nil {
+				return nil, err
+			}
+			if len(frame) > 0 && bytes.IndexByte(identifiers, frame[0]) >= 0 {
+				frames = append(frames, frame)
+			}
+		}
+	}
+	return frames, nil
+}
+
+// Backend accepts everything. Stored counts the calls, E frames get URL as
+// their QR code URL.
+type Backend struct {
+	Stored int
+	URL    string
+}
+
+func (b *Backend) InsertSlip(ctx context.Context, msg *sliplines.Message, typed *slipfields.Message, raw []byte) error {
+	b.Stored++
+	return nil
+}
+
+func (b *Backend) InsertSlipValidation(ctx context.Context, req *v13.SlipValidationInsertReq) (string, error) {
+	b.Stored++
+	return b.URL, nil
+}
+
+func (b *Backend) InsertZReport(ctx context.Context, report *zreport.ZReport, summary *zfile.Summary) error {
+	b.Stored++
+	return nil
+}
+
+// Conn reads what was written to its Buffer and keeps the responses in
+// Out.
+type Conn struct {
+	bytes.Buffer
+	Out bytes.Buffer
+}
+
+// NewConn returns a Conn that reads in, the part of a frame the handlers
+// read after the first read of the connection handler.
+func NewConn(in []byte) *Conn {
+	c := &Conn{}
+	c.Buffer.Write(in)
+	return c
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	return c.Out.Write(b)
+}
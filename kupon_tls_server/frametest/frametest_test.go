@@ -0,0 +1,47 @@
+package frametest
+
+import (
+	"bytes"
+	"nexusws/cmd/kupon_tls_server/capture"
+	"path/filepath"
+	"testing"
+)
+
+func TestCaptured(t *testing.T) {
+	dir := t.TempDir()
+	c, err := capture.New(dir, []string{EcrSerial})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, e := G13(SlipBody), E("14")
+	for _, frame := range [][]byte{g, e} {
+		rec := c.Recorder("trace-1", &Conn{})
+		rec.Write([]byte("A0000"))
+		if err := rec.Done(EcrSerial, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	frames, err := Captured(dir, 'G', 'g')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 || !bytes.Equal(frames[0], g) {
+		t.Errorf("frames %q", frames)
+	}
+	if frames, err = Captured(filepath.Join(dir, "missing")); err != nil || len(frames) != 0 {
+		t.Errorf("missing dir: %q, %v", frames, err)
+	}
+}
+
+func TestCaptureDir(t *testing.T) {
+	for _, ids := range []string{"Gg", "Ee", "Ww"} {
+		frames, err := Captured(CaptureDir, ids[0], ids[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frames) == 0 {
+			t.Errorf("no %c frames in %s", ids[0], CaptureDir)
+		}
+	}
+}
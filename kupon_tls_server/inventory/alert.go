@@ -0,0 +1,121 @@
+package inventory
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-kit/kit/log/level"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"time"
+)
+
+var (
+	deviceLastSeen = kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+		Namespace: "kupon",
+		Subsystem: "device",
+		Name:      "last_seen_timestamp_seconds",
+		Help:      "Unix time of the last accepted frame of a registered register.",
+	}, []string{"ecr_serial"})
+	devicesSilent = kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+		Namespace: "kupon",
+		Subsystem: "device",
+		Name:      "silent",
+		Help:      "Registers silent for longer than inventory.silent_after.",
+	}, []string{})
+	silentAlerts = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Namespace: "kupon",
+		Subsystem: "device",
+		Name:      "silent_alerts_total",
+		Help:      "Silent register alerts by delivery result.",
+	}, []string{"result"})
+)
+
+// AlertDeviceSilent is the type of the alert sent for a register that has
+// not sent an accepted frame for longer than the configured time.
+const AlertDeviceSilent = "device_silent"
+
+type Alert struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	EcrSerial string    `json:"ecr_serial"`
+	SilentFor string    `json:"silent_for"`
+	Device    Device    `json:"device"`
+}
+
+// CheckSilent calls notify once per silence for every device whose last
+// frame is older than after. A device whose alert could not be delivered is
+// notified again on the next call. It returns the number of silent devices.
+func (inv *Inventory) CheckSilent(now time.Time, after time.Duration, notify func(*Alert) error) int {
+	var silent, pending []Device
+	inv.mu.Lock()
+	for _, d := range inv.devices {
+		if now.Sub(d.LastSeen) <= after {
+			continue
+		}
+		silent = append(silent, *d)
+		if !d.SilentAlerted {
+			pending = append(pending, *d)
+		}
+	}
+	inv.mu.Unlock()
+	devicesSilent.Set(float64(len(silent)))
+
+	for _, d := range pending {
+		err := notify(&Alert{
+			Type:      AlertDeviceSilent,
+			Time:      now.UTC(),
+			EcrSerial: d.EcrSerial,
+			SilentFor: now.Sub(d.LastSeen).Truncate(time.Minute).String(),
+			Device:    d,
+		})
+		if err != nil {
+			silentAlerts.With("result", "error").Add(1)
+			level.Error(inv.l).Log("msg", "silent device alert failed", "ecrSerial", d.EcrSerial, "err", err)
+			continue
+		}
+		silentAlerts.With("result", "ok").Add(1)
+
+		inv.mu.Lock()
+		// a frame may have arrived while notifying
+		if cur := inv.devices[d.EcrSerial]; cur != nil && cur.LastSeen.Equal(d.LastSeen) {
+			cur.SilentAlerted = true
+			inv.dirty = true
+		}
+		inv.mu.Unlock()
+	}
+	return len(silent)
+}
+
+// Webhook posts alerts as JSON to a URL.
+type Webhook struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewWebhook(url string) *Webhook {
+	return &Webhook{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (w *Webhook) Send(a *Alert) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, w.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s: %s", w.URL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+// Package inventory keeps, for every register, what was last seen of it:
+// when and from where it last sent an accepted frame, over which protocol
+// and TLS version, and its last slip and Z report. Registers that stay
+// silent too long are reported to a webhook, see CheckSilent.
+package inventory
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"io/ioutil"
+	"nexusws/cmd/kupon_tls_server/eventsink"
+	"nexusws/cmd/kupon_tls_server/registry"
+	"nexusws/cmd/kupon_tls_server/slipfields"
+	"nexusws/cmd/kupon_tls_server/sliplines"
+	"nexusws/cmd/kupon_tls_server/slipvalidation"
+	"nexusws/cmd/kupon_tls_server/zreport"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Device struct {
+	EcrSerial       string    `json:"ecr_serial"`
+	LastSeen        time.Time `json:"last_seen"`
+	RemoteIP        string    `json:"remote_ip"`
+	ProtocolVersion string    `json:"protocol_version"`
+	TLSVersion      string    `json:"tls_version"`
+	LastSlipSerial  int       `json:"last_slip_serial,omitempty"`
+	LastZReport     int       `json:"last_z_report,omitempty"` // 0 when the file was not parsed
+	LastZReportFile string    `json:"last_z_report_file,omitempty"`
+	// Registry holds the registry attributes seen with the last frame.
+	Registry *registry.Device `json:"registry,omitempty"`
+	// SilentAlerted is set once an alert was sent for the current silence.
+	SilentAlerted bool `json:"silent_alerted,omitempty"`
+}
+
+// Conn is the connection frames are received on, set by the connection
+// handler with NewContext.
+type Conn struct {
+	RemoteIP   string
+	TLSVersion string
+}
+
+type contextKey struct{}
+
+func NewContext(ctx context.Context, c *Conn) context.Context {
+	return context.WithValue(ctx, contextKey{}, c)
+}
+
+func fromContext(ctx context.Context) *Conn {
+	c, _ := ctx.Value(contextKey{}).(*Conn)
+	if c == nil {
+		return &Conn{}
+	}
+	return c
+}
+
+// TLSVersionName returns the name of a crypto/tls version number.
+func TLSVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+// Inventory is an event sink recording every accepted frame. Like the
+// reconciler it never fails a write. It is kept in memory and written to
+// its file by Save.
+type Inventory struct {
+	l    log.Logger
+	path string
+
+	mu      sync.Mutex
+	devices map[string]*Device
+	dirty   bool
+}
+
+// New returns the inventory saved in path, empty when the file does not
+// exist yet.
+func New(l log.Logger, path string) (*Inventory, error) {
+	inv := &Inventory{l: l, path: path, devices: make(map[string]*Device)}
+	b, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return inv, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var devices []*Device
+	err = json.Unmarshal(b, &devices)
+	if err != nil {
+		return nil, fmt.Errorf("inventory %s: %w", path, err)
+	}
+	for _, d := range devices {
+		inv.devices[d.EcrSerial] = d
+		observe(d)
+	}
+	return inv, nil
+}
+
+func (inv *Inventory) Write(ctx context.Context, e *eventsink.Event) error {
+	ecr := strings.TrimSpace(e.EcrSerial)
+	if ecr == "" {
+		return nil
+	}
+	c := fromContext(ctx)
+
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	d, ok := inv.devices[ecr]
+	if !ok {
+		d = &Device{EcrSerial: ecr}
+		inv.devices[ecr] = d
+	}
+	d.LastSeen = e.Time
+	d.RemoteIP = c.RemoteIP
+	d.TLSVersion = c.TLSVersion
+	d.Registry = e.Device
+	d.SilentAlerted = false
+
+	switch p := e.Payload.(type) {
+	case *sliplines.Message:
+		d.ProtocolVersion = p.Header.ProtocolVersion
+		for _, r := range p.Records {
+			n, err := strconv.Atoi(strings.TrimSpace(r.SlipSerial))
+			if err != nil {
+				level.Warn(inv.l).Log("msg", "inventory: SlipSerial is not a number", "ecrSerial", ecr, "err", err)
+				continue
+			}
+			d.LastSlipSerial = n
+		}
+	case *slipfields.Message:
+		d.ProtocolVersion = p.Header.ProtocolVersion
+		for _, r := range p.Records {
+			d.LastSlipSerial = r.SlipSerial
+		}
+	case *slipvalidation.EcrSlipValidation:
+		d.ProtocolVersion = p.Header.ProtocolVersion
+	case *zreport.ZReportEvent:
+		d.ProtocolVersion = p.ProtocolVersion
+		d.LastZReportFile = p.FileName
+		d.LastZReport = 0
+		if p.Summary != nil {
+			d.LastZReport = p.Summary.ReportNo
+		}
+	}
+	inv.dirty = true
+
+	observe(d)
+	return nil
+}
+
+// observe exports the last seen time of d. Devices that are not registered
+// are left out, any client could add a label value for each serial it
+// makes up.
+func observe(d *Device) {
+	if d.Registry == nil {
+		return
+	}
+	deviceLastSeen.With("ecr_serial", d.EcrSerial).Set(float64(d.LastSeen.Unix()))
+}
+
+// Devices returns a copy of every device, by EcrSerial.
+func (inv *Inventory) Devices() []Device {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	devices := make([]Device, 0, len(inv.devices))
+	for _, d := range inv.devices {
+		devices = append(devices, *d)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].EcrSerial < devices[j].EcrSerial })
+	return devices
+}
+
+// Device returns a copy of the device of ecrSerial.
+func (inv *Inventory) Device(ecrSerial string) (Device, bool) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	d, ok := inv.devices[ecrSerial]
+	if !ok {
+		return Device{}, false
+	}
+	return *d, true
+}
+
+// Save writes the inventory to its file when it changed since the last
+// save.
+func (inv *Inventory) Save() error {
+	inv.mu.Lock()
+	if !inv.dirty {
+		inv.mu.Unlock()
+		return nil
+	}
+	devices := make([]*Device, 0, len(inv.devices))
+	for _, d := range inv.devices {
+		c := *d
+		devices = append(devices, &c)
+	}
+	inv.dirty = false
+	inv.mu.Unlock()
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].EcrSerial < devices[j].EcrSerial })
+	b, err := json.MarshalIndent(devices, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(inv.path+".tmp", b, 0640)
+	if err == nil {
+		err = os.Rename(inv.path+".tmp", inv.path)
+	}
+	if err != nil {
+		inv.mu.Lock()
+		inv.dirty = true
+		inv.mu.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kit/kit/log"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"nexusws/cmd/kupon_tls_server/eventsink"
+	"nexusws/cmd/kupon_tls_server/registry"
+	"nexusws/cmd/kupon_tls_server/sliplines"
+	"nexusws/cmd/kupon_tls_server/zreport"
+	"nexusws/cmd/kupon_tls_server/zreport/zfile"
+	v13 "nexusws/pkg/nexushttpclient/v13"
+	zr "nexusws/pkg/nexushttpclient/zreport"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inventory.json")
+	inv, err := New(log.NewNopLogger(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := NewContext(context.Background(), &Conn{RemoteIP: "10.0.0.7", TLSVersion: "TLS1.2"})
+
+	msg := &sliplines.Message{
+		Header:  &v13.MessageGHeader{ProtocolVersion: "13", EcrSerial: "ECR0000001"},
+		Records: make([]sliplines.Record, 2),
+	}
+	msg.Records[0].SlipSerial = "41"
+	msg.Records[1].SlipSerial = "0042"
+	g := eventsink.NewEvent(ctx, eventsink.EventSlipRecord, "ECR0000001", msg, nil)
+	inv.Write(ctx, g)
+	w := eventsink.NewEvent(ctx, eventsink.EventZReport, "ECR0000001", &zreport.ZReportEvent{
+		ZReport: &zr.ZReport{ProtocolVersion: "13", FileName: "z0012.txt"},
+		Summary: &zfile.Summary{ReportNo: 12},
+	}, nil)
+	inv.Write(ctx, w)
+
+	d, ok := inv.Device("ECR0000001")
+	if !ok {
+		t.Fatal("device not recorded")
+	}
+	if d.RemoteIP != "10.0.0.7" || d.TLSVersion != "TLS1.2" || d.ProtocolVersion != "13" ||
+		d.LastSlipSerial != 42 || d.LastZReport != 12 || d.LastZReportFile != "z0012.txt" || !d.LastSeen.Equal(w.Time) {
+		t.Errorf("device %+v", d)
+	}
+
+	err = inv.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv, err = New(log.NewNopLogger(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := inv.Devices(); len(got) != 1 || got[0].LastSlipSerial != 42 {
+		t.Errorf("reloaded %+v", got)
+	}
+}
+
+func TestCheckSilent(t *testing.T) {
+	inv, err := New(log.NewNopLogger(), filepath.Join(t.TempDir(), "inventory.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	e := eventsink.NewEvent(ctx, eventsink.EventSlipValidation, "ECR0000001", nil, nil)
+	inv.Write(ctx, e)
+
+	var sent []*Alert
+	notify := func(a *Alert) error {
+		sent = append(sent, a)
+		return nil
+	}
+	failing := func(a *Alert) error {
+		return errors.New("webhook down")
+	}
+
+	if n := inv.CheckSilent(e.Time.Add(time.Hour), 2*time.Hour, notify); n != 0 || len(sent) != 0 {
+		t.Fatalf("not silent yet: %d silent, %d sent", n, len(sent))
+	}
+	later := e.Time.Add(3 * time.Hour)
+	if n := inv.CheckSilent(later, 2*time.Hour, failing); n != 1 {
+		t.Fatalf("%d silent", n)
+	}
+	// the failed alert is sent on the next check, and only once
+	inv.CheckSilent(later, 2*time.Hour, notify)
+	inv.CheckSilent(later, 2*time.Hour, notify)
+	if len(sent) != 1 || sent[0].EcrSerial != "ECR0000001" || sent[0].Type != AlertDeviceSilent || sent[0].SilentFor != "3h0m0s" {
+		t.Fatalf("sent %+v", sent)
+	}
+
+	// a new frame ends the silence, the next one is alerted again
+	e = eventsink.NewEvent(ctx, eventsink.EventSlipValidation, "ECR0000001", nil, nil)
+	inv.Write(ctx, e)
+	inv.CheckSilent(e.Time.Add(3*time.Hour), 2*time.Hour, notify)
+	if len(sent) != 2 {
+		t.Errorf("%d alerts after a second silence", len(sent))
+	}
+}
+
+func TestLastSeenRegisteredOnly(t *testing.T) {
+	inv, err := New(log.NewNopLogger(), filepath.Join(t.TempDir(), "inventory.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	registered := registry.NewContext(ctx, &registry.Device{EcrSerial: "ECR0000101"})
+	inv.Write(ctx, eventsink.NewEvent(registered, eventsink.EventSlipValidation, "ECR0000101", nil, nil))
+	inv.Write(ctx, eventsink.NewEvent(ctx, eventsink.EventSlipValidation, "made-up", nil, nil))
+
+	families, err := stdprometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, f := range families {
+		if f.GetName() != "kupon_device_last_seen_timestamp_seconds" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				seen[l.GetValue()] = true
+			}
+		}
+	}
+	if !seen["ECR0000101"] || seen["made-up"] {
+		t.Errorf("exported %v", seen)
+	}
+}
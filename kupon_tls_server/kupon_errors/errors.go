@@ -0,0 +1,45 @@
+// Package kupon_errors holds the NACK codes sent only by the TLS server. They
+// start at 9000 to stay clear of the codes in nexusws/pkg/nexus_errors, which
+// are shared with NexusWS.
+package kupon_errors
+
+const (
+	// ErrBackendUnavailable is sent while the backend circuit breaker is open.
+	// Registers should wait before resending.
+	ErrBackendUnavailable = 9000
+	// ErrMalformedZReport is sent when the Z report file content can not be
+	// parsed and content parsing is strict.
+	ErrMalformedZReport = 9001
+	// ErrZReportPartInvalid is sent for a multi-part W frame whose part index,
+	// total parts or digest do not fit the upload it belongs to.
+	ErrZReportPartInvalid = 9002
+	// ErrZReportDigestMismatch is sent when a reassembled multi-part Z report
+	// does not match its digest. The upload is discarded and has to be resent
+	// from the first part.
+	ErrZReportDigestMismatch = 9003
+	// ErrInvalidFieldValue is sent when a slip line field does not hold a
+	// value of its kind, an amount that is not a number for example. Only
+	// checked when slip records are converted to typed JSON.
+	ErrInvalidFieldValue = 9004
+	// Semantic validation of slip records, see package slipcheck. Only sent
+	// when validation rejects.
+	ErrSlipTotalMismatch = 9005 // items do not add up to the slip total
+	ErrVatMismatch       = 9006 // VAT per rate does not match the VAT lines
+	ErrPaymentNotCovered = 9007 // payments are less than the slip total
+	ErrVatRateNotAllowed = 9008 // a VAT rate outside the configured set
+	// ErrUnsupportedProtocolVersion is sent for a G or E frame whose
+	// protocol version has no parser.
+	ErrUnsupportedProtocolVersion = 9009
+	// Signed frames, see package signing. ErrSignatureRequired is sent for an
+	// unsigned frame from a register that must sign, ErrSignatureInvalid for
+	// an unknown or expired key or a signature that does not match.
+	ErrSignatureRequired = 9010
+	ErrSignatureInvalid  = 9011
+	// Device registry, see package registry.
+	ErrUnknownDevice        = 9012 // EcrSerial is not registered
+	ErrDeviceBlocked        = 9013
+	ErrDeviceDecommissioned = 9014
+	// ErrUnsupportedCharset is sent when the code page configured for the
+	// register has no decoder, see package charset.
+	ErrUnsupportedCharset = 9015
+)
@@ -4,28 +4,54 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"io"
 	"net"
+	"net/http"
+	"nexusws/cmd/kupon_tls_server/admin"
+	"nexusws/cmd/kupon_tls_server/backend"
+	"nexusws/cmd/kupon_tls_server/capture"
+	"nexusws/cmd/kupon_tls_server/eventsink"
+	"nexusws/cmd/kupon_tls_server/inventory"
+	"nexusws/cmd/kupon_tls_server/registry"
+	"nexusws/cmd/kupon_tls_server/sequence"
+	"nexusws/cmd/kupon_tls_server/session"
+	"nexusws/cmd/kupon_tls_server/signing"
+	"nexusws/cmd/kupon_tls_server/slipcheck"
+	"nexusws/cmd/kupon_tls_server/slipfields"
 	"nexusws/cmd/kupon_tls_server/sliprecord"
 	"nexusws/cmd/kupon_tls_server/slipvalidation"
 	"nexusws/cmd/kupon_tls_server/zreport"
+	"nexusws/cmd/kupon_tls_server/zreport/archive"
 	nxCtx "nexusws/pkg/context"
 	"nexusws/pkg/httpclient"
 	"nexusws/pkg/nexushttpclient"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		os.Exit(reconcileCmd(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "decode" {
+		os.Exit(decodeCmd(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replayCmd(os.Args[2:]))
+	}
 
+	const configFile = "./config.yaml"
 	cfg := &Config{}
-	err := NewFromFile("./config.yaml", cfg)
+	err := NewFromFile(configFile, cfg)
 	if err != nil {
 		panic(err)
 	}
@@ -104,11 +130,265 @@ func main() {
 		ln.Close()
 	}()
 
-	hcl := httpclient.NewHttpInternalServiceClient(logger)
-	nCl := nexushttpclient.New(logger, hcl)
+	if cfg.Metrics.ListenAddress != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.Handler())
+			err := http.ListenAndServe(cfg.Metrics.ListenAddress, mux)
+			level.Error(logger).Log("metrics", "stopped", "err", err)
+		}()
+	}
 
-	nexusWsHost := fmt.Sprintf("%s:%d", cfg.NexusWS.Host, cfg.NexusWS.Port)
-	nexusCl := nexushttpclient.NewSlipClient(&logger, nCl, nexusWsHost)
+	var b backend.Backend
+	switch cfg.Backend {
+	case BackendNexusWS, "":
+		hcl := httpclient.NewHttpInternalServiceClient(logger)
+		nCl := nexushttpclient.New(logger, hcl)
+
+		nexusWsHost := fmt.Sprintf("%s:%d", cfg.NexusWS.Host, cfg.NexusWS.Port)
+		nexusCl := nexushttpclient.NewSlipClient(&logger, nCl, nexusWsHost)
+
+		res := backend.NewResilience(logger, backend.ResilienceConfig{
+			MaxAttempts:     cfg.NexusWS.Retry.MaxAttempts,
+			BackoffMin:      cfg.NexusWS.Retry.BackoffMin,
+			BackoffMax:      cfg.NexusWS.Retry.BackoffMax,
+			Budget:          cfg.NexusWS.Retry.Budget,
+			BreakerFailures: cfg.NexusWS.CircuitBreaker.Failures,
+			BreakerOpenFor:  cfg.NexusWS.CircuitBreaker.OpenFor,
+		})
+
+		var outbox *backend.Outbox
+		switch cfg.NexusWS.SlipWriteMode {
+		case backend.SlipWriteSequential, "":
+		case backend.SlipWriteOutbox:
+			outbox, err = backend.NewOutbox(logger, nexusCl, res, cfg.NexusWS.OutboxDir)
+			if err != nil {
+				level.Error(logger).Log("err", err)
+				return
+			}
+			defer outbox.Close()
+		default:
+			level.Error(logger).Log("err", fmt.Sprintf("unknown slip_write_mode %s", cfg.NexusWS.SlipWriteMode))
+			return
+		}
+		level.Info(logger).Log("backend", cfg.Backend, "slip_write_mode", cfg.NexusWS.SlipWriteMode)
+		b = backend.NewNexusWS(nexusCl, outbox, res)
+	case BackendPostgres:
+		pg, err := backend.NewPostgres(context.Background(), logger, cfg.Postgres.DSN, cfg.Postgres.QrURLPrefix)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			return
+		}
+		defer pg.Close()
+		b = pg
+	default:
+		level.Error(logger).Log("err", fmt.Sprintf("unknown backend %s", cfg.Backend))
+		return
+	}
+
+	var sinks eventsink.Multi
+	if cfg.FileSink.Enabled {
+		fs, err := eventsink.NewFileSink(logger, cfg.FileSink.Root, cfg.FileSink.MaxFileSizeMB<<20)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			return
+		}
+		defer fs.Close()
+		sinks = append(sinks, fs)
+	}
+	if cfg.Kafka.Enabled {
+		ks, err := eventsink.NewKafkaSink(logger, eventsink.KafkaConfig{
+			Brokers:     cfg.Kafka.Brokers,
+			Topics:      cfg.Kafka.Topics,
+			BufferSize:  cfg.Kafka.BufferSize,
+			MaxAttempts: cfg.Kafka.MaxAttempts,
+		})
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			return
+		}
+		defer ks.Close(30 * time.Second)
+		sinks = append(sinks, ks)
+	}
+	if cfg.Reconciliation.Enabled {
+		if cfg.ZReport.ContentParsing == zreport.ContentParsingOff || cfg.ZReport.ContentParsing == "" {
+			level.Error(logger).Log("err", "reconciliation needs zreport.content_parsing lenient or strict")
+			return
+		}
+		rec, err := newReconciler(logger, cfg)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			return
+		}
+		sinks = append(sinks, rec)
+	}
+	var capturer *capture.Capturer
+	if cfg.Capture.Dir != "" {
+		capturer, err = capture.New(cfg.Capture.Dir, cfg.Capture.EcrSerials)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			return
+		}
+		sinks = append(sinks, capturer)
+		// SIGHUP reloads the capture list from the config file
+		go func() {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			for range hup {
+				reloaded := &Config{}
+				err := NewFromFile(configFile, reloaded)
+				if err != nil {
+					level.Error(logger).Log("msg", "config reload failed", "err", err)
+					continue
+				}
+				capturer.Set(reloaded.Capture.EcrSerials)
+				level.Info(logger).Log("msg", "capture list reloaded", "ecr_serials", len(reloaded.Capture.EcrSerials))
+			}
+		}()
+	}
+	var inv *inventory.Inventory
+	if cfg.Inventory.Enabled {
+		inv, err = inventory.New(logger, cfg.Inventory.File)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			return
+		}
+		defer inv.Save()
+		sinks = append(sinks, inv)
+		go func() {
+			for range time.Tick(time.Minute) {
+				err := inv.Save()
+				if err != nil {
+					level.Error(logger).Log("msg", "inventory save failed", "err", err)
+				}
+			}
+		}()
+		if cfg.Inventory.SilentAfter > 0 && cfg.Inventory.WebhookURL != "" {
+			wh := inventory.NewWebhook(cfg.Inventory.WebhookURL)
+			go func() {
+				for range time.Tick(5 * time.Minute) {
+					inv.CheckSilent(time.Now(), cfg.Inventory.SilentAfter, wh.Send)
+				}
+			}()
+		}
+	}
+	sessions := session.NewManager()
+	if cfg.Admin.ListenAddress != "" {
+		if cfg.Admin.Token == "" {
+			level.Error(logger).Log("err", "admin.token is required with admin.listen_address")
+			return
+		}
+		if cfg.Admin.CertFile == "" && !admin.Loopback(cfg.Admin.ListenAddress) {
+			level.Error(logger).Log("err", "admin.listen_address is not a loopback address, set admin.cert_file and admin.key_file to serve it over TLS")
+			return
+		}
+		adm := admin.New(logger, cfg.Admin.Token)
+		if inv != nil {
+			adm.HandleDevices(inv)
+		}
+		adm.HandleSessions(sessions)
+		if capturer != nil {
+			adm.HandleCapture(capturer)
+		}
+		go func() {
+			var err error
+			if cfg.Admin.CertFile != "" {
+				err = http.ListenAndServeTLS(cfg.Admin.ListenAddress, cfg.Admin.CertFile, cfg.Admin.KeyFile, adm)
+			} else {
+				err = http.ListenAndServe(cfg.Admin.ListenAddress, adm)
+			}
+			level.Error(logger).Log("admin", "stopped", "err", err)
+		}()
+	}
+	var sink eventsink.Sink
+	if len(sinks) > 0 {
+		sink = sinks
+	}
+
+	var seq *sequence.Tracker
+	if cfg.Sequence.Enabled {
+		seq, err = sequence.NewTracker(logger, cfg.Sequence.Dir, cfg.Sequence.ResendInterval)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			return
+		}
+	}
+
+	gOpts, err := slipRecordOptions(cfg)
+	if err != nil {
+		level.Error(logger).Log("err", err)
+		return
+	}
+	// the line and field names of the checks come from the configuration,
+	// there are no defaults
+	level.Info(logger).Log("validation", gOpts.Validator.Mode(), "checks", strings.Join(gOpts.Validator.Checks(), ","))
+
+	var keys *signing.Store
+	if cfg.Signing.KeyStore != "" {
+		keys, err = signing.Load(cfg.Signing.KeyStore)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			return
+		}
+		// rotated keys are picked up without a restart
+		go func() {
+			for range time.Tick(time.Minute) {
+				err := keys.Reload()
+				if err != nil {
+					level.Error(logger).Log("msg", "key store reload failed", "err", err)
+				}
+			}
+		}()
+	}
+	gOpts.Keys = keys
+
+	reg, err := registry.Open(cfg.Registry)
+	if err != nil {
+		level.Error(logger).Log("err", err)
+		return
+	}
+	gOpts.Registry = reg
+	eOpts := &slipvalidation.Options{Keys: keys, Registry: reg}
+
+	zOpts := &zreport.Options{
+		ContentParsing: cfg.ZReport.ContentParsing,
+		Keys:           keys,
+		Registry:       reg,
+	}
+	if cfg.ZReport.UploadDir != "" {
+		zOpts.Uploads, err = zreport.NewUploads(cfg.ZReport.UploadDir, cfg.ZReport.UploadTTL)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			return
+		}
+		go func() {
+			for range time.Tick(time.Hour) {
+				err := zOpts.Uploads.Sweep()
+				if err != nil {
+					level.Error(logger).Log("msg", "z report upload sweep failed", "err", err)
+				}
+			}
+		}()
+	}
+	if cfg.ZReport.ArchiveRoot != "" {
+		zOpts.Archive, err = archive.New(cfg.ZReport.ArchiveRoot)
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			return
+		}
+		if cfg.ZReport.ArchiveMaxAge > 0 {
+			go func() {
+				for range time.Tick(time.Hour) {
+					res, err := zOpts.Archive.Sweep(cfg.ZReport.ArchiveMaxAge, cfg.ZReport.ArchiveRetention)
+					if err != nil {
+						level.Error(logger).Log("msg", "z report archive sweep failed", "err", err)
+						continue
+					}
+					level.Info(logger).Log("msg", "z report archive swept", "deleted", res.Deleted, "compressed", res.Compressed)
+				}
+			}()
+		}
+	}
 
 	go func() {
 		for {
@@ -126,21 +406,66 @@ func main() {
 
 			l := log.With(logger, "trace_id", nxCtx.GetTraceId(ctx))
 
-			go handleConnection(ctx, conn, nexusCl, l)
+			sess := sessions.Open(traceID, conn)
+			go handleConnection(ctx, sess, capturer, b, sink, seq, gOpts, eOpts, zOpts, l)
 		}
 	}()
 	level.Error(logger).Log("exit", <-errs)
 }
 
-func handleConnection(ctx context.Context, conn net.Conn, nexusCl *nexushttpclient.SlipClient, logger log.Logger) {
+// slipRecordOptions returns the G frame parsing options of cfg, without keys
+// and registry.
+func slipRecordOptions(cfg *Config) (*sliprecord.Options, error) {
+	gOpts := &sliprecord.Options{
+		Parsing:    cfg.SlipRecord.Parsing,
+		JSONFormat: cfg.SlipRecord.JSONFormat,
+		Schema:     slipfields.Schema{},
+	}
+	for k, v := range slipfields.DefaultSchema {
+		gOpts.Schema[k] = v
+	}
+	for k, v := range cfg.SlipRecord.FieldKinds {
+		gOpts.Schema[k] = v
+	}
+	err := gOpts.Schema.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if gOpts.JSONFormat == slipfields.FormatTyped && !gOpts.Schema.HasKind(slipfields.KindAmount) {
+		return nil, errors.New("slip_record.json_format typed needs the amount fields of the slip lines in slip_record.field_kinds")
+	}
+	if cfg.SlipRecord.Validation.Mode == "" {
+		cfg.SlipRecord.Validation.Mode = slipcheck.ModeOff
+	}
+	gOpts.Validator, err = slipcheck.New(cfg.SlipRecord.Validation)
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.SlipRecord.Charset.Validate()
+	if err != nil {
+		return nil, err
+	}
+	gOpts.Charset = &cfg.SlipRecord.Charset
+	return gOpts, nil
+}
+
+func handleConnection(ctx context.Context, sess *session.Session, capturer *capture.Capturer, b backend.Backend, sink eventsink.Sink, seq *sequence.Tracker, gOpts *sliprecord.Options, eOpts *slipvalidation.Options, zOpts *zreport.Options, logger log.Logger) {
+	conn := sess.Conn()
 	defer func() {
 		//level.Error(logger).Log("err", "closing socket")
 
 		conn.Close()
+		sess.End()
 	}()
 
 	level.Info(logger).Log("newconnection", conn.RemoteAddr())
 
+	connInfo := &inventory.Conn{RemoteIP: conn.RemoteAddr().String()}
+	if host, _, err := net.SplitHostPort(connInfo.RemoteIP); err == nil {
+		connInfo.RemoteIP = host
+	}
+	ctx = inventory.NewContext(ctx, connInfo)
+
 	// set SetReadDeadline
 	err := conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
 	if err != nil {
@@ -148,9 +473,23 @@ func handleConnection(ctx context.Context, conn net.Conn, nexusCl *nexushttpclie
 		return
 	}
 
+	captured := func(rec *capture.Recorder, ecrSerial string, frame []byte) {
+		err := rec.Done(ecrSerial, frame)
+		if err != nil {
+			level.Error(logger).Log("msg", "capture failed", "err", err)
+		}
+	}
+
 	for {
 		msg := make([]byte, sliprecord.SlipMaxMessageLength)
 		n, err := conn.Read(msg)
+		if tc, ok := sess.NetConn().(*tls.Conn); ok && connInfo.TLSVersion == "" {
+			// the handshake is done by the first Read
+			if st := tc.ConnectionState(); st.HandshakeComplete {
+				connInfo.TLSVersion = inventory.TLSVersionName(st.Version)
+				sess.SetTLS(st)
+			}
+		}
 		if err != nil {
 			if err == io.EOF {
 				//level.Info(logger).Log("info", "reached end of data from socket")
@@ -171,33 +510,47 @@ func handleConnection(ctx context.Context, conn net.Conn, nexusCl *nexushttpclie
 			return
 		}
 
-		if msg[sliprecord.SlipRecordIdentifierOffset] == sliprecord.SlipRecordMessageIdentifier {
+		switch msg[sliprecord.SlipRecordIdentifierOffset] {
+		case sliprecord.SlipRecordMessageIdentifier, sliprecord.SlipRecordSignedMessageIdentifier:
 			level.Info(logger).Log("newmessage", "G")
 
-			s := sliprecord.New(logger, nexusCl, msg, n)
-			err = s.HandleMsgG(ctx, conn)
+			sess.MessageStarted("G")
+			rec := capturer.Recorder(sess.ID, conn)
+			s := sliprecord.New(logger, b, sink, seq, gOpts, msg, n)
+			err = s.HandleMsgG(rec.Context(ctx), rec)
+			sess.MessageDone(s.EcrSerial(), err)
+			captured(rec, s.EcrSerial(), s.RawMessage())
 
 			//d := s.RawMessage()
 			//level.Info(logger).Log("received raw message G:", hex.EncodeToString(d))
 			if err != nil {
 				level.Error(logger).Log("err", err)
 			}
-		} else if msg[sliprecord.SlipRecordIdentifierOffset] == sliprecord.SlipValidationMessageIdentifier {
+		case sliprecord.SlipValidationMessageIdentifier, sliprecord.SlipValidationSignedMessageIdentifier:
 			level.Info(logger).Log("newmessage", "E")
 
-			s := slipvalidation.New(logger, nexusCl, msg, n)
-			err = s.Handle(ctx, conn)
+			sess.MessageStarted("E")
+			rec := capturer.Recorder(sess.ID, conn)
+			s := slipvalidation.New(logger, b, sink, eOpts, msg, n)
+			err = s.Handle(rec.Context(ctx), rec)
+			sess.MessageDone(s.EcrSerial(), err)
+			d, i := s.RawMessage()
+			captured(rec, s.EcrSerial(), d[:i])
 
 			//d, i := s.RawMessage()
 			//level.Info(logger).Log("received raw message E:", hex.EncodeToString(d[:i]))
 			if err != nil {
 				level.Error(logger).Log("err", err)
 			}
-		} else if msg[sliprecord.SlipRecordIdentifierOffset] == zreport.ZReportMessageIdentifier {
+		case zreport.ZReportMessageIdentifier, zreport.ZReportSignedMessageIdentifier:
 			level.Info(logger).Log("newmessage", "W")
 
-			s := zreport.New(logger, nexusCl, msg, n)
-			err = s.Handle(ctx, conn)
+			sess.MessageStarted("W")
+			rec := capturer.Recorder(sess.ID, conn)
+			s := zreport.New(logger, b, sink, zOpts, msg, n)
+			err = s.Handle(rec.Context(ctx), rec)
+			sess.MessageDone(s.EcrSerial(), err)
+			captured(rec, s.EcrSerial(), s.RawMessage())
 
 			//d := s.RawMessage()
 			//level.Info(logger).Log("received raw message W:", hex.EncodeToString(d))
@@ -206,7 +559,7 @@ func handleConnection(ctx context.Context, conn net.Conn, nexusCl *nexushttpclie
 				level.Info(logger).Log("received raw message W:", hex.EncodeToString(d))
 				level.Error(logger).Log("err", err)
 			}
-		} else {
+		default:
 			level.Error(logger).Log("unknown message identifier", msg)
 		}
 	}
@@ -0,0 +1,81 @@
+package reconcile
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+var csvHeader = []string{
+	"ecr_serial", "z_report", "status", "report_received", "updated_at",
+	"first_slip_no", "last_slip_no", "expected_slips", "received_slips",
+	"missing_slips", "unexpected_slip_nos", "late_slip_nos",
+	"totals_compared", "expected_total", "received_total",
+}
+
+// Export writes records to w in the given format.
+func Export(w io.Writer, format string, records []*Record) error {
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		err := cw.Write(csvHeader)
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			err = cw.Write([]string{
+				r.EcrSerial,
+				strconv.Itoa(r.ZReport),
+				r.Status,
+				r.ReportReceived.Format(time.RFC3339),
+				r.UpdatedAt.Format(time.RFC3339),
+				strconv.Itoa(r.FirstSlipNo),
+				strconv.Itoa(r.LastSlipNo),
+				strconv.Itoa(r.ExpectedSlips),
+				strconv.Itoa(r.ReceivedSlips),
+				joinRanges(r.MissingSlips),
+				joinInts(r.UnexpectedSlipNos),
+				joinInts(r.LateSlipNos),
+				strconv.FormatBool(r.TotalsCompared),
+				strconv.FormatInt(r.ExpectedTotal, 10),
+				strconv.FormatInt(r.ReceivedTotal, 10),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return fmt.Errorf("unknown export format %q", format)
+	}
+}
+
+func joinRanges(r []SlipRange) string {
+	s := make([]string, len(r))
+	for i, v := range r {
+		s[i] = v.String()
+	}
+	return strings.Join(s, " ")
+}
+
+func joinInts(n []int) string {
+	s := make([]string, len(n))
+	for i, v := range n {
+		s[i] = strconv.Itoa(v)
+	}
+	return strings.Join(s, " ")
+}
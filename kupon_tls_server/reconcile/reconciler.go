@@ -0,0 +1,250 @@
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"nexusws/cmd/kupon_tls_server/eventsink"
+	"nexusws/cmd/kupon_tls_server/slipfields"
+	"nexusws/cmd/kupon_tls_server/sliplines"
+	"nexusws/cmd/kupon_tls_server/zreport"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TotalFunc returns the gross total of a slip record in the smallest currency
+// unit. The second value is false when the record carries no total.
+type TotalFunc func(r *slipfields.Record) (int64, bool)
+
+// Reconciler is an event sink that collects accepted G records per register
+// and Z report and, when the Z report arrives, compares what the register
+// reported with what was actually received.
+//
+// It never fails a write: a reconciliation problem is logged and must not
+// NACK a register whose message was already saved.
+type Reconciler struct {
+	l         log.Logger
+	st        *store
+	totalFunc TotalFunc
+	mu        sync.Mutex
+}
+
+func NewReconciler(l log.Logger, dir string, totalFunc TotalFunc) *Reconciler {
+	return &Reconciler{
+		l:         l,
+		st:        &store{dir: dir},
+		totalFunc: totalFunc,
+	}
+}
+
+func (r *Reconciler) Write(ctx context.Context, e *eventsink.Event) error {
+	var err error
+	switch e.Type {
+	case eventsink.EventSlipRecord:
+		var slips []slip
+		switch msg := e.Payload.(type) {
+		case *sliplines.Message:
+			// only the header counters are parsed without a schema, the
+			// total field is parsed by totalFunc
+			var typed *slipfields.Message
+			typed, err = slipfields.Convert(msg, nil)
+			if err == nil {
+				slips = r.typedSlips(typed)
+			}
+		case *slipfields.Message:
+			slips = r.typedSlips(msg)
+		default:
+			return nil
+		}
+		if err == nil {
+			err = r.addSlips(e, slips)
+		}
+	case eventsink.EventZReport:
+		report, ok := e.Payload.(*zreport.ZReportEvent)
+		if !ok {
+			return nil
+		}
+		err = r.reconcile(e, report)
+	default:
+		return nil
+	}
+	if err != nil {
+		level.Error(r.l).Log("msg", "reconciliation failed", "type", e.Type, "ecrSerial", e.EcrSerial, "err", err.Error())
+	}
+	return nil
+}
+
+// slip is a received slip record with its numbers parsed.
+type slip struct {
+	zReport     int
+	slipSerial  int
+	dailySlipNo int
+	total       int64
+	hasTotal    bool
+}
+
+func (r *Reconciler) typedSlips(msg *slipfields.Message) []slip {
+	slips := make([]slip, 0, len(msg.Records))
+	for i := range msg.Records {
+		rec := &msg.Records[i]
+		sl := slip{zReport: rec.ZReport, slipSerial: rec.SlipSerial, dailySlipNo: rec.DailySlipNo}
+		if r.totalFunc != nil {
+			sl.total, sl.hasTotal = r.totalFunc(rec)
+		}
+		slips = append(slips, sl)
+	}
+	return slips
+}
+
+func (r *Reconciler) addSlips(e *eventsink.Event, slips []slip) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	late := map[int][]int{}
+	zReports := make([]int, 0)
+	for _, sl := range slips {
+		err := r.st.appendSlip(e.EcrSerial, sl.zReport, &receivedSlip{
+			SlipSerial:  sl.slipSerial,
+			DailySlipNo: sl.dailySlipNo,
+			Total:       sl.total,
+			HasTotal:    sl.hasTotal,
+			Received:    e.Time,
+			TraceID:     e.TraceID,
+		})
+		if err != nil {
+			return err
+		}
+		if _, ok := late[sl.zReport]; !ok {
+			zReports = append(zReports, sl.zReport)
+		}
+		late[sl.zReport] = append(late[sl.zReport], sl.slipSerial)
+	}
+
+	// slips for an already reconciled Z report are late, redo the record once
+	// per Z report of the message
+	for _, zReport := range zReports {
+		rep, err := r.st.record(e.EcrSerial, zReport)
+		if err != nil {
+			return err
+		}
+		if rep == nil {
+			continue
+		}
+		err = r.update(rep, e.Time)
+		if err != nil {
+			return err
+		}
+		level.Warn(r.l).Log("msg", "slips received after Z report", "ecrSerial", e.EcrSerial, "zReport", zReport, "slipSerials", fmt.Sprint(late[zReport]))
+	}
+	return nil
+}
+
+func (r *Reconciler) reconcile(e *eventsink.Event, report *zreport.ZReportEvent) error {
+	if report.Summary == nil {
+		return errors.New("z report has no parsed summary, enable zreport content parsing")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rep := &Record{
+		EcrSerial:      e.EcrSerial,
+		ZReport:        report.Summary.ReportNo,
+		ReportReceived: e.Time,
+		FirstSlipNo:    report.Summary.FirstSlipNo,
+		LastSlipNo:     report.Summary.LastSlipNo,
+		ExpectedSlips:  report.Summary.SlipCount,
+		ExpectedTotal:  report.Summary.Total(),
+	}
+	err := r.update(rep, e.Time)
+	if err != nil {
+		return err
+	}
+	if rep.Status != StatusOK {
+		level.Warn(r.l).Log("msg", "z report does not match received slips", "ecrSerial", rep.EcrSerial, "zReport", rep.ZReport,
+			"missing", rep.MissingSlipCount, "unexpected", len(rep.UnexpectedSlipNos),
+			"expectedSlips", rep.ExpectedSlips, "receivedSlips", rep.ReceivedSlips)
+	}
+	return nil
+}
+
+// update recomputes rep from the slips stored so far and saves it.
+func (r *Reconciler) update(rep *Record, now time.Time) error {
+	slips, err := r.st.slips(rep.EcrSerial, rep.ZReport)
+	if err != nil {
+		return err
+	}
+
+	inRange := make([]int, 0, len(slips))
+	rep.ReceivedSlips = len(slips)
+	rep.UnexpectedSlipNos = []int{}
+	rep.LateSlipNos = []int{}
+	rep.ReceivedTotal = 0
+	rep.TotalsCompared = r.totalFunc != nil
+	for _, slip := range slips {
+		if slip.SlipSerial < rep.FirstSlipNo || slip.SlipSerial > rep.LastSlipNo {
+			rep.UnexpectedSlipNos = append(rep.UnexpectedSlipNos, slip.SlipSerial)
+		} else {
+			inRange = append(inRange, slip.SlipSerial)
+		}
+		if slip.Received.After(rep.ReportReceived) {
+			rep.LateSlipNos = append(rep.LateSlipNos, slip.SlipSerial)
+		}
+		if !slip.HasTotal {
+			rep.TotalsCompared = false
+		}
+		rep.ReceivedTotal += slip.Total
+	}
+
+	rep.MissingSlips, rep.MissingSlipCount = missing(rep.FirstSlipNo, rep.LastSlipNo, inRange)
+	sort.Ints(rep.UnexpectedSlipNos)
+	sort.Ints(rep.LateSlipNos)
+
+	rep.UpdatedAt = now
+	rep.updateStatus()
+	return r.st.saveRecord(rep)
+}
+
+// Records returns the stored reconciliation records of one register, or of
+// all registers when ecrSerial is empty. A zReport above 0 selects a single
+// Z report.
+func (r *Reconciler) Records(ecrSerial string, zReport int) ([]*Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if zReport > 0 {
+		if ecrSerial == "" {
+			return nil, errors.New("a Z report number needs an ECR serial")
+		}
+		rep, err := r.st.record(ecrSerial, zReport)
+		if err != nil || rep == nil {
+			return nil, err
+		}
+		return []*Record{rep}, nil
+	}
+	return r.st.records(ecrSerial)
+}
+
+// missing returns the ranges of first..last that are not in received, which
+// holds distinct numbers of that range. The work depends on the slips
+// received, not on the width of the range the register reported.
+func missing(first int, last int, received []int) ([]SlipRange, int) {
+	ranges := []SlipRange{}
+	if first <= 0 || last < first {
+		return ranges, 0
+	}
+	sort.Ints(received)
+	count := 0
+	next := first
+	for _, n := range append(received, last+1) {
+		if n > next {
+			ranges = append(ranges, SlipRange{From: next, To: n - 1})
+			count += n - next
+		}
+		next = n + 1
+	}
+	return ranges, count
+}
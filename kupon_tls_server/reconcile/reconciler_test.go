@@ -0,0 +1,134 @@
+package reconcile
+
+import (
+	"context"
+	"github.com/go-kit/kit/log"
+	"math"
+	"nexusws/cmd/kupon_tls_server/eventsink"
+	"nexusws/cmd/kupon_tls_server/slipcheck"
+	"nexusws/cmd/kupon_tls_server/slipfields"
+	"nexusws/cmd/kupon_tls_server/sliplines"
+	"nexusws/cmd/kupon_tls_server/zreport"
+	"nexusws/cmd/kupon_tls_server/zreport/zfile"
+	v13 "nexusws/pkg/nexushttpclient/v13"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func slipEvent(t time.Time, zReport int, slipSerials ...int) *eventsink.Event {
+	msg := &sliplines.Message{Header: &v13.MessageGHeader{EcrSerial: "ECR1"}}
+	for i, n := range slipSerials {
+		rec := sliplines.Record{}
+		rec.ZReport = strconv.Itoa(zReport)
+		rec.SlipSerial = strconv.Itoa(n)
+		rec.DailySlipNo = strconv.Itoa(i + 1)
+		msg.Records = append(msg.Records, rec)
+	}
+	return &eventsink.Event{Type: eventsink.EventSlipRecord, Time: t, EcrSerial: "ECR1", Payload: msg}
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	r := NewReconciler(log.NewNopLogger(), t.TempDir(), nil)
+	now := time.Date(2024, 3, 1, 20, 0, 0, 0, time.UTC)
+
+	r.Write(ctx, slipEvent(now, 7, 100, 101, 101, 103, 99))
+	r.Write(ctx, &eventsink.Event{
+		Type:      eventsink.EventZReport,
+		Time:      now.Add(time.Minute),
+		EcrSerial: "ECR1",
+		Payload: &zreport.ZReportEvent{Summary: &zfile.Summary{
+			ReportNo: 7, SlipCount: 5, FirstSlipNo: 100, LastSlipNo: 104,
+		}},
+	})
+
+	got, err := r.Records("ECR1", 7)
+	if err != nil || len(got) != 1 {
+		t.Fatalf("Records: %v %v", got, err)
+	}
+	rep := got[0]
+	if rep.Status != StatusMismatch || rep.ReceivedSlips != 4 {
+		t.Fatalf("status %s received %d", rep.Status, rep.ReceivedSlips)
+	}
+	if !reflect.DeepEqual(rep.MissingSlips, []SlipRange{{102, 102}, {104, 104}}) || rep.MissingSlipCount != 2 {
+		t.Errorf("missing %v count %d", rep.MissingSlips, rep.MissingSlipCount)
+	}
+	if !reflect.DeepEqual(rep.UnexpectedSlipNos, []int{99}) {
+		t.Errorf("unexpected %v", rep.UnexpectedSlipNos)
+	}
+
+	// late slips are added to the existing record
+	r.Write(ctx, slipEvent(now.Add(2*time.Minute), 7, 102, 104))
+	got, _ = r.Records("ECR1", 7)
+	rep = got[0]
+	if len(rep.MissingSlips) != 0 || !reflect.DeepEqual(rep.LateSlipNos, []int{102, 104}) {
+		t.Errorf("after late slips missing %v late %v", rep.MissingSlips, rep.LateSlipNos)
+	}
+}
+
+func zReportEvent(t time.Time, summary *zfile.Summary) *eventsink.Event {
+	return &eventsink.Event{
+		Type:      eventsink.EventZReport,
+		Time:      t,
+		EcrSerial: "ECR1",
+		Payload:   &zreport.ZReportEvent{Summary: summary},
+	}
+}
+
+func TestReconcileWideRange(t *testing.T) {
+	ctx := context.Background()
+	r := NewReconciler(log.NewNopLogger(), t.TempDir(), nil)
+	now := time.Date(2024, 3, 1, 20, 0, 0, 0, time.UTC)
+
+	// the range is not walked number by number
+	r.Write(ctx, slipEvent(now, 8, 5, 6))
+	r.Write(ctx, zReportEvent(now.Add(time.Minute), &zfile.Summary{
+		ReportNo: 8, SlipCount: 2, FirstSlipNo: 1, LastSlipNo: math.MaxInt32,
+	}))
+
+	got, err := r.Records("ECR1", 8)
+	if err != nil || len(got) != 1 {
+		t.Fatalf("Records: %v %v", got, err)
+	}
+	want := []SlipRange{{1, 4}, {7, math.MaxInt32}}
+	if rep := got[0]; !reflect.DeepEqual(rep.MissingSlips, want) || rep.MissingSlipCount != math.MaxInt32-2 {
+		t.Errorf("missing %v count %d", rep.MissingSlips, rep.MissingSlipCount)
+	}
+}
+
+func TestReconcileTotals(t *testing.T) {
+	ctx := context.Background()
+	v, err := slipcheck.New(slipcheck.Config{
+		Mode:  slipcheck.ModeOff,
+		Total: slipcheck.Field{Line: "LineD", Field: "Total"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReconciler(log.NewNopLogger(), t.TempDir(), v.Total)
+	now := time.Date(2024, 3, 1, 20, 0, 0, 0, time.UTC)
+
+	msg := &slipfields.Message{Format: slipfields.FormatTyped}
+	for n, total := range map[int]string{1: "10.00", 2: "2.50"} {
+		msg.Records = append(msg.Records, slipfields.Record{
+			ZReport: 9, SlipSerial: n, DailySlipNo: n,
+			Lines: map[string]interface{}{"LineD": map[string]interface{}{"Total": total}},
+		})
+	}
+	r.Write(ctx, &eventsink.Event{Type: eventsink.EventSlipRecord, Time: now, EcrSerial: "ECR1", Payload: msg})
+
+	summary := &zfile.Summary{
+		ReportNo: 9, SlipCount: 2, FirstSlipNo: 1, LastSlipNo: 2,
+		VatGroups: []zfile.VatTotal{{Group: "A", Gross: 1300}},
+	}
+	r.Write(ctx, zReportEvent(now.Add(time.Minute), summary))
+
+	got, _ := r.Records("ECR1", 9)
+	rep := got[0]
+	if !rep.TotalsCompared || rep.ReceivedTotal != 1250 || rep.ExpectedTotal != 1300 || rep.Status != StatusMismatch {
+		t.Errorf("totals compared %v, received %d, expected %d, status %s",
+			rep.TotalsCompared, rep.ReceivedTotal, rep.ExpectedTotal, rep.Status)
+	}
+}
@@ -0,0 +1,76 @@
+package reconcile
+
+import (
+	"strconv"
+	"time"
+)
+
+const (
+	StatusOK       = "ok"
+	StatusMismatch = "mismatch"
+)
+
+// Record is the result of reconciling one Z report with the G records
+// received for the same EcrSerial and Z report number. Slip numbers are
+// SlipSerial values.
+type Record struct {
+	EcrSerial      string    `json:"EcrSerial"`
+	ZReport        int       `json:"ZReport"`
+	ReportReceived time.Time `json:"ReportReceived"`
+	UpdatedAt      time.Time `json:"UpdatedAt"`
+	Status         string    `json:"Status"`
+
+	FirstSlipNo   int `json:"FirstSlipNo"`
+	LastSlipNo    int `json:"LastSlipNo"`
+	ExpectedSlips int `json:"ExpectedSlips"`
+	ReceivedSlips int `json:"ReceivedSlips"`
+
+	// MissingSlips are the parts of the report range that were never
+	// received, MissingSlipCount the number of slips in them.
+	MissingSlips     []SlipRange `json:"MissingSlips"`
+	MissingSlipCount int         `json:"MissingSlipCount"`
+	// UnexpectedSlipNos were received but are outside the report range.
+	UnexpectedSlipNos []int `json:"UnexpectedSlipNos"`
+	// LateSlipNos arrived after the Z report closed the fiscal day.
+	LateSlipNos []int `json:"LateSlipNos"`
+
+	// TotalsCompared is false when slip totals are not available, the totals
+	// below are then not meaningful.
+	TotalsCompared bool  `json:"TotalsCompared"`
+	ExpectedTotal  int64 `json:"ExpectedTotal"`
+	ReceivedTotal  int64 `json:"ReceivedTotal"`
+}
+
+func (r *Record) updateStatus() {
+	r.Status = StatusOK
+	if r.MissingSlipCount > 0 ||
+		len(r.UnexpectedSlipNos) > 0 ||
+		len(r.LateSlipNos) > 0 ||
+		r.ExpectedSlips != r.ReceivedSlips ||
+		(r.TotalsCompared && r.ExpectedTotal != r.ReceivedTotal) {
+		r.Status = StatusMismatch
+	}
+}
+
+// SlipRange is a run of slip numbers, From and To included.
+type SlipRange struct {
+	From int `json:"From"`
+	To   int `json:"To"`
+}
+
+func (r SlipRange) String() string {
+	if r.From == r.To {
+		return strconv.Itoa(r.From)
+	}
+	return strconv.Itoa(r.From) + "-" + strconv.Itoa(r.To)
+}
+
+// receivedSlip is what is kept of every G record until its Z report arrives.
+type receivedSlip struct {
+	SlipSerial  int       `json:"SlipSerial"`
+	DailySlipNo int       `json:"DailySlipNo"`
+	Total       int64     `json:"Total"`
+	HasTotal    bool      `json:"HasTotal"`
+	Received    time.Time `json:"Received"`
+	TraceID     string    `json:"TraceID"`
+}
@@ -0,0 +1,157 @@
+package reconcile
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	slipsFileSuffix  = ".slips.ndjson"
+	recordFileSuffix = ".reconciliation.json"
+)
+
+var ecrSerialUnsafeChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// store keeps the received slips and reconciliation records of every Z
+// report under <dir>/<EcrSerial>/<zreport>.slips.ndjson and
+// <dir>/<EcrSerial>/<zreport>.reconciliation.json. It is not safe for
+// concurrent use.
+type store struct {
+	dir string
+}
+
+func (s *store) ecrDir(ecrSerial string) string {
+	name := ecrSerialUnsafeChars.ReplaceAllString(ecrSerial, "_")
+	if name == "" {
+		name = "unknown"
+	}
+	return filepath.Join(s.dir, name)
+}
+
+func (s *store) appendSlip(ecrSerial string, zReport int, slip *receivedSlip) error {
+	dir := s.ecrDir(ecrSerial)
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(slip)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, strconv.Itoa(zReport)+slipsFileSuffix), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	cerr := f.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// slips returns the received slips of a Z report, one per SlipSerial.
+// Resends of a slip keep the first one received.
+func (s *store) slips(ecrSerial string, zReport int) ([]*receivedSlip, error) {
+	f, err := os.Open(filepath.Join(s.ecrDir(ecrSerial), strconv.Itoa(zReport)+slipsFileSuffix))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	seen := map[int]bool{}
+	slips := make([]*receivedSlip, 0)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		slip := &receivedSlip{}
+		err = json.Unmarshal(sc.Bytes(), slip)
+		if err != nil {
+			return nil, err
+		}
+		if seen[slip.SlipSerial] {
+			continue
+		}
+		seen[slip.SlipSerial] = true
+		slips = append(slips, slip)
+	}
+	return slips, sc.Err()
+}
+
+func (s *store) saveRecord(r *Record) error {
+	dir := s.ecrDir(r.EcrSerial)
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(dir, strconv.Itoa(r.ZReport)+recordFileSuffix)
+	err = os.WriteFile(name+".tmp", data, 0640)
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+func (s *store) record(ecrSerial string, zReport int) (*Record, error) {
+	data, err := os.ReadFile(filepath.Join(s.ecrDir(ecrSerial), strconv.Itoa(zReport)+recordFileSuffix))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := &Record{}
+	err = json.Unmarshal(data, r)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// records returns the reconciliation records of one register, or of all
+// registers when ecrSerial is empty, ordered by EcrSerial and Z report.
+func (s *store) records(ecrSerial string) ([]*Record, error) {
+	pattern := filepath.Join(s.dir, "*", "*"+recordFileSuffix)
+	if ecrSerial != "" {
+		pattern = filepath.Join(s.ecrDir(ecrSerial), "*"+recordFileSuffix)
+	}
+	names, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*Record, 0, len(names))
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		r := &Record{}
+		err = json.Unmarshal(data, r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].EcrSerial != records[j].EcrSerial {
+			return strings.Compare(records[i].EcrSerial, records[j].EcrSerial) < 0
+		}
+		return records[i].ZReport < records[j].ZReport
+	})
+	return records, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"nexusws/cmd/kupon_tls_server/reconcile"
+	"nexusws/cmd/kupon_tls_server/slipcheck"
+	"os"
+)
+
+// reconcileCmd prints stored reconciliation records:
+//
+//	kupon_tls_server reconcile [-config config.yaml] [-ecr serial] [-z no] [-format csv|json]
+func reconcileCmd(args []string) int {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	configFile := fs.String("config", "./config.yaml", "config file")
+	ecrSerial := fs.String("ecr", "", "ECR serial, all registers when empty")
+	zReport := fs.Int("z", 0, "Z report number, needs -ecr")
+	format := fs.String("format", reconcile.FormatCSV, "output format, csv or json")
+	mismatchOnly := fs.Bool("mismatch", false, "only Z reports that do not match")
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	cfg := &Config{}
+	err = NewFromFile(*configFile, cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	r, err := newReconciler(log.NewNopLogger(), cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	records, err := r.Records(*ecrSerial, *zReport)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *mismatchOnly {
+		filtered := records[:0]
+		for _, rec := range records {
+			if rec.Status != reconcile.StatusOK {
+				filtered = append(filtered, rec)
+			}
+		}
+		records = filtered
+	}
+
+	err = reconcile.Export(os.Stdout, *format, records)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// newReconciler returns the reconciler of cfg. Slip totals are read from the
+// total field of slip_record.validation, whatever its mode. Without one only
+// the slip numbers are reconciled.
+func newReconciler(l log.Logger, cfg *Config) (*reconcile.Reconciler, error) {
+	vcfg := cfg.SlipRecord.Validation
+	if vcfg.Total.Line == "" || vcfg.Total.Field == "" {
+		return reconcile.NewReconciler(l, cfg.Reconciliation.Dir, nil), nil
+	}
+	vcfg.Mode = slipcheck.ModeOff
+	v, err := slipcheck.New(vcfg)
+	if err != nil {
+		return nil, err
+	}
+	return reconcile.NewReconciler(l, cfg.Reconciliation.Dir, v.Total), nil
+}
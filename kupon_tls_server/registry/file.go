@@ -0,0 +1,85 @@
+package registry
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"nexusws/cmd/kupon_tls_server/reloadfile"
+	"strings"
+	"sync"
+)
+
+// File is a YAML registry:
+//
+//	devices:
+//	  ECR0000001:
+//	    owner_tin: K12345678A
+//	    business_unit: ab123cd456
+//	    location: Tirana
+//	    protocol_version: "13"
+//	    status: active
+//
+// It is read again by Lookup when the file changed.
+type File struct {
+	file *reloadfile.File
+
+	mu      sync.RWMutex
+	devices map[string]*Device
+}
+
+func NewFile(path string) (*File, error) {
+	f := &File{file: reloadfile.New(path)}
+	err := f.reload()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) reload() error {
+	return f.file.Load(f.apply)
+}
+
+func (f *File) apply(b []byte) error {
+	var content struct {
+		Devices map[string]*Device `yaml:"devices"`
+	}
+	err := yaml.Unmarshal(b, &content)
+	if err != nil {
+		return fmt.Errorf("registry %s: %w", f.file.Path(), err)
+	}
+	devices := make(map[string]*Device, len(content.Devices))
+	for ecr, d := range content.Devices {
+		if d == nil {
+			d = &Device{}
+		}
+		d.EcrSerial = strings.TrimSpace(ecr)
+		err = d.validate()
+		if err != nil {
+			return fmt.Errorf("registry %s: %w", f.file.Path(), err)
+		}
+		devices[d.EcrSerial] = d
+	}
+
+	f.mu.Lock()
+	f.devices = devices
+	f.mu.Unlock()
+	return nil
+}
+
+// Lookup returns a copy of the device. When the file can not be read again
+// the devices read before are used.
+func (f *File) Lookup(ecrSerial string) (*Device, error) {
+	err := f.reload()
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	d, ok := f.devices[ecrSerial]
+	if !ok {
+		if err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	c := *d
+	return &c, nil
+}
@@ -0,0 +1,175 @@
+// Package registry holds the registered fiscal devices. Frames are only
+// accepted from active devices, and the attributes of the device are added
+// to postgres rows, events and log lines.
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"nexusws/cmd/kupon_tls_server/kupon_errors"
+	"strings"
+)
+
+// Device statuses, frames are accepted from StatusActive devices only.
+const (
+	StatusActive         = "active"
+	StatusBlocked        = "blocked"
+	StatusDecommissioned = "decommissioned"
+)
+
+// Registry sources.
+const (
+	TypeYAML   = "yaml"
+	TypeSQLite = "sqlite"
+)
+
+var (
+	ErrUnknownDevice        = errors.New("device is not registered")
+	ErrDeviceBlocked        = errors.New("device is blocked")
+	ErrDeviceDecommissioned = errors.New("device is decommissioned")
+)
+
+type Device struct {
+	EcrSerial    string `yaml:"-" json:"ecr_serial"`
+	OwnerTIN     string `yaml:"owner_tin" json:"owner_tin"`
+	BusinessUnit string `yaml:"business_unit" json:"business_unit"`
+	Location     string `yaml:"location" json:"location"`
+	// ProtocolVersion the device is expected to send, any when empty.
+	ProtocolVersion string `yaml:"protocol_version" json:"protocol_version,omitempty"`
+	Status          string `yaml:"status" json:"status"` // StatusActive when empty
+}
+
+// Expects reports whether protocolVersion is the one the device should send.
+func (d *Device) Expects(protocolVersion string) bool {
+	return d.ProtocolVersion == "" || d.ProtocolVersion == protocolVersion
+}
+
+// Keyvals are the attributes added to log lines of the device.
+func (d *Device) Keyvals() []interface{} {
+	return []interface{}{"owner_tin", d.OwnerTIN, "business_unit", d.BusinessUnit, "location", d.Location}
+}
+
+func (d *Device) validate() error {
+	switch d.Status {
+	case "":
+		d.Status = StatusActive
+	case StatusActive, StatusBlocked, StatusDecommissioned:
+	default:
+		return fmt.Errorf("device %s: unknown status %q", d.EcrSerial, d.Status)
+	}
+	return nil
+}
+
+// Source looks devices up by EcrSerial. Lookup returns nil without an error
+// for a device that is not registered.
+type Source interface {
+	Lookup(ecrSerial string) (*Device, error)
+}
+
+type Config struct {
+	Type string `yaml:"type"` // TypeYAML or TypeSQLite, the registry is off when empty
+	Path string `yaml:"path"`
+	// AllowUnknown accepts frames from devices missing from the registry,
+	// for rolling the registry out.
+	AllowUnknown bool `yaml:"allow_unknown"`
+}
+
+type Registry struct {
+	src          Source
+	allowUnknown bool
+}
+
+func New(src Source, allowUnknown bool) *Registry {
+	return &Registry{src: src, allowUnknown: allowUnknown}
+}
+
+// Open returns the registry of c, nil when c.Type is empty.
+func Open(c Config) (*Registry, error) {
+	var src Source
+	var err error
+	switch c.Type {
+	case "":
+		return nil, nil
+	case TypeYAML:
+		src, err = NewFile(c.Path)
+	case TypeSQLite:
+		src, err = NewSQLite(c.Path)
+	default:
+		return nil, fmt.Errorf("unknown registry type %s", c.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return New(src, c.AllowUnknown), nil
+}
+
+// Admit returns the device of ecrSerial, or an error when its frames must be
+// refused. A nil registry admits every device without attributes, as does
+// AllowUnknown for unregistered ones.
+func (r *Registry) Admit(ecrSerial string) (*Device, error) {
+	if r == nil {
+		return nil, nil
+	}
+	d, err := r.src.Lookup(strings.TrimSpace(ecrSerial))
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		if r.allowUnknown {
+			return nil, nil
+		}
+		return nil, ErrUnknownDevice
+	}
+	switch d.Status {
+	case StatusBlocked:
+		return d, ErrDeviceBlocked
+	case StatusDecommissioned:
+		return d, ErrDeviceDecommissioned
+	}
+	return d, nil
+}
+
+// AdmitFrame admits the device of a frame like Admit. It returns ctx carrying
+// the device and l with its attributes, or ctx and l as they are when the
+// device has none. A frame of an unexpected protocol version is only logged.
+func (r *Registry) AdmitFrame(ctx context.Context, l log.Logger, ecrSerial string, protocolVersion string) (context.Context, log.Logger, error) {
+	d, err := r.Admit(ecrSerial)
+	if err != nil || d == nil {
+		return ctx, l, err
+	}
+	l = log.With(l, d.Keyvals()...)
+	if !d.Expects(protocolVersion) {
+		level.Warn(l).Log("msg", "unexpected protocol version", "protocol_version", protocolVersion, "expected", d.ProtocolVersion)
+	}
+	return NewContext(ctx, d), l, nil
+}
+
+// NackCode returns the NACK code for an error of Admit, def for a failed
+// lookup.
+func NackCode(err error, def int) int {
+	switch {
+	case errors.Is(err, ErrUnknownDevice):
+		return kupon_errors.ErrUnknownDevice
+	case errors.Is(err, ErrDeviceBlocked):
+		return kupon_errors.ErrDeviceBlocked
+	case errors.Is(err, ErrDeviceDecommissioned):
+		return kupon_errors.ErrDeviceDecommissioned
+	}
+	return def
+}
+
+type contextKey struct{}
+
+// NewContext returns ctx carrying d for the backend and the event sinks.
+func NewContext(ctx context.Context, d *Device) context.Context {
+	return context.WithValue(ctx, contextKey{}, d)
+}
+
+// FromContext returns the device of ctx, nil when there is none.
+func FromContext(ctx context.Context) *Device {
+	d, _ := ctx.Value(contextKey{}).(*Device)
+	return d
+}
@@ -0,0 +1,132 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/go-kit/kit/log"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const devices = `
+devices:
+  ECR0000001:
+    owner_tin: K12345678A
+    business_unit: ab123cd456
+    location: Tirana
+    protocol_version: "13"
+  ECR0000002:
+    status: blocked
+  ECR0000003:
+    status: decommissioned
+`
+
+func testSources(t *testing.T) map[string]Source {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "devices.yaml")
+	err := ioutil.WriteFile(path, []byte(devices), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewSQLite(filepath.Join(dir, "devices.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	_, err = db.db.Exec(`INSERT INTO devices (ecr_serial, owner_tin, business_unit, location, protocol_version, status) VALUES
+		('ECR0000001', 'K12345678A', 'ab123cd456', 'Tirana', '13', 'active'),
+		('ECR0000002', '', '', '', '', 'blocked'),
+		('ECR0000003', '', '', '', '', 'decommissioned')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Source{TypeYAML: f, TypeSQLite: db}
+}
+
+func TestAdmit(t *testing.T) {
+	for name, src := range testSources(t) {
+		r := New(src, false)
+
+		d, err := r.Admit("ECR0000001")
+		if err != nil || d == nil {
+			t.Fatalf("%s: active device: %v", name, err)
+		}
+		want := Device{EcrSerial: "ECR0000001", OwnerTIN: "K12345678A", BusinessUnit: "ab123cd456",
+			Location: "Tirana", ProtocolVersion: "13", Status: StatusActive}
+		if *d != want {
+			t.Errorf("%s: got %+v", name, d)
+		}
+		if !d.Expects("13") || d.Expects("14") {
+			t.Errorf("%s: Expects", name)
+		}
+
+		for ecr, want := range map[string]error{
+			"ECR0000002": ErrDeviceBlocked,
+			"ECR0000003": ErrDeviceDecommissioned,
+			"ECR0000004": ErrUnknownDevice,
+		} {
+			_, err = r.Admit(ecr)
+			if !errors.Is(err, want) {
+				t.Errorf("%s: %s: got %v, want %v", name, ecr, err, want)
+			}
+		}
+
+		d, err = New(src, true).Admit("ECR0000004")
+		if d != nil || err != nil {
+			t.Errorf("%s: allow unknown: %v %v", name, d, err)
+		}
+	}
+
+	var none *Registry
+	if d, err := none.Admit("ECR0000004"); d != nil || err != nil {
+		t.Errorf("nil registry: %v %v", d, err)
+	}
+}
+
+func TestContext(t *testing.T) {
+	ctx := context.Background()
+	if FromContext(ctx) != nil {
+		t.Fatal("device in an empty context")
+	}
+	d := &Device{EcrSerial: "ECR0000001"}
+	if FromContext(NewContext(ctx, d)) != d {
+		t.Error("device lost")
+	}
+}
+
+func TestAdmitFrame(t *testing.T) {
+	r := New(testSources(t)[TypeYAML], false)
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	got, _, err := r.AdmitFrame(ctx, log.NewLogfmtLogger(&buf), "ECR0000001", "14")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := FromContext(got); d == nil || d.OwnerTIN != "K12345678A" {
+		t.Errorf("device %+v", d)
+	}
+	if !strings.Contains(buf.String(), "unexpected protocol version") || !strings.Contains(buf.String(), "owner_tin=K12345678A") {
+		t.Errorf("logged %q", buf.String())
+	}
+
+	got, _, err = r.AdmitFrame(ctx, log.NewNopLogger(), "ECR0000002", "13")
+	if !errors.Is(err, ErrDeviceBlocked) || FromContext(got) != nil {
+		t.Errorf("blocked device: err %v", err)
+	}
+
+	// no registry
+	var none *Registry
+	got, _, err = none.AdmitFrame(ctx, log.NewNopLogger(), "ECR0000009", "13")
+	if err != nil || got != ctx {
+		t.Errorf("without registry: err %v", err)
+	}
+}
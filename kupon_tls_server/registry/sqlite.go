@@ -0,0 +1,55 @@
+package registry
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLite is a registry kept in the devices table of a SQLite database,
+// managed by tools outside the server. The table is created when missing.
+type SQLite struct {
+	db *sql.DB
+}
+
+func NewSQLite(path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS devices (
+		ecr_serial       TEXT PRIMARY KEY,
+		owner_tin        TEXT NOT NULL DEFAULT '',
+		business_unit    TEXT NOT NULL DEFAULT '',
+		location         TEXT NOT NULL DEFAULT '',
+		protocol_version TEXT NOT NULL DEFAULT '',
+		status           TEXT NOT NULL DEFAULT 'active'
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLite{db: db}, nil
+}
+
+func (r *SQLite) Close() error {
+	return r.db.Close()
+}
+
+func (r *SQLite) Lookup(ecrSerial string) (*Device, error) {
+	d := &Device{EcrSerial: ecrSerial}
+	err := r.db.QueryRow(
+		`SELECT owner_tin, business_unit, location, protocol_version, status FROM devices WHERE ecr_serial = ?`,
+		ecrSerial,
+	).Scan(&d.OwnerTIN, &d.BusinessUnit, &d.Location, &d.ProtocolVersion, &d.Status)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = d.validate()
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
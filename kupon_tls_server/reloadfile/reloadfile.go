@@ -0,0 +1,52 @@
+// Package reloadfile reads configuration files again when they change, for
+// the registry and the signing key store.
+package reloadfile
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// File is a file that is read again when its modification time changed.
+type File struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+func New(path string) *File {
+	return &File{path: path}
+}
+
+func (f *File) Path() string {
+	return f.path
+}
+
+// Load passes the content of the file to apply when it changed since the
+// last Load that succeeded. When apply fails the content read before stays
+// in use, and the file is read again on the next Load.
+func (f *File) Load(apply func(b []byte) error) error {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fi.ModTime().Equal(f.modTime) {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	err = apply(b)
+	if err != nil {
+		return err
+	}
+	f.modTime = fi.ModTime()
+	return nil
+}
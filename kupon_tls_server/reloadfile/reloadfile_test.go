@@ -0,0 +1,67 @@
+package reloadfile
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.yaml")
+	err := ioutil.WriteFile(path, []byte("a"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := New(path)
+
+	var applied []string
+	apply := func(b []byte) error {
+		applied = append(applied, string(b))
+		if string(b) == "broken" {
+			return errors.New("broken")
+		}
+		return nil
+	}
+	touch := func(content string, at time.Time) {
+		err := ioutil.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, at, at)
+	}
+
+	if err = f.Load(apply); err != nil {
+		t.Fatal(err)
+	}
+	// unchanged
+	if err = f.Load(apply); err != nil {
+		t.Fatal(err)
+	}
+
+	later := time.Now().Add(time.Minute)
+	touch("broken", later)
+	if err = f.Load(apply); err == nil {
+		t.Error("no error from apply")
+	}
+	// a failed apply is tried again
+	if err = f.Load(apply); err == nil {
+		t.Error("no error from apply")
+	}
+
+	touch("b", later.Add(time.Minute))
+	if err = f.Load(apply); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a", "broken", "broken", "b"}
+	if len(applied) != len(want) {
+		t.Fatalf("applied %q, want %q", applied, want)
+	}
+	for i := range want {
+		if applied[i] != want[i] {
+			t.Errorf("applied %q, want %q", applied, want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"nexusws/cmd/kupon_tls_server/eventsink"
+	"nexusws/cmd/kupon_tls_server/frametest"
+	"nexusws/cmd/kupon_tls_server/sliprecord"
+	"nexusws/cmd/kupon_tls_server/slipvalidation"
+	"nexusws/cmd/kupon_tls_server/zreport"
+	nxCtx "nexusws/pkg/context"
+)
+
+// InProcess runs frames through the handlers, with a backend that accepts
+// everything and a sink that keeps the events. E frames get the QR code
+// URL of the recorded H response, so that only parser changes show up:
+// NACKs recorded for backend failures are replayed as ACKs. There is no
+// sequence tracker, see Diff for the resend requests.
+type InProcess struct {
+	l     log.Logger
+	gOpts *sliprecord.Options
+	eOpts *slipvalidation.Options
+	zOpts *zreport.Options
+}
+
+func NewInProcess(l log.Logger, gOpts *sliprecord.Options, eOpts *slipvalidation.Options, zOpts *zreport.Options) *InProcess {
+	return &InProcess{l: l, gOpts: gOpts, eOpts: eOpts, zOpts: zOpts}
+}
+
+func (p *InProcess) Run(ctx context.Context, ex *Exchange) (*Result, error) {
+	ctx = nxCtx.WithTraceID(ctx, ex.Session)
+	b := &frametest.Backend{URL: recordedURL(ex.Response)}
+	sink := &memorySink{}
+
+	// the connection handler reads at most SlipMaxMessageLength bytes, the
+	// handlers read the rest
+	msg := make([]byte, sliprecord.SlipMaxMessageLength)
+	n := copy(msg, ex.Frame)
+	conn := frametest.NewConn(ex.Frame[n:])
+
+	var err error
+	switch msg[sliprecord.SlipRecordIdentifierOffset] {
+	case sliprecord.SlipRecordMessageIdentifier, sliprecord.SlipRecordSignedMessageIdentifier:
+		err = sliprecord.New(p.l, b, sink, nil, p.gOpts, msg, n).HandleMsgG(ctx, conn)
+	case sliprecord.SlipValidationMessageIdentifier, sliprecord.SlipValidationSignedMessageIdentifier:
+		err = slipvalidation.New(p.l, b, sink, p.eOpts, msg, n).Handle(ctx, conn)
+	case zreport.ZReportMessageIdentifier, zreport.ZReportSignedMessageIdentifier:
+		err = zreport.New(p.l, b, sink, p.zOpts, msg, n).Handle(ctx, conn)
+	}
+	if err != nil {
+		p.l.Log("frame", describeFrame(ex.Frame), "err", err)
+	}
+	return &Result{Response: conn.Out.Bytes(), Events: sink.events}, nil
+}
+
+// recordedURL returns the QR code URL of an H response, after the ACK of
+// its E frame.
+func recordedURL(resp []byte) string {
+	resp = bytes.TrimPrefix(resp, []byte(slipvalidation.SlipValidationProtocolACK))
+	if len(resp) < 6 || resp[0] != 'H' {
+		return ""
+	}
+	n := int(resp[3]) | int(resp[4])<<8
+	if 6+n > len(resp) {
+		return ""
+	}
+	return string(resp[6 : 6+n])
+}
+
+type memorySink struct {
+	events []json.RawMessage
+}
+
+func (s *memorySink) Write(ctx context.Context, e *eventsink.Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.events = append(s.events, b)
+	return nil
+}
@@ -0,0 +1,235 @@
+// Package replay sends captured frames again, see package capture, and
+// compares what comes back with what was recorded: the responses of every
+// frame and, in process, the events written to the sinks.
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"nexusws/cmd/kupon_tls_server/capture"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Exchange is a captured frame with what it produced.
+type Exchange struct {
+	Time      time.Time
+	Session   string
+	EcrSerial string
+	Frame     []byte
+	Events    []json.RawMessage
+	Response  []byte // every response written, concatenated
+}
+
+// Exchanges groups capture records by inbound frame. Records before the
+// first inbound frame are skipped.
+func Exchanges(records []capture.Record) ([]*Exchange, error) {
+	var exchanges []*Exchange
+	var cur *Exchange
+	for i := range records {
+		rec := &records[i]
+		switch rec.Dir {
+		case capture.DirIn:
+			b, err := rec.Bytes()
+			if err != nil {
+				return nil, fmt.Errorf("record %d: %v", i, err)
+			}
+			cur = &Exchange{Time: rec.Time, Session: rec.Session, EcrSerial: rec.EcrSerial, Frame: b}
+			exchanges = append(exchanges, cur)
+		case capture.DirEvent:
+			if cur != nil {
+				cur.Events = append(cur.Events, rec.Event)
+			}
+		case capture.DirOut:
+			b, err := rec.Bytes()
+			if err != nil {
+				return nil, fmt.Errorf("record %d: %v", i, err)
+			}
+			if cur != nil {
+				cur.Response = append(cur.Response, b...)
+			}
+		}
+	}
+	return exchanges, nil
+}
+
+// Result is what a replayed frame produced.
+type Result struct {
+	Response []byte
+	// Events is nil when the events are not seen, over TLS.
+	Events []json.RawMessage
+}
+
+// Runner replays exchanges, in capture order.
+type Runner interface {
+	Run(ctx context.Context, ex *Exchange) (*Result, error)
+}
+
+// Diff lists the differences of a replayed exchange, empty when it
+// matches the capture. Resend requests after the ACK of a G frame are left
+// out, they depend on the slips the server had seen before, not on the frame.
+func Diff(ex *Exchange, res *Result) []string {
+	var diffs []string
+	if !bytes.Equal(withoutResend(ex.Response), withoutResend(res.Response)) {
+		diffs = append(diffs, fmt.Sprintf("response: recorded %s, replayed %s", DescribeResponse(ex.Response), DescribeResponse(res.Response)))
+	}
+	if res.Events == nil {
+		return diffs
+	}
+	if len(ex.Events) != len(res.Events) {
+		diffs = append(diffs, fmt.Sprintf("events: recorded %d, replayed %d", len(ex.Events), len(res.Events)))
+	}
+	for i := 0; i < len(ex.Events) && i < len(res.Events); i++ {
+		d, err := diffEvents(ex.Events[i], res.Events[i])
+		if err != nil {
+			diffs = append(diffs, fmt.Sprintf("event %d: %v", i, err))
+			continue
+		}
+		for _, s := range d {
+			diffs = append(diffs, fmt.Sprintf("event %d: %s", i, s))
+		}
+	}
+	return diffs
+}
+
+// withoutResend drops the resend request that follows an ACK.
+func withoutResend(resp []byte) []byte {
+	if len(resp) > 5 && string(resp[:5]) == "A0000" && resp[5] == 'R' {
+		return resp[:5]
+	}
+	return resp
+}
+
+// eventVolatile are the event fields that differ on every run.
+var eventVolatile = []string{"time", "trace_id", "device"}
+
+func diffEvents(recorded, replayed json.RawMessage) ([]string, error) {
+	var a, b map[string]interface{}
+	err := json.Unmarshal(recorded, &a)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(replayed, &b)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range eventVolatile {
+		delete(a, k)
+		delete(b, k)
+	}
+	var diffs []string
+	diffJSON("", a, b, &diffs)
+	return diffs, nil
+}
+
+// diffJSON appends the paths where a and b, decoded JSON, differ.
+func diffJSON(path string, a, b interface{}, diffs *[]string) {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			diffJSON(path+"."+k, av[k], bv[k], diffs)
+		}
+		return
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		if len(av) != len(bv) {
+			*diffs = append(*diffs, fmt.Sprintf("%s: recorded %d elements, replayed %d", path, len(av), len(bv)))
+		}
+		for i := 0; i < len(av) && i < len(bv); i++ {
+			diffJSON(fmt.Sprintf("%s[%d]", path, i), av[i], bv[i], diffs)
+		}
+		return
+	}
+	ab, _ := json.Marshal(a)
+	bb, _ := json.Marshal(b)
+	if !bytes.Equal(ab, bb) {
+		*diffs = append(*diffs, fmt.Sprintf("%s: recorded %s, replayed %s", path, ab, bb))
+	}
+}
+
+// DescribeResponse names the responses in b: ACK, NACK codes, H frames
+// with their QR code URL and resend requests.
+func DescribeResponse(b []byte) string {
+	if len(b) == 0 {
+		return "nothing"
+	}
+	var parts []string
+	for len(b) > 0 {
+		switch {
+		case b[0] == 'A' && len(b) >= 5:
+			if string(b[:5]) == "A0000" {
+				parts = append(parts, "ACK")
+			} else {
+				parts = append(parts, "NACK "+string(b[1:5]))
+			}
+			b = b[5:]
+			continue
+		case b[0] == 'H' && len(b) >= 6:
+			n := int(b[3]) | int(b[4])<<8
+			if 6+n <= len(b) {
+				parts = append(parts, fmt.Sprintf("H %q", b[6:6+n]))
+				b = nil
+				continue
+			}
+		case b[0] == 'R':
+			parts = append(parts, fmt.Sprintf("R %x", b))
+			b = nil
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%x", b))
+		b = nil
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Report replays exchanges with r and writes one line per frame, followed
+// by its differences. It returns the number of frames that differ.
+func Report(ctx context.Context, w io.Writer, r Runner, exchanges []*Exchange) (int, error) {
+	differ := 0
+	for _, ex := range exchanges {
+		res, err := r.Run(ctx, ex)
+		if err != nil {
+			return differ, err
+		}
+		diffs := Diff(ex, res)
+		status := "ok"
+		if len(diffs) > 0 {
+			status = "DIFF"
+			differ++
+		}
+		fmt.Fprintf(w, "%-4s %s %s %s %s\n", status, ex.Time.Format("2006-01-02T15:04:05.000"), ex.EcrSerial, ex.Session, describeFrame(ex.Frame))
+		for _, d := range diffs {
+			fmt.Fprintf(w, "     %s\n", d)
+		}
+	}
+	fmt.Fprintf(w, "%d frames, %d differ\n", len(exchanges), differ)
+	return differ, nil
+}
+
+func describeFrame(b []byte) string {
+	if len(b) < 3 {
+		return fmt.Sprintf("%x", b)
+	}
+	return fmt.Sprintf("%c v%s %d bytes", b[0], b[1:3], len(b))
+}
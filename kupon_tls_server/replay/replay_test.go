@@ -0,0 +1,156 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/go-kit/kit/log"
+	"nexusws/cmd/kupon_tls_server/capture"
+	"nexusws/cmd/kupon_tls_server/frametest"
+	"nexusws/cmd/kupon_tls_server/sequence"
+	"nexusws/cmd/kupon_tls_server/sliprecord"
+	"nexusws/cmd/kupon_tls_server/slipvalidation"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExchanges(t *testing.T) {
+	records := []capture.Record{
+		{Dir: capture.DirOut, Frame: "00"}, // before the first frame
+		{Dir: capture.DirIn, Session: "s1", Frame: hex.EncodeToString([]byte("E14"))},
+		{Dir: capture.DirEvent, Event: json.RawMessage(`{"type":"slip_validation"}`)},
+		{Dir: capture.DirOut, Frame: hex.EncodeToString([]byte("A00"))},
+		{Dir: capture.DirOut, Frame: hex.EncodeToString([]byte("00"))},
+		{Dir: capture.DirIn, Session: "s1", Frame: hex.EncodeToString([]byte("W14"))},
+	}
+	ex, err := Exchanges(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ex) != 2 || string(ex[0].Frame) != "E14" || len(ex[0].Events) != 1 || string(ex[0].Response) != "A0000" || ex[1].Response != nil {
+		t.Fatalf("exchanges %+v", ex)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	ex := &Exchange{
+		Response: []byte("A0000"),
+		Events:   []json.RawMessage{json.RawMessage(`{"type":"zreport","time":"1","payload":{"a":[1,2],"b":"x"}}`)},
+	}
+	same := &Result{
+		Response: []byte("A0000"),
+		Events:   []json.RawMessage{json.RawMessage(`{"type":"zreport","time":"2","payload":{"b":"x","a":[1,2]}}`)},
+	}
+	if d := Diff(ex, same); len(d) != 0 {
+		t.Errorf("diff of the same result: %q", d)
+	}
+
+	changed := &Result{
+		Response: []byte("A9003"),
+		Events:   []json.RawMessage{json.RawMessage(`{"type":"zreport","payload":{"a":[1,3],"c":true}}`)},
+	}
+	want := []string{
+		`response: recorded ACK, replayed NACK 9003`,
+		`event 0: .payload.a[1]: recorded 2, replayed 3`,
+		`event 0: .payload.b: recorded "x", replayed null`,
+		`event 0: .payload.c: recorded null, replayed true`,
+	}
+	d := Diff(ex, changed)
+	if strings.Join(d, "\n") != strings.Join(want, "\n") {
+		t.Errorf("diff %q", d)
+	}
+}
+
+func TestReportInProcess(t *testing.T) {
+	ex := []*Exchange{{EcrSerial: "ECR0000001", Frame: []byte("G12\x00\x004ECR0000001"), Response: []byte("A0000")}}
+	p := NewInProcess(log.NewNopLogger(), &sliprecord.Options{}, nil, nil)
+
+	var out bytes.Buffer
+	differ, err := Report(context.Background(), &out, p, ex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if differ != 1 || !strings.Contains(out.String(), "response: recorded ACK, replayed NACK 9009") {
+		t.Errorf("%d differ, report:\n%s", differ, out.String())
+	}
+}
+
+func TestDescribeResponse(t *testing.T) {
+	h := []byte{'H', '1', '4', 3, 0, 'A', 'u', 'r', 'l', '7', 'F'}
+	for b, want := range map[string]string{
+		"":           "nothing",
+		"A0000":      "ACK",
+		"A9002A0000": "NACK 9002, ACK",
+		string(h):    `H "url"`,
+	} {
+		if got := DescribeResponse([]byte(b)); got != want {
+			t.Errorf("%q: %q, want %q", b, got, want)
+		}
+	}
+}
+
+func TestRoundTripInProcess(t *testing.T) {
+	dir := t.TempDir()
+	capturer, err := capture.New(dir, []string{"ECR0000001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// slip 101 is missing, the second G is answered with a resend request as
+	// its register sets the resend flag
+	seq, err := sequence.NewTracker(log.NewNopLogger(), dir, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := [][]byte{
+		frametest.G14Flags("14", sliprecord.SlipRecordV14FlagResend, "AMAC1;12;100;1;1;20230727;125624;0\nBMAC1;12;100;1;1;Kafe;1;100;100;0;1\n"),
+		frametest.G14Flags("14", sliprecord.SlipRecordV14FlagResend, "AMAC1;12;102;3;1;20230727;130211;0\n"),
+		frametest.E("14"),
+	}
+
+	// record the frames the way the connection handler does
+	ctx := context.Background()
+	// like the NexusWS of a capture
+	b := &frametest.Backend{URL: "http://www.kasat.al/k1/4841625c-b566-4c9d-95be-42d87ec6243a"}
+	for _, frame := range frames {
+		c := &frametest.Conn{}
+		rec := capturer.Recorder("s1", c)
+		msg := make([]byte, sliprecord.SlipMaxMessageLength)
+		n := copy(msg, frame)
+		if frame[0] == sliprecord.SlipRecordMessageIdentifier {
+			s := sliprecord.New(log.NewNopLogger(), b, capturer, seq, &sliprecord.Options{}, msg, n)
+			err = s.HandleMsgG(rec.Context(ctx), rec)
+			rec.Done(s.EcrSerial(), s.RawMessage())
+		} else {
+			s := slipvalidation.New(log.NewNopLogger(), b, capturer, &slipvalidation.Options{}, msg, n)
+			err = s.Handle(rec.Context(ctx), rec)
+			rec.Done("ECR0000001", frame)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := capture.ReadFile(capturer.File("ECR0000001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchanges, err := Exchanges(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(exchanges) != 3 || !bytes.Contains(exchanges[1].Response, []byte{sliprecord.ResendMessageIdentifier}) {
+		t.Fatalf("captured %d exchanges, second responded %q", len(exchanges), exchanges[1].Response)
+	}
+
+	p := NewInProcess(log.NewNopLogger(), &sliprecord.Options{}, &slipvalidation.Options{}, nil)
+	var out bytes.Buffer
+	differ, err := Report(ctx, &out, p, exchanges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if differ != 0 {
+		t.Errorf("%d differ, report:\n%s", differ, out.String())
+	}
+}
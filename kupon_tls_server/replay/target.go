@@ -0,0 +1,72 @@
+package replay
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+)
+
+// Target sends frames to a running server over TLS, one connection per
+// captured session. Only responses are compared, events are not seen.
+type Target struct {
+	addr   string
+	config *tls.Config
+	// wait for responses, as long as fewer bytes than recorded came back
+	wait time.Duration
+
+	session string
+	conn    *tls.Conn
+}
+
+func NewTarget(addr string, config *tls.Config, wait time.Duration) *Target {
+	return &Target{addr: addr, config: config, wait: wait}
+}
+
+func (t *Target) Run(ctx context.Context, ex *Exchange) (*Result, error) {
+	if t.conn == nil || t.session != ex.Session {
+		t.Close()
+		d := &tls.Dialer{Config: t.config}
+		c, err := d.DialContext(ctx, "tcp", t.addr)
+		if err != nil {
+			return nil, err
+		}
+		t.conn = c.(*tls.Conn)
+		t.session = ex.Session
+	}
+
+	_, err := t.conn.Write(ex.Frame)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	var resp []byte
+	buf := make([]byte, 4096)
+	deadline := time.Now().Add(t.wait)
+	for len(resp) < len(ex.Response) || len(ex.Response) == 0 {
+		t.conn.SetReadDeadline(deadline)
+		n, err := t.conn.Read(buf)
+		resp = append(resp, buf[:n]...)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			// the server closed the connection, the next frame opens another
+			t.Close()
+			break
+		}
+	}
+	return &Result{Response: resp}, nil
+}
+
+func (t *Target) Close() error {
+	if t.conn == nil {
+		return nil
+	}
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"io/ioutil"
+	"nexusws/cmd/kupon_tls_server/capture"
+	"nexusws/cmd/kupon_tls_server/replay"
+	"nexusws/cmd/kupon_tls_server/slipvalidation"
+	"nexusws/cmd/kupon_tls_server/zreport"
+	"os"
+	"time"
+)
+
+// replayCmd replays capture files and prints how the responses and events
+// differ from the recorded ones. It exits with 1 when a frame differs.
+//
+//	kupon_tls_server replay [-config config.yaml] [-v] file...
+//	kupon_tls_server replay -target host:port [-insecure] [-wait 2s] file...
+//
+// In process, frames go through the handlers with the parsing options of
+// the config, without a backend, registry or signature checks.
+func replayCmd(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	configFile := fs.String("config", "./config.yaml", "config file, in process")
+	verbose := fs.Bool("v", false, "log handler errors to stderr, in process")
+	target := fs.String("target", "", "server address, replay in process when empty")
+	insecure := fs.Bool("insecure", false, "do not verify the server certificate")
+	wait := fs.Duration("wait", 2*time.Second, "time to wait for the responses of a frame")
+	err := fs.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "no capture file")
+		return 2
+	}
+
+	var exchanges []*replay.Exchange
+	for _, file := range fs.Args() {
+		records, err := capture.ReadFile(file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		ex, err := replay.Exchanges(records)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			return 1
+		}
+		exchanges = append(exchanges, ex...)
+	}
+
+	var r replay.Runner
+	if *target != "" {
+		t := replay.NewTarget(*target, &tls.Config{InsecureSkipVerify: *insecure}, *wait)
+		defer t.Close()
+		r = t
+	} else {
+		cfg := &Config{}
+		err = NewFromFile(*configFile, cfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		gOpts, err := slipRecordOptions(cfg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		dir, err := ioutil.TempDir("", "replay")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer os.RemoveAll(dir)
+		zOpts := &zreport.Options{ContentParsing: cfg.ZReport.ContentParsing}
+		zOpts.Uploads, err = zreport.NewUploads(dir, time.Hour)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		l := log.NewNopLogger()
+		if *verbose {
+			l = log.NewLogfmtLogger(os.Stderr)
+		}
+		r = replay.NewInProcess(l, gOpts, &slipvalidation.Options{}, zOpts)
+	}
+
+	differ, err := replay.Report(context.Background(), os.Stdout, r, exchanges)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if differ > 0 {
+		return 1
+	}
+	return 0
+}
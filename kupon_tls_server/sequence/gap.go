@@ -0,0 +1,99 @@
+package sequence
+
+import (
+	"time"
+)
+
+// Kind of sequence a gap was found in.
+const (
+	KindDailySlipNo = "daily_slip_no" // DailySlipNo within one Z report
+	KindSlipSerial  = "slip_serial"   // SlipSerial across Z reports
+)
+
+// Gap is an open item: slips From to To, both included, that the register
+// skipped. ZReport is only set for KindDailySlipNo.
+type Gap struct {
+	Kind          string    `json:"Kind"`
+	ZReport       int       `json:"ZReport,omitempty"`
+	From          int       `json:"From"`
+	To            int       `json:"To"`
+	Opened        time.Time `json:"Opened"`
+	Requests      int       `json:"Requests"`
+	LastRequested time.Time `json:"LastRequested,omitempty"`
+}
+
+func (g *Gap) contains(kind string, zReport int, n int) bool {
+	return g.Kind == kind && g.ZReport == zReport && n >= g.From && n <= g.To
+}
+
+// state is what is kept per register between connections.
+type state struct {
+	EcrSerial       string `json:"EcrSerial"`
+	LastSlipSerial  int    `json:"LastSlipSerial"`
+	LastZReport     int    `json:"LastZReport"`
+	LastDailySlipNo int    `json:"LastDailySlipNo"`
+	Gaps            []*Gap `json:"Gaps"`
+}
+
+// fill removes n from the gap containing it, splitting the gap when n is
+// inside the range.
+func (st *state) fill(kind string, zReport int, n int) {
+	for i, g := range st.Gaps {
+		if !g.contains(kind, zReport, n) {
+			continue
+		}
+		switch {
+		case g.From == g.To:
+			st.Gaps = append(st.Gaps[:i], st.Gaps[i+1:]...)
+		case n == g.From:
+			g.From++
+		case n == g.To:
+			g.To--
+		default:
+			tail := *g
+			tail.From = n + 1
+			g.To = n - 1
+			st.Gaps = append(st.Gaps[:i+1], append([]*Gap{&tail}, st.Gaps[i+1:]...)...)
+		}
+		return
+	}
+}
+
+// observe updates the state with one received slip and returns the gaps it
+// opened.
+func (st *state) observe(zReport int, slipSerial int, dailySlipNo int, now time.Time) []*Gap {
+	opened := make([]*Gap, 0)
+
+	if st.LastSlipSerial > 0 && slipSerial > st.LastSlipSerial+1 {
+		opened = append(opened, &Gap{Kind: KindSlipSerial, From: st.LastSlipSerial + 1, To: slipSerial - 1, Opened: now})
+	}
+	if slipSerial > st.LastSlipSerial {
+		st.LastSlipSerial = slipSerial
+	} else {
+		st.fill(KindSlipSerial, 0, slipSerial)
+	}
+
+	switch {
+	case st.LastZReport == 0:
+		// first slip seen from this register, nothing to compare with
+		st.LastZReport = zReport
+		st.LastDailySlipNo = dailySlipNo
+	case zReport > st.LastZReport:
+		// every Z report starts again at DailySlipNo 1
+		if dailySlipNo > 1 {
+			opened = append(opened, &Gap{Kind: KindDailySlipNo, ZReport: zReport, From: 1, To: dailySlipNo - 1, Opened: now})
+		}
+		st.LastZReport = zReport
+		st.LastDailySlipNo = dailySlipNo
+	case zReport == st.LastZReport && dailySlipNo > st.LastDailySlipNo:
+		if dailySlipNo > st.LastDailySlipNo+1 {
+			opened = append(opened, &Gap{Kind: KindDailySlipNo, ZReport: zReport, From: st.LastDailySlipNo + 1, To: dailySlipNo - 1, Opened: now})
+		}
+		st.LastDailySlipNo = dailySlipNo
+	default:
+		st.fill(KindDailySlipNo, zReport, dailySlipNo)
+	}
+
+	st.Gaps = append(st.Gaps, opened...)
+	return opened
+}
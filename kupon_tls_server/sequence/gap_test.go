@@ -0,0 +1,53 @@
+package sequence
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStateObserve(t *testing.T) {
+	now := time.Now()
+	st := &state{}
+
+	// zReport, slipSerial, dailySlipNo
+	for _, s := range [][3]int{{7, 100, 1}, {7, 101, 2}, {7, 104, 5}, {8, 106, 2}} {
+		st.observe(s[0], s[1], s[2], now)
+	}
+	want := []Gap{
+		{Kind: KindSlipSerial, From: 102, To: 103},
+		{Kind: KindDailySlipNo, ZReport: 7, From: 3, To: 4},
+		{Kind: KindSlipSerial, From: 105, To: 105},
+		{Kind: KindDailySlipNo, ZReport: 8, From: 1, To: 1},
+	}
+	checkGaps(t, st, want)
+
+	// resent slips close their gaps
+	st.observe(7, 102, 3, now)
+	st.observe(8, 105, 1, now)
+	want = []Gap{
+		{Kind: KindSlipSerial, From: 103, To: 103},
+		{Kind: KindDailySlipNo, ZReport: 7, From: 4, To: 4},
+	}
+	checkGaps(t, st, want)
+}
+
+func TestStateFillSplits(t *testing.T) {
+	st := &state{Gaps: []*Gap{{Kind: KindSlipSerial, From: 10, To: 20}}}
+	st.fill(KindSlipSerial, 0, 15)
+	checkGaps(t, st, []Gap{
+		{Kind: KindSlipSerial, From: 10, To: 14},
+		{Kind: KindSlipSerial, From: 16, To: 20},
+	})
+}
+
+func checkGaps(t *testing.T, st *state, want []Gap) {
+	t.Helper()
+	if len(st.Gaps) != len(want) {
+		t.Fatalf("got %d gaps, want %d: %+v", len(st.Gaps), len(want), st.Gaps)
+	}
+	for i, g := range st.Gaps {
+		if g.Kind != want[i].Kind || g.ZReport != want[i].ZReport || g.From != want[i].From || g.To != want[i].To {
+			t.Errorf("gap %d: got %+v, want %+v", i, *g, want[i])
+		}
+	}
+}
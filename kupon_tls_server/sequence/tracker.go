@@ -0,0 +1,158 @@
+package sequence
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"nexusws/cmd/kupon_tls_server/sliplines"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ecrSerialUnsafeChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// Tracker follows SlipSerial and DailySlipNo of every register and keeps the
+// gaps it finds as open items in <dir>/<EcrSerial>.json until the missing
+// slips arrive.
+type Tracker struct {
+	l   log.Logger
+	dir string
+	// resendInterval is the least time between two resend requests for the
+	// same gap
+	resendInterval time.Duration
+
+	mu     sync.Mutex
+	states map[string]*state
+}
+
+func NewTracker(l log.Logger, dir string, resendInterval time.Duration) (*Tracker, error) {
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+	return &Tracker{
+		l:              l,
+		dir:            dir,
+		resendInterval: resendInterval,
+		states:         make(map[string]*state),
+	}, nil
+}
+
+// Observe records the slips of an accepted G message.
+func (t *Tracker) Observe(ecrSerial string, records []sliplines.Record) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st, err := t.state(ecrSerial)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for i := range records {
+		zReport, err := atoi(records[i].ZReport)
+		if err != nil {
+			return fmt.Errorf("record %d ZReport: %w", i, err)
+		}
+		slipSerial, err := atoi(records[i].SlipSerial)
+		if err != nil {
+			return fmt.Errorf("record %d SlipSerial: %w", i, err)
+		}
+		dailySlipNo, err := atoi(records[i].DailySlipNo)
+		if err != nil {
+			return fmt.Errorf("record %d DailySlipNo: %w", i, err)
+		}
+		for _, g := range st.observe(zReport, slipSerial, dailySlipNo, now) {
+			level.Warn(t.l).Log("msg", "slip sequence gap", "ecrSerial", ecrSerial, "kind", g.Kind, "zReport", g.ZReport, "from", g.From, "to", g.To)
+		}
+	}
+	return t.save(st)
+}
+
+// NextRequest returns the oldest open gap of the register that was not
+// requested within the resend interval and marks it as requested, or nil.
+func (t *Tracker) NextRequest(ecrSerial string) (*Gap, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st, err := t.state(ecrSerial)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	for _, g := range st.Gaps {
+		if g.Requests > 0 && now.Sub(g.LastRequested) < t.resendInterval {
+			continue
+		}
+		g.Requests++
+		g.LastRequested = now
+		req := *g
+		return &req, t.save(st)
+	}
+	return nil, nil
+}
+
+// OpenGaps returns the open items of the register.
+func (t *Tracker) OpenGaps(ecrSerial string) ([]Gap, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st, err := t.state(ecrSerial)
+	if err != nil {
+		return nil, err
+	}
+	gaps := make([]Gap, len(st.Gaps))
+	for i, g := range st.Gaps {
+		gaps[i] = *g
+	}
+	return gaps, nil
+}
+
+func (t *Tracker) fileName(ecrSerial string) string {
+	return filepath.Join(t.dir, ecrSerialUnsafeChars.ReplaceAllString(ecrSerial, "_")+".json")
+}
+
+func (t *Tracker) state(ecrSerial string) (*state, error) {
+	st, ok := t.states[ecrSerial]
+	if ok {
+		return st, nil
+	}
+
+	st = &state{EcrSerial: ecrSerial, Gaps: make([]*Gap, 0)}
+	b, err := os.ReadFile(t.fileName(ecrSerial))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(b, st)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", t.fileName(ecrSerial), err)
+		}
+	}
+	t.states[ecrSerial] = st
+	return st, nil
+}
+
+func (t *Tracker) save(st *state) error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := t.fileName(st.EcrSerial)
+	err = os.WriteFile(name+".tmp", b, 0640)
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+func atoi(s string) (int, error) {
+	return strconv.Atoi(strings.TrimSpace(s))
+}
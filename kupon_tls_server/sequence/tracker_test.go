@@ -0,0 +1,106 @@
+package sequence
+
+import (
+	"github.com/go-kit/kit/log"
+	"nexusws/cmd/kupon_tls_server/sliplines"
+	"os"
+	"testing"
+	"time"
+)
+
+func records(slips ...[3]string) []sliplines.Record {
+	recs := make([]sliplines.Record, len(slips))
+	for i, s := range slips {
+		recs[i].Mac = "MAC1"
+		recs[i].ZReport, recs[i].SlipSerial, recs[i].DailySlipNo = s[0], s[1], s[2]
+	}
+	return recs
+}
+
+func TestTrackerReload(t *testing.T) {
+	dir := t.TempDir()
+	tr, err := NewTracker(log.NewNopLogger(), dir, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tr.Observe("ECR/1", records([3]string{"7", "100", "1"}, [3]string{"7", " 103", "4"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(tr.fileName("ECR/1")); err != nil {
+		t.Fatalf("state not saved: %v", err)
+	}
+
+	// a restarted server knows the gaps and the last numbers
+	tr, err = NewTracker(log.NewNopLogger(), dir, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gaps, err := tr.OpenGaps("ECR/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gaps) != 2 || gaps[0].From != 101 || gaps[0].To != 102 || gaps[1].ZReport != 7 {
+		t.Fatalf("gaps after reload %+v", gaps)
+	}
+	err = tr.Observe("ECR/1", records([3]string{"7", "104", "5"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gaps, _ = tr.OpenGaps("ECR/1"); len(gaps) != 2 {
+		t.Errorf("gaps after the next slip %+v", gaps)
+	}
+
+	if err = tr.Observe("ECR1", records([3]string{"7", "x", "1"})); err == nil {
+		t.Errorf("no error for a SlipSerial that is not a number")
+	}
+
+	if err = os.WriteFile(tr.fileName("ECR2"), []byte("{"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tr.OpenGaps("ECR2"); err == nil {
+		t.Errorf("no error for a corrupted state file")
+	}
+}
+
+func TestTrackerNextRequest(t *testing.T) {
+	tr, err := NewTracker(log.NewNopLogger(), t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, err := tr.NextRequest("ECR1"); g != nil || err != nil {
+		t.Fatalf("request %+v, err %v without gaps", g, err)
+	}
+	err = tr.Observe("ECR1", records([3]string{"7", "100", "1"}, [3]string{"7", "102", "2"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := tr.NextRequest("ECR1")
+	if err != nil || g == nil || g.Kind != KindSlipSerial || g.From != 101 || g.Requests != 1 {
+		t.Fatalf("first request %+v, err %v", g, err)
+	}
+	// within the interval the gap is not requested again
+	if g, err = tr.NextRequest("ECR1"); g != nil || err != nil {
+		t.Fatalf("second request %+v, err %v", g, err)
+	}
+
+	// the request count survives a restart, the interval is over
+	tr, err = NewTracker(log.NewNopLogger(), tr.dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err = tr.NextRequest("ECR1")
+	if err != nil || g == nil || g.Requests != 2 || g.LastRequested.IsZero() {
+		t.Fatalf("request after the interval %+v, err %v", g, err)
+	}
+
+	// the resent slip closes the gap
+	err = tr.Observe("ECR1", records([3]string{"7", "101", "3"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, err = tr.NextRequest("ECR1"); g != nil || err != nil {
+		t.Errorf("request %+v, err %v after the gap closed", g, err)
+	}
+}
@@ -0,0 +1,169 @@
+package session
+
+import (
+	"errors"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+var sessionsActive = kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+	Namespace: "kupon",
+	Subsystem: "sessions",
+	Name:      "active",
+	Help:      "Open register connections.",
+}, []string{})
+
+// Session lifecycle event types.
+const (
+	EventOpened         = "opened"
+	EventTLS            = "tls"        // handshake completed
+	EventIdentified     = "identified" // first EcrSerial of the session
+	EventMessageStarted = "message_started"
+	EventMessageDone    = "message_done"
+	EventClosed         = "closed"
+	EventKilled         = "killed" // closed through the admin API
+)
+
+var ErrUnknownSession = errors.New("unknown session")
+
+type Event struct {
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	SessionID string    `json:"session_id"`
+	EcrSerial string    `json:"ecr_serial,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Session   Info      `json:"session"`
+}
+
+// subscriberBuffer events are kept for a slow subscriber, later ones are
+// dropped for it.
+const subscriberBuffer = 256
+
+type subscriber struct {
+	ecrSerial string
+	events    chan Event
+}
+
+// Manager holds the open sessions.
+type Manager struct {
+	mu          sync.Mutex
+	sessions    map[string]*Session
+	subscribers map[*subscriber]struct{}
+}
+
+func NewManager() *Manager {
+	return &Manager{
+		sessions:    make(map[string]*Session),
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+// Open registers the connection conn, id is its trace ID.
+func (m *Manager) Open(id string, conn net.Conn) *Session {
+	s := &Session{
+		ID:         id,
+		RemoteAddr: conn.RemoteAddr().String(),
+		Started:    time.Now(),
+		conn:       conn,
+		m:          m,
+	}
+	m.mu.Lock()
+	m.sessions[id] = s
+	n := len(m.sessions)
+	m.mu.Unlock()
+	sessionsActive.Set(float64(n))
+	m.publish(s, EventOpened, "", nil)
+	return s
+}
+
+func (m *Manager) end(s *Session) {
+	m.mu.Lock()
+	delete(m.sessions, s.ID)
+	n := len(m.sessions)
+	m.mu.Unlock()
+	sessionsActive.Set(float64(n))
+	m.publish(s, EventClosed, "", nil)
+}
+
+// Kill closes the connection of session id. The handler of the connection
+// ends with a read or write error and ends the session.
+func (m *Manager) Kill(id string) error {
+	m.mu.Lock()
+	s, ok := m.sessions[id]
+	m.mu.Unlock()
+	if !ok {
+		return ErrUnknownSession
+	}
+	m.publish(s, EventKilled, "", nil)
+	return s.conn.Close()
+}
+
+// List returns the open sessions, oldest first.
+func (m *Manager) List() []Info {
+	now := time.Now()
+	m.mu.Lock()
+	sessions := make([]*Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	m.mu.Unlock()
+
+	infos := make([]Info, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, s.Info(now))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Started.Before(infos[j].Started) })
+	return infos
+}
+
+// Subscribe returns the events of the sessions of ecrSerial, of every
+// session when it is empty. Events of a session are only matched once it
+// is identified. cancel ends the subscription and closes the channel.
+func (m *Manager) Subscribe(ecrSerial string) (events <-chan Event, cancel func()) {
+	sub := &subscriber{ecrSerial: ecrSerial, events: make(chan Event, subscriberBuffer)}
+	m.mu.Lock()
+	m.subscribers[sub] = struct{}{}
+	m.mu.Unlock()
+
+	var once sync.Once
+	return sub.events, func() {
+		once.Do(func() {
+			m.mu.Lock()
+			delete(m.subscribers, sub)
+			close(sub.events)
+			m.mu.Unlock()
+		})
+	}
+}
+
+func (m *Manager) publish(s *Session, eventType string, message string, err error) {
+	info := s.Info(time.Now())
+	e := Event{
+		Time:      time.Now().UTC(),
+		Type:      eventType,
+		SessionID: s.ID,
+		EcrSerial: info.EcrSerial,
+		Message:   message,
+		Session:   info,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for sub := range m.subscribers {
+		if sub.ecrSerial != "" && sub.ecrSerial != e.EcrSerial {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package session
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestManager(t *testing.T) {
+	m := NewManager()
+	events, cancel := m.Subscribe("ECR0000001")
+	defer cancel()
+
+	server, client := net.Pipe()
+	defer client.Close()
+	s := m.Open("trace-1", server)
+
+	go client.Write([]byte("E13"))
+	conn := s.Conn()
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if err != nil || n != 3 {
+		t.Fatalf("read %d, %v", n, err)
+	}
+	s.MessageStarted("E")
+	if info := m.List(); len(info) != 1 || info[0].BytesIn != 3 || info[0].CurrentMessage != "E" || info[0].EcrSerial != "" {
+		t.Fatalf("list %+v", info)
+	}
+	s.MessageDone("ECR0000001", errors.New("nack"))
+
+	// opened and message_started were sent before the session was identified
+	for _, want := range []string{EventIdentified, EventMessageDone} {
+		e := <-events
+		if e.Type != want || e.EcrSerial != "ECR0000001" {
+			t.Fatalf("event %+v, want %s", e, want)
+		}
+	}
+
+	if err := m.Kill("trace-2"); err != ErrUnknownSession {
+		t.Errorf("kill unknown: %v", err)
+	}
+	if err := m.Kill("trace-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(buf); err == nil {
+		t.Error("read after kill")
+	}
+	s.End()
+	if info := m.List(); len(info) != 0 {
+		t.Errorf("list after end %+v", info)
+	}
+	for _, want := range []string{EventKilled, EventClosed} {
+		if e := <-events; e.Type != want {
+			t.Errorf("event %+v, want %s", e, want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Package session keeps the open register connections for the admin API:
+// what each one is doing, how much it transferred, and a stream of their
+// lifecycle events.
+package session
+
+import (
+	"crypto/tls"
+	"net"
+	"nexusws/cmd/kupon_tls_server/inventory"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session is one register connection.
+type Session struct {
+	ID         string
+	RemoteAddr string
+	Started    time.Time
+
+	conn     net.Conn
+	bytesIn  int64
+	bytesOut int64
+
+	mu          sync.Mutex
+	ecrSerial   string
+	tlsVersion  string
+	cipherSuite string
+	serverName  string
+	message     string
+	m           *Manager
+}
+
+// Info is a snapshot of a session.
+type Info struct {
+	ID             string    `json:"id"` // trace ID of the connection
+	RemoteAddr     string    `json:"remote_addr"`
+	EcrSerial      string    `json:"ecr_serial,omitempty"`
+	TLSVersion     string    `json:"tls_version,omitempty"`
+	CipherSuite    string    `json:"cipher_suite,omitempty"`
+	ServerName     string    `json:"server_name,omitempty"`
+	BytesIn        int64     `json:"bytes_in"`
+	BytesOut       int64     `json:"bytes_out"`
+	CurrentMessage string    `json:"current_message,omitempty"`
+	Started        time.Time `json:"started"`
+	Age            string    `json:"age"`
+}
+
+// Conn returns the connection of the session, counting the bytes read and
+// written.
+func (s *Session) Conn() net.Conn {
+	return &countingConn{Conn: s.conn, s: s}
+}
+
+// NetConn returns the connection of the session as accepted.
+func (s *Session) NetConn() net.Conn {
+	return s.conn
+}
+
+// End removes the session from its manager, once its connection is closed.
+func (s *Session) End() {
+	s.m.end(s)
+}
+
+// SetTLS records the parameters of a completed handshake.
+func (s *Session) SetTLS(st tls.ConnectionState) {
+	s.mu.Lock()
+	s.tlsVersion = inventory.TLSVersionName(st.Version)
+	s.cipherSuite = tls.CipherSuiteName(st.CipherSuite)
+	s.serverName = st.ServerName
+	s.mu.Unlock()
+	s.m.publish(s, EventTLS, "", nil)
+}
+
+// TLSVersion is empty until SetTLS.
+func (s *Session) TLSVersion() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tlsVersion
+}
+
+// MessageStarted marks the frame type being handled, 'G', 'E' or 'W'.
+func (s *Session) MessageStarted(message string) {
+	s.mu.Lock()
+	s.message = message
+	s.mu.Unlock()
+	s.m.publish(s, EventMessageStarted, message, nil)
+}
+
+// MessageDone ends the current frame. ecrSerial is set once the handler
+// parsed it, err is the error of the handler.
+func (s *Session) MessageDone(ecrSerial string, err error) {
+	s.mu.Lock()
+	message := s.message
+	s.message = ""
+	identified := ecrSerial != "" && s.ecrSerial == ""
+	if ecrSerial != "" {
+		s.ecrSerial = ecrSerial
+	}
+	s.mu.Unlock()
+	if identified {
+		s.m.publish(s, EventIdentified, "", nil)
+	}
+	s.m.publish(s, EventMessageDone, message, err)
+}
+
+func (s *Session) Info(now time.Time) Info {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Info{
+		ID:             s.ID,
+		RemoteAddr:     s.RemoteAddr,
+		EcrSerial:      s.ecrSerial,
+		TLSVersion:     s.tlsVersion,
+		CipherSuite:    s.cipherSuite,
+		ServerName:     s.serverName,
+		BytesIn:        atomic.LoadInt64(&s.bytesIn),
+		BytesOut:       atomic.LoadInt64(&s.bytesOut),
+		CurrentMessage: s.message,
+		Started:        s.Started,
+		Age:            now.Sub(s.Started).Truncate(time.Second).String(),
+	}
+}
+
+type countingConn struct {
+	net.Conn
+	s *Session
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.s.bytesIn, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.s.bytesOut, int64(n))
+	return n, err
+}
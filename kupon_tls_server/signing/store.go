@@ -0,0 +1,168 @@
+// Package signing verifies the HMAC-SHA256 trailer registers append to
+// signed G, E and W frames.
+//
+// A signed frame starts with the lower case message identifier ('g', 'e' or
+// 'w') and is followed by a trailer after its checksum:
+//
+//	key ID  2 bytes, little endian
+//	HMAC   32 bytes, HMAC-SHA256 of the frame and the key ID
+//
+// Keys are shared per EcrSerial and read from a key store file.
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"nexusws/cmd/kupon_tls_server/kupon_errors"
+	"nexusws/cmd/kupon_tls_server/reloadfile"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	KeyIDLength   = 2
+	TrailerLength = KeyIDLength + sha256.Size
+)
+
+var (
+	ErrSignatureRequired = errors.New("frame is not signed")
+	ErrUnknownKey        = errors.New("unknown signing key")
+	ErrKeyNotValid       = errors.New("signing key not valid at this time")
+	ErrBadSignature      = errors.New("signature does not match")
+)
+
+// Key is a shared secret. Keys of a device may overlap in validity, which
+// lets a register switch to a new key at any point of the overlap.
+type Key struct {
+	ID        uint16    `yaml:"id"`
+	Secret    string    `yaml:"secret"` // hex
+	NotBefore time.Time `yaml:"not_before"`
+	NotAfter  time.Time `yaml:"not_after"` // zero for no end
+
+	secret []byte
+}
+
+func (k *Key) validAt(t time.Time) bool {
+	if t.Before(k.NotBefore) {
+		return false
+	}
+	return k.NotAfter.IsZero() || t.Before(k.NotAfter)
+}
+
+// Device holds the keys of one register. With MustSign unsigned frames are
+// rejected, otherwise they are accepted and signed ones verified.
+type Device struct {
+	MustSign bool  `yaml:"must_sign"`
+	Keys     []Key `yaml:"keys"`
+}
+
+type file struct {
+	Devices map[string]*Device `yaml:"devices"`
+}
+
+// Store is the key store file, read again by Reload when it changed.
+type Store struct {
+	file *reloadfile.File
+
+	mu      sync.RWMutex
+	devices map[string]*Device
+}
+
+func Load(path string) (*Store, error) {
+	s := &Store{file: reloadfile.New(path)}
+	err := s.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the file again when its modification time changed. On error
+// the keys read before are kept.
+func (s *Store) Reload() error {
+	return s.file.Load(s.apply)
+}
+
+func (s *Store) apply(b []byte) error {
+	var f file
+	err := yaml.Unmarshal(b, &f)
+	if err != nil {
+		return fmt.Errorf("key store %s: %w", s.file.Path(), err)
+	}
+	devices := make(map[string]*Device, len(f.Devices))
+	for ecr, d := range f.Devices {
+		for i := range d.Keys {
+			k := &d.Keys[i]
+			k.secret, err = hex.DecodeString(k.Secret)
+			if err != nil || len(k.secret) == 0 {
+				return fmt.Errorf("key store %s: device %s key %d: secret is not hex", s.file.Path(), ecr, k.ID)
+			}
+		}
+		devices[strings.TrimSpace(ecr)] = d
+	}
+
+	s.mu.Lock()
+	s.devices = devices
+	s.mu.Unlock()
+	return nil
+}
+
+// Check verifies a frame of ecrSerial received at t. frame is the whole
+// frame, with the trailer when signed. Without a store frames are accepted
+// as they are.
+func (s *Store) Check(ecrSerial string, frame []byte, signed bool, t time.Time) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	d := s.devices[strings.TrimSpace(ecrSerial)]
+	s.mu.RUnlock()
+
+	if !signed {
+		if d != nil && d.MustSign {
+			return ErrSignatureRequired
+		}
+		return nil
+	}
+	if d == nil || len(frame) < TrailerLength {
+		return ErrUnknownKey
+	}
+
+	trailer := frame[len(frame)-TrailerLength:]
+	id := binary.LittleEndian.Uint16(trailer[:KeyIDLength])
+	for i := range d.Keys {
+		k := &d.Keys[i]
+		if k.ID != id {
+			continue
+		}
+		if !k.validAt(t) {
+			return ErrKeyNotValid
+		}
+		if !hmac.Equal(Sum(k.secret, frame[:len(frame)-sha256.Size]), trailer[KeyIDLength:]) {
+			return ErrBadSignature
+		}
+		return nil
+	}
+	return ErrUnknownKey
+}
+
+// Sum is the HMAC of b, the frame followed by the key ID.
+func Sum(secret []byte, b []byte) []byte {
+	m := hmac.New(sha256.New, secret)
+	m.Write(b)
+	return m.Sum(nil)
+}
+
+// NackCode returns the NACK code for an error of Check.
+func NackCode(err error) int {
+	if errors.Is(err, ErrSignatureRequired) {
+		return kupon_errors.ErrSignatureRequired
+	}
+	return kupon_errors.ErrSignatureInvalid
+}
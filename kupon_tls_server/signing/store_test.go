@@ -0,0 +1,131 @@
+package signing
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const keyStore = `
+devices:
+  ECR0000001:
+    must_sign: true
+    keys:
+      - id: 1
+        secret: "0102030405060708"
+        not_before: 2026-01-01T00:00:00Z
+        not_after: 2026-03-01T00:00:00Z
+      - id: 2
+        secret: "a1a2a3a4a5a6a7a8"
+        not_before: 2026-02-01T00:00:00Z
+  ECR0000002:
+    keys:
+      - id: 1
+        secret: "0102030405060708"
+        not_before: 2026-01-01T00:00:00Z
+`
+
+func sign(frame []byte, id uint16, secret []byte) []byte {
+	b := make([]byte, len(frame)+KeyIDLength)
+	copy(b, frame)
+	binary.LittleEndian.PutUint16(b[len(frame):], id)
+	return append(b, Sum(secret, b)...)
+}
+
+func TestCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	err := ioutil.WriteFile(path, []byte(keyStore), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := []byte("e13ECR0000001...4F")
+	key1 := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	key2 := []byte{0xa1, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7, 0xa8}
+	jan := time.Date(2026, 1, 15, 0, 0, 0, 0, time.UTC)
+	feb := time.Date(2026, 2, 15, 0, 0, 0, 0, time.UTC)
+	apr := time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)
+
+	tampered := sign(frame, 1, key1)
+	tampered[5] = 'X'
+
+	tests := []struct {
+		name   string
+		ecr    string
+		frame  []byte
+		signed bool
+		at     time.Time
+		want   error
+	}{
+		{"unsigned, must sign", "ECR0000001", frame, false, jan, ErrSignatureRequired},
+		{"unsigned, may sign", "ECR0000002", frame, false, jan, nil},
+		{"unsigned, unknown device", "ECR0000003", frame, false, jan, nil},
+		{"signed, unknown device", "ECR0000003", sign(frame, 1, key1), true, jan, ErrUnknownKey},
+		{"old key", "ECR0000001", sign(frame, 1, key1), true, jan, nil},
+		{"new key before its time", "ECR0000001", sign(frame, 2, key2), true, jan, ErrKeyNotValid},
+		{"old key in the overlap", "ECR0000001", sign(frame, 1, key1), true, feb, nil},
+		{"new key in the overlap", "ECR0000001", sign(frame, 2, key2), true, feb, nil},
+		{"old key expired", "ECR0000001", sign(frame, 1, key1), true, apr, ErrKeyNotValid},
+		{"unknown key ID", "ECR0000001", sign(frame, 3, key2), true, feb, ErrUnknownKey},
+		{"wrong secret", "ECR0000001", sign(frame, 2, key1), true, feb, ErrBadSignature},
+		{"tampered frame", "ECR0000001", tampered, true, jan, ErrBadSignature},
+	}
+	for _, tt := range tests {
+		err := s.Check(tt.ecr, tt.frame, tt.signed, tt.at)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	var none *Store
+	if err := none.Check("ECR0000001", frame, false, jan); err != nil {
+		t.Errorf("nil store: %v", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	err := ioutil.WriteFile(path, []byte(keyStore), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a broken file keeps the keys read before
+	err = ioutil.WriteFile(path, []byte("devices:\n  ECR0000001:\n    keys:\n      - id: 1\n        secret: zz\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	if err = s.Reload(); err == nil {
+		t.Fatal("reload of a secret that is not hex")
+	}
+	if err = s.Check("ECR0000001", []byte("e13"), false, time.Now()); err != ErrSignatureRequired {
+		t.Errorf("keys lost on a failed reload: %v", err)
+	}
+
+	err = ioutil.WriteFile(path, []byte("devices: {}\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	os.Chtimes(path, later, later)
+	if err = s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Check("ECR0000001", []byte("e13"), false, time.Now()); err != nil {
+		t.Errorf("device still must sign after reload: %v", err)
+	}
+}
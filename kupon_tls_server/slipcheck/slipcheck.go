@@ -0,0 +1,361 @@
+// Package slipcheck validates the figures of a slip record: item lines
+// against the slip total, VAT per rate against the declared VAT lines,
+// payments against the total and VAT rates against the allowed set.
+//
+// Which line and field holds which figure is configured, see Config. The v13
+// names of these fields are not known to this server, so a Validator that is
+// not off needs at least one check configured. Checks whose lines are not
+// configured, or not present on a record, are skipped.
+package slipcheck
+
+import (
+	"fmt"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"nexusws/cmd/kupon_tls_server/kupon_errors"
+	"nexusws/cmd/kupon_tls_server/slipfields"
+	"sort"
+)
+
+// Modes
+const (
+	ModeOff    = "off"
+	ModeWarn   = "warn"   // log failures and accept the message
+	ModeReject = "reject" // NACK with the code of the first failure
+)
+
+// Checks
+const (
+	CheckTotal   = "total"
+	CheckVat     = "vat"
+	CheckPayment = "payment"
+	CheckVatRate = "vat_rate"
+)
+
+// DefaultAllowedVatRates are the VAT rates accepted when Config has none.
+var DefaultAllowedVatRates = []string{"0", "6", "10", "20"}
+
+// Field names a field of a line type, LineD.Total for example.
+type Field struct {
+	Line  string `yaml:"line"`
+	Field string `yaml:"field"`
+}
+
+type Config struct {
+	Mode string `yaml:"mode"`
+	// ItemLine holds one item per line, with its gross amount and VAT rate.
+	ItemLine   string `yaml:"item_line"`
+	ItemAmount string `yaml:"item_amount"`
+	ItemRate   string `yaml:"item_rate"`
+	Total      Field  `yaml:"total"`
+	// VatLine holds the VAT declared per rate.
+	VatLine   string `yaml:"vat_line"`
+	VatRate   string `yaml:"vat_rate"`
+	VatAmount string `yaml:"vat_amount"`
+	Payment   Field  `yaml:"payment"`
+	// AllowedVatRates in percent, "20" or "6.5". DefaultAllowedVatRates
+	// when empty.
+	AllowedVatRates []string `yaml:"allowed_vat_rates"`
+	// Tolerance is the largest difference accepted for sums, in the
+	// smallest currency unit.
+	Tolerance int64 `yaml:"tolerance"`
+}
+
+// Failure is a check a record did not pass.
+type Failure struct {
+	Check       string
+	Code        int
+	SlipSerial  int
+	DailySlipNo int
+	Detail      string
+}
+
+func (f *Failure) Error() string {
+	return fmt.Sprintf("slip %d (daily %d) %s check: %s", f.SlipSerial, f.DailySlipNo, f.Check, f.Detail)
+}
+
+var failuresTotal = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+	Namespace: "kupon",
+	Subsystem: "slip_validation",
+	Name:      "failures_total",
+	Help:      "Slip records failing a validation check, by check and mode.",
+}, []string{"check", "mode"})
+
+var codes = map[string]int{
+	CheckTotal:   kupon_errors.ErrSlipTotalMismatch,
+	CheckVat:     kupon_errors.ErrVatMismatch,
+	CheckPayment: kupon_errors.ErrPaymentNotCovered,
+	CheckVatRate: kupon_errors.ErrVatRateNotAllowed,
+}
+
+type Validator struct {
+	cfg     Config
+	allowed map[int64]bool
+}
+
+func New(cfg Config) (*Validator, error) {
+	switch cfg.Mode {
+	case ModeOff, ModeWarn, ModeReject:
+	default:
+		return nil, fmt.Errorf("unknown validation mode %q", cfg.Mode)
+	}
+	if cfg.Mode != ModeOff && len(cfg.configured()) == 0 {
+		return nil, fmt.Errorf("validation mode %s needs the lines and fields of a %s, %s or %s check", cfg.Mode, CheckTotal, CheckVat, CheckPayment)
+	}
+
+	v := &Validator{cfg: cfg}
+	rates := cfg.AllowedVatRates
+	if len(rates) == 0 {
+		rates = DefaultAllowedVatRates
+	}
+	v.allowed = make(map[int64]bool, len(rates))
+	for _, r := range rates {
+		d, err := slipfields.ParseDecimal(r, 2)
+		if err != nil {
+			return nil, fmt.Errorf("allowed vat rate %q: %w", r, err)
+		}
+		v.allowed[d.Units] = true
+	}
+	return v, nil
+}
+
+// configured returns the checks whose lines and fields are all set.
+func (c *Config) configured() []string {
+	needs := map[string][]string{
+		CheckTotal:   {c.ItemLine, c.ItemAmount, c.Total.Line, c.Total.Field},
+		CheckVat:     {c.ItemLine, c.ItemAmount, c.ItemRate, c.VatLine, c.VatRate, c.VatAmount},
+		CheckPayment: {c.Total.Line, c.Total.Field, c.Payment.Line, c.Payment.Field},
+	}
+	checks := make([]string, 0, len(needs))
+	for check, settings := range needs {
+		complete := true
+		for _, s := range settings {
+			if s == "" {
+				complete = false
+			}
+		}
+		if complete {
+			checks = append(checks, check)
+		}
+	}
+	sort.Strings(checks)
+	return checks
+}
+
+func (v *Validator) Mode() string {
+	return v.cfg.Mode
+}
+
+// Checks returns the checks that run, none when the mode is off. CheckVatRate
+// runs with any check that reads a VAT rate.
+func (v *Validator) Checks() []string {
+	if v.cfg.Mode == ModeOff {
+		return nil
+	}
+	checks := v.cfg.configured()
+	if v.cfg.ItemRate != "" || v.cfg.VatRate != "" {
+		checks = append(checks, CheckVatRate)
+	}
+	return checks
+}
+
+// Check returns the failures of every record of m.
+func (v *Validator) Check(m *slipfields.Message) []*Failure {
+	if v.cfg.Mode == ModeOff {
+		return nil
+	}
+	failures := make([]*Failure, 0)
+	for i := range m.Records {
+		failures = append(failures, v.checkRecord(&m.Records[i])...)
+	}
+	for _, f := range failures {
+		failuresTotal.With("check", f.Check, "mode", v.cfg.Mode).Add(1)
+	}
+	return failures
+}
+
+func (v *Validator) checkRecord(r *slipfields.Record) []*Failure {
+	failures := make([]*Failure, 0)
+	fail := func(check string, format string, args ...interface{}) {
+		failures = append(failures, &Failure{
+			Check:       check,
+			Code:        codes[check],
+			SlipSerial:  r.SlipSerial,
+			DailySlipNo: r.DailySlipNo,
+			Detail:      fmt.Sprintf(format, args...),
+		})
+	}
+
+	// gross amount per VAT rate
+	itemsByRate := map[int64]int64{}
+	var itemsTotal int64
+	items := lines(r, v.cfg.ItemLine)
+	for i, item := range items {
+		amount, err := decimal(item, v.cfg.ItemAmount, 2)
+		if err != nil {
+			fail(CheckTotal, "item %d: %v", i, err)
+			continue
+		}
+		itemsTotal += amount.Units
+		if v.cfg.ItemRate == "" {
+			continue
+		}
+		rate, err := decimal(item, v.cfg.ItemRate, 2)
+		if err != nil {
+			fail(CheckVat, "item %d: %v", i, err)
+			continue
+		}
+		if v.allowed != nil && !v.allowed[rate.Units] {
+			fail(CheckVatRate, "item %d: rate %s%% is not allowed", i, rate)
+		}
+		itemsByRate[rate.Units] += amount.Units
+	}
+
+	total, hasTotal, err := v.single(r, v.cfg.Total)
+	if err != nil {
+		fail(CheckTotal, "%v", err)
+	}
+	if hasTotal && len(items) > 0 && abs(itemsTotal-total.Units) > v.cfg.Tolerance {
+		fail(CheckTotal, "items add up to %s, total is %s", slipfields.Decimal{Units: itemsTotal, Scale: 2}, total)
+	}
+
+	vatLines := lines(r, v.cfg.VatLine)
+	if len(vatLines) > 0 {
+		declared := map[int64]int64{}
+		for i, l := range vatLines {
+			rate, err := decimal(l, v.cfg.VatRate, 2)
+			if err != nil {
+				fail(CheckVat, "vat line %d: %v", i, err)
+				continue
+			}
+			amount, err := decimal(l, v.cfg.VatAmount, 2)
+			if err != nil {
+				fail(CheckVat, "vat line %d: %v", i, err)
+				continue
+			}
+			if v.allowed != nil && !v.allowed[rate.Units] {
+				fail(CheckVatRate, "vat line %d: rate %s%% is not allowed", i, rate)
+			}
+			declared[rate.Units] += amount.Units
+		}
+		if v.cfg.ItemRate != "" && len(items) > 0 {
+			for _, rate := range rates(itemsByRate, declared) {
+				want := vatOf(itemsByRate[rate], rate)
+				if abs(want-declared[rate]) > v.cfg.Tolerance {
+					fail(CheckVat, "rate %s%%: items give VAT %s, declared %s",
+						slipfields.Decimal{Units: rate, Scale: 2},
+						slipfields.Decimal{Units: want, Scale: 2},
+						slipfields.Decimal{Units: declared[rate], Scale: 2})
+				}
+			}
+		}
+	}
+
+	payments := lines(r, v.cfg.Payment.Line)
+	if hasTotal && len(payments) > 0 {
+		var paid int64
+		for i, p := range payments {
+			amount, err := decimal(p, v.cfg.Payment.Field, 2)
+			if err != nil {
+				fail(CheckPayment, "payment %d: %v", i, err)
+				continue
+			}
+			paid += amount.Units
+		}
+		if paid+v.cfg.Tolerance < total.Units {
+			fail(CheckPayment, "payments of %s do not cover the total of %s", slipfields.Decimal{Units: paid, Scale: 2}, total)
+		}
+	}
+
+	return failures
+}
+
+// Total returns the configured slip total of r in hundredths, false when the
+// total field is not configured, absent or not a decimal.
+func (v *Validator) Total(r *slipfields.Record) (int64, bool) {
+	d, ok, err := v.single(r, v.cfg.Total)
+	if err != nil || !ok {
+		return 0, false
+	}
+	return d.Units, true
+}
+
+// single returns the value of a field of a line that appears once.
+func (v *Validator) single(r *slipfields.Record, f Field) (slipfields.Decimal, bool, error) {
+	l := lines(r, f.Line)
+	if len(l) == 0 {
+		return slipfields.Decimal{}, false, nil
+	}
+	d, err := decimal(l[0], f.Field, 2)
+	if err != nil {
+		return slipfields.Decimal{}, false, err
+	}
+	return d, true, nil
+}
+
+// lines returns the lines of a type on r, one for single lines, none when the
+// type is not configured or absent.
+func lines(r *slipfields.Record, line string) []map[string]interface{} {
+	if line == "" {
+		return nil
+	}
+	switch l := r.Lines[line].(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{l}
+	case []map[string]interface{}:
+		return l
+	}
+	return nil
+}
+
+// decimal returns a field as a Decimal, parsing it when the schema left it a
+// string.
+func decimal(line map[string]interface{}, field string, scale int) (slipfields.Decimal, error) {
+	switch v := line[field].(type) {
+	case slipfields.Decimal:
+		return v, nil
+	case string:
+		d, err := slipfields.ParseDecimal(v, scale)
+		if err != nil {
+			return d, &slipfields.FieldError{Field: field, Value: v, Kind: slipfields.KindAmount, Err: err}
+		}
+		return d, nil
+	case nil:
+		return slipfields.Decimal{}, fmt.Errorf("field %s is missing", field)
+	default:
+		return slipfields.Decimal{}, fmt.Errorf("field %s is a %T", field, v)
+	}
+}
+
+// vatOf returns the VAT included in gross at rate, both in hundredths,
+// rounded half up.
+func vatOf(gross int64, rate int64) int64 {
+	n := gross * rate
+	d := 10000 + rate
+	if n < 0 {
+		return -((-n + d/2) / d)
+	}
+	return (n + d/2) / d
+}
+
+func rates(a map[int64]int64, b map[int64]int64) []int64 {
+	seen := map[int64]bool{}
+	all := make([]int64, 0, len(a)+len(b))
+	for _, m := range []map[int64]int64{a, b} {
+		for r := range m {
+			if !seen[r] {
+				seen[r] = true
+				all = append(all, r)
+			}
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	return all
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
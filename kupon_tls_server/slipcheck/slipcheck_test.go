@@ -0,0 +1,135 @@
+package slipcheck
+
+import (
+	"nexusws/cmd/kupon_tls_server/kupon_errors"
+	"nexusws/cmd/kupon_tls_server/slipfields"
+	"strings"
+	"testing"
+)
+
+func amount(s string) slipfields.Decimal {
+	d, err := slipfields.ParseDecimal(s, 2)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func item(gross string, rate string) map[string]interface{} {
+	return map[string]interface{}{"Gross": amount(gross), "Rate": rate}
+}
+
+func TestCheck(t *testing.T) {
+	cfg := Config{
+		Mode:            ModeReject,
+		ItemLine:        "LineB",
+		ItemAmount:      "Gross",
+		ItemRate:        "Rate",
+		Total:           Field{Line: "LineD", Field: "Total"},
+		VatLine:         "LineC",
+		VatRate:         "Rate",
+		VatAmount:       "Vat",
+		Payment:         Field{Line: "LineE", Field: "Amount"},
+		AllowedVatRates: []string{"0", "6", "20"},
+		Tolerance:       1,
+	}
+	v, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := func(total string, rateB string, vat20 string, paid string) slipfields.Record {
+		return slipfields.Record{SlipSerial: 1, DailySlipNo: 1, Lines: map[string]interface{}{
+			"LineB": []map[string]interface{}{item("120.00", "20"), item("10.60", rateB)},
+			"LineC": []map[string]interface{}{
+				{"Rate": "20", "Vat": vat20},
+				{"Rate": rateB, "Vat": "0.60"},
+			},
+			"LineD": map[string]interface{}{"Total": total},
+			"LineE": map[string]interface{}{"Amount": paid},
+		}}
+	}
+
+	tests := []struct {
+		name   string
+		record slipfields.Record
+		codes  []int
+	}{
+		{"valid", record("130.60", "6", "20.00", "150"), nil},
+		{"rounding within tolerance", record("130.61", "6", "20.01", "130.61"), nil},
+		{"total", record("131.60", "6", "20.00", "131.60"), []int{kupon_errors.ErrSlipTotalMismatch}},
+		{"vat", record("130.60", "6", "19.00", "130.60"), []int{kupon_errors.ErrVatMismatch}},
+		{"payment", record("130.60", "6", "20.00", "100"), []int{kupon_errors.ErrPaymentNotCovered}},
+		{"rate", record("130.60", "10", "20.00", "130.60"), []int{
+			kupon_errors.ErrVatRateNotAllowed, kupon_errors.ErrVatRateNotAllowed, kupon_errors.ErrVatMismatch}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failures := v.Check(&slipfields.Message{Records: []slipfields.Record{tt.record}})
+			if len(failures) != len(tt.codes) {
+				t.Fatalf("got %v, want codes %v", failures, tt.codes)
+			}
+			for i, f := range failures {
+				if f.Code != tt.codes[i] {
+					t.Errorf("failure %d: %v, want code %d", i, f, tt.codes[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCheckSkipsUnconfigured(t *testing.T) {
+	v, err := New(Config{Mode: ModeReject, ItemLine: "LineB", ItemAmount: "Gross", Total: Field{Line: "LineD", Field: "Total"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no items to add up, the payment check is not configured
+	r := slipfields.Record{Lines: map[string]interface{}{
+		"LineD": map[string]interface{}{"Total": "10.00"},
+		"LineE": map[string]interface{}{"Amount": "1.00"},
+	}}
+	failures := v.Check(&slipfields.Message{Records: []slipfields.Record{r}})
+	if len(failures) != 0 {
+		t.Errorf("got %v", failures)
+	}
+}
+
+func TestNew(t *testing.T) {
+	total := Config{Mode: ModeReject, ItemLine: "LineB", ItemAmount: "Gross", Total: Field{Line: "LineD", Field: "Total"}}
+	tests := []struct {
+		name string
+		cfg  Config
+		err  bool
+	}{
+		{"off without checks", Config{Mode: ModeOff}, false},
+		{"warn without checks", Config{Mode: ModeWarn}, true},
+		{"reject with half a check", Config{Mode: ModeReject, ItemLine: "LineB", ItemAmount: "Gross"}, true},
+		{"reject with the total check", total, false},
+		{"bad vat rate", Config{Mode: ModeOff, AllowedVatRates: []string{"x"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.cfg)
+			if (err != nil) != tt.err {
+				t.Errorf("err %v", err)
+			}
+		})
+	}
+
+	// the rates of DefaultAllowedVatRates are checked without configuring them
+	v, err := New(total)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.allowed[2000] || v.allowed[1800] {
+		t.Errorf("allowed %v", v.allowed)
+	}
+	if got := strings.Join(v.Checks(), ","); got != CheckTotal {
+		t.Errorf("checks %s", got)
+	}
+	total.ItemRate = "Rate"
+	total.Mode = ModeOff
+	if v, err = New(total); err != nil || len(v.Checks()) != 0 {
+		t.Errorf("checks %v with mode off, err %v", v.Checks(), err)
+	}
+}
@@ -0,0 +1,90 @@
+package slipfields
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var errDecimalSyntax = errors.New("not a decimal number")
+
+// Decimal is a fixed-point number, Units / 10^Scale.
+type Decimal struct {
+	Units int64
+	Scale int
+}
+
+// ParseDecimal parses s with at most scale fraction digits. Both '.' and ','
+// are accepted as the decimal separator, s without one is a whole number.
+func ParseDecimal(s string, scale int) (Decimal, error) {
+	s = strings.TrimSpace(s)
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	whole, frac := s, ""
+	if i := strings.IndexAny(s, ".,"); i >= 0 {
+		whole, frac = s[:i], s[i+1:]
+	}
+	if whole == "" && frac == "" || len(frac) > scale || !digits(whole) || !digits(frac) {
+		return Decimal{}, errDecimalSyntax
+	}
+	frac += strings.Repeat("0", scale-len(frac))
+
+	d := Decimal{Scale: scale}
+	for _, c := range whole + frac {
+		if d.Units > (math.MaxInt64-9)/10 {
+			return Decimal{}, strconv.ErrRange
+		}
+		d.Units = d.Units*10 + int64(c-'0')
+	}
+	if neg {
+		d.Units = -d.Units
+	}
+	return d, nil
+}
+
+func (d Decimal) String() string {
+	units := d.Units
+	sign := ""
+	if units < 0 {
+		sign = "-"
+		units = -units
+	}
+	s := strconv.FormatInt(units, 10)
+	if d.Scale == 0 {
+		return sign + s
+	}
+	if len(s) <= d.Scale {
+		s = strings.Repeat("0", d.Scale-len(s)+1) + s
+	}
+	return sign + s[:len(s)-d.Scale] + "." + s[len(s)-d.Scale:]
+}
+
+// MarshalJSON writes d as a JSON number with exactly Scale fraction digits.
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Decimal) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	scale := 0
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		scale = len(s) - i - 1
+	}
+	v, err := ParseDecimal(s, scale)
+	if err != nil {
+		return err
+	}
+	*d = v
+	return nil
+}
+
+func digits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package slipfields
+
+import (
+	"testing"
+)
+
+func TestParseDecimal(t *testing.T) {
+	tests := []struct {
+		in    string
+		scale int
+		units int64
+		str   string
+		err   bool
+	}{
+		{"12.30", 2, 1230, "12.30", false},
+		{"12,3", 2, 1230, "12.30", false},
+		{"12", 2, 1200, "12.00", false},
+		{"0", 2, 0, "0.00", false},
+		{"000", 2, 0, "0.00", false},
+		{".5", 2, 50, "0.50", false},
+		{"-0.05", 2, -5, "-0.05", false},
+		{"1.250", 3, 1250, "1.250", false},
+		{" 7.5 ", 3, 7500, "7.500", false},
+		{"1.234", 2, 0, "", true},
+		{"", 2, 0, "", true},
+		{"1.2.3", 2, 0, "", true},
+		{"12a", 2, 0, "", true},
+		{"99999999999999999999", 2, 0, "", true},
+	}
+	for _, tt := range tests {
+		d, err := ParseDecimal(tt.in, tt.scale)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", tt.in, d)
+			}
+			continue
+		}
+		if err != nil || d.Units != tt.units || d.String() != tt.str {
+			t.Errorf("%q: got %d %q %v, want %d %q", tt.in, d.Units, d.String(), err, tt.units, tt.str)
+		}
+	}
+}
+
+func TestParseCounter(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+		err  bool
+	}{
+		{"000120", 120, false},
+		{"0000", 0, false},
+		{"7", 7, false},
+		{"", 0, true},
+		{"12x", 0, true},
+		{"-1", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseCounter(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("%q: got %d %v", tt.in, got, err)
+		}
+	}
+}
+
+func TestTrimZeros(t *testing.T) {
+	for in, want := range map[string]string{"000120": "120", "0000": "0", "": "", "5": "5"} {
+		if got := TrimZeros(in); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
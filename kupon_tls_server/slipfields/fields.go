@@ -0,0 +1,86 @@
+// Package slipfields converts the string fields of parsed slip lines into
+// typed values: fixed-point decimals for amounts, quantities and VAT rates,
+// integers for counters and time.Time for timestamps.
+package slipfields
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of field values.
+const (
+	KindString    = "string"
+	KindAmount    = "amount"    // Decimal with 2 fraction digits
+	KindQuantity  = "quantity"  // Decimal with 3 fraction digits
+	KindRate      = "rate"      // VAT rate in percent, Decimal with 2 fraction digits
+	KindCounter   = "counter"   // int
+	KindTimestamp = "timestamp" // time.Time, TimestampLayout in local time
+)
+
+// TimestampLayout is the date and time format used by the registers.
+const TimestampLayout = "20060102150405"
+
+// FieldError is a field that does not hold a value of its kind.
+type FieldError struct {
+	Field string
+	Value string
+	Kind  string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("field %s: %q is not a valid %s: %v", e.Field, e.Value, e.Kind, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// Parse converts value to kind. field only names the value in errors.
+func Parse(field string, kind string, value string) (interface{}, error) {
+	var v interface{}
+	var err error
+	switch kind {
+	case KindString, "":
+		return value, nil
+	case KindAmount, KindRate:
+		v, err = ParseDecimal(value, 2)
+	case KindQuantity:
+		v, err = ParseDecimal(value, 3)
+	case KindCounter:
+		v, err = ParseCounter(value)
+	case KindTimestamp:
+		v, err = time.ParseInLocation(TimestampLayout, strings.TrimSpace(value), time.Local)
+	default:
+		err = fmt.Errorf("unknown kind")
+	}
+	if err != nil {
+		return nil, &FieldError{Field: field, Value: value, Kind: kind, Err: err}
+	}
+	return v, nil
+}
+
+// ParseCounter parses a zero padded counter, "0000" is 0.
+func ParseCounter(s string) (int, error) {
+	n, err := strconv.Atoi(TrimZeros(strings.TrimSpace(s)))
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("negative counter %d", n)
+	}
+	return n, nil
+}
+
+// TrimZeros removes the zero padding of a number, keeping the last zero of
+// an all-zero field: "000120" is "120", "0000" is "0".
+func TrimZeros(s string) string {
+	t := strings.TrimLeft(s, "0")
+	if t == "" && s != "" {
+		return "0"
+	}
+	return t
+}
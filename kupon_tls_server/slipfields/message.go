@@ -0,0 +1,186 @@
+package slipfields
+
+import (
+	"fmt"
+	"nexusws/cmd/kupon_tls_server/sliplines"
+	v13 "nexusws/pkg/nexushttpclient/v13"
+	"reflect"
+	"strings"
+)
+
+// JSONFormat values. A typed message carries FormatTyped in its Format field
+// so the receiver can tell it from the v13 string JSON, which has none.
+const (
+	FormatV13   = "v13"
+	FormatTyped = "typed"
+)
+
+// Schema maps fields to their kind, either as "LineX.Field" for one line
+// type or as "Field" for every line. Fields not in the schema stay strings.
+type Schema map[string]string
+
+// DefaultSchema holds the only field whose v13 name this server relies on.
+// The amount, quantity and rate fields come from the configuration, which
+// is why FormatTyped is refused without them, see HasKind.
+var DefaultSchema = Schema{
+	"LineM.RecordNo": KindCounter,
+}
+
+// HasKind reports whether a field of kind is in the schema.
+func (s Schema) HasKind(kind string) bool {
+	for _, k := range s {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Schema) kind(line string, field string) string {
+	if k, ok := s[line+"."+field]; ok {
+		return k
+	}
+	return s[field]
+}
+
+// Message is the typed form of sliplines.Message.
+type Message struct {
+	Format   string              `json:"Format"`
+	Header   *v13.MessageGHeader `json:"Header"`
+	Records  []Record            `json:"Records"`
+	Checksum string              `json:"Checksum"`
+}
+
+type Record struct {
+	Mac                       string `json:"Mac"`
+	ZReport                   int    `json:"ZReport"`
+	SlipSerial                int    `json:"SlipSerial"`
+	DailySlipNo               int    `json:"DailySlipNo"`
+	IsTransmittedInBackground bool   `json:"IsTransmittedInBackground"`
+	// Lines holds every line that was present, by v13 field name ("LineA").
+	// A line is a map of field name to typed value, lines that can repeat
+	// are a list of those.
+	Lines map[string]interface{} `json:"Lines"`
+}
+
+// Errors lists every field that failed to convert.
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Convert returns the typed form of msg. On failure the error is Errors and
+// the message holds the fields that did convert.
+func Convert(msg *sliplines.Message, schema Schema) (*Message, error) {
+	m := &Message{
+		Format:   FormatTyped,
+		Header:   msg.Header,
+		Records:  make([]Record, 0, len(msg.Records)),
+		Checksum: msg.Checksum,
+	}
+
+	var errs []error
+	parse := func(field string, value string) int {
+		v, err := Parse(field, KindCounter, value)
+		if err != nil {
+			errs = append(errs, err)
+			return 0
+		}
+		return v.(int)
+	}
+	for i := range msg.Records {
+		sr := &msg.Records[i]
+		r := Record{
+			Mac:                       sr.Mac,
+			ZReport:                   parse("ZReport", sr.ZReport),
+			SlipSerial:                parse("SlipSerial", sr.SlipSerial),
+			DailySlipNo:               parse("DailySlipNo", sr.DailySlipNo),
+			IsTransmittedInBackground: sr.IsTransmittedInBackground,
+			Lines:                     make(map[string]interface{}),
+		}
+
+		sr.EachLine(func(name string, f reflect.Value) error {
+			v, err := convertLine(name, f, schema)
+			errs = append(errs, err...)
+			if v != nil {
+				r.Lines[name] = v
+			}
+			return nil
+		})
+		m.Records = append(m.Records, r)
+	}
+	if len(errs) > 0 {
+		return m, Errors(errs)
+	}
+	return m, nil
+}
+
+// convertLine converts a *LineX or []LineX field, nil when it is empty.
+func convertLine(name string, v reflect.Value, schema Schema) (interface{}, []error) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return convertFields(name, v.Elem(), schema)
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return nil, nil
+		}
+		lines := make([]map[string]interface{}, 0, v.Len())
+		var errs []error
+		for i := 0; i < v.Len(); i++ {
+			l, err := convertFields(name, v.Index(i), schema)
+			errs = append(errs, err...)
+			lines = append(lines, l)
+		}
+		return lines, errs
+	case reflect.Struct:
+		return convertFields(name, v, schema)
+	}
+	return nil, nil
+}
+
+func convertFields(name string, v reflect.Value, schema Schema) (map[string]interface{}, []error) {
+	if v.Kind() != reflect.Struct {
+		return map[string]interface{}{"Value": v.Interface()}, nil
+	}
+
+	fields := make(map[string]interface{}, v.NumField())
+	var errs []error
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		if f.Type.Kind() != reflect.String {
+			fields[f.Name] = v.Field(i).Interface()
+			continue
+		}
+		value, err := Parse(name+"."+f.Name, schema.kind(name, f.Name), v.Field(i).String())
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		fields[f.Name] = value
+	}
+	return fields, errs
+}
+
+// Validate reports kinds that Parse does not know.
+func (s Schema) Validate() error {
+	for field, kind := range s {
+		switch kind {
+		case KindString, KindAmount, KindQuantity, KindRate, KindCounter, KindTimestamp:
+		default:
+			return fmt.Errorf("field %s: unknown kind %q", field, kind)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package slipfields
+
+import (
+	"errors"
+	"nexusws/cmd/kupon_tls_server/sliplines"
+	v13 "nexusws/pkg/nexushttpclient/v13"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	msg := &sliplines.Message{Header: &v13.MessageGHeader{EcrSerial: "ECR1"}, Records: make([]sliplines.Record, 1)}
+	rec := &msg.Records[0]
+	rec.Mac, rec.ZReport, rec.SlipSerial, rec.DailySlipNo = "MAC1", "0012", "000100", "0000"
+	rec.LineM = &v13.LineM{RecordNo: "0007"}
+
+	m, err := Convert(msg, DefaultSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := m.Records[0]
+	if m.Format != FormatTyped || r.ZReport != 12 || r.SlipSerial != 100 || r.DailySlipNo != 0 {
+		t.Fatalf("got %+v", r)
+	}
+	lineM, ok := r.Lines["LineM"].(map[string]interface{})
+	if !ok || lineM["RecordNo"] != 7 {
+		t.Errorf("LineM %v", r.Lines["LineM"])
+	}
+
+	rec.LineM.RecordNo = "7a"
+	_, err = Convert(msg, DefaultSchema)
+	errs, ok := err.(Errors)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("got %v, want one field error", err)
+	}
+	var fe *FieldError
+	if !errors.As(errs[0], &fe) || fe.Field != "LineM.RecordNo" {
+		t.Errorf("got %v, want a FieldError for LineM.RecordNo", err)
+	}
+}
@@ -0,0 +1,161 @@
+// Package sliplines holds a parsed G message. Its records are the
+// v13.SlipRecord NexusWS takes plus the lines the v13 package has no field
+// for, which are parsed here. Like the v13 lines their fields are separated
+// by ';' and follow the record header, N lines of v13 excepted:
+//
+//	S Mac;ZReport;SlipSerial;DailySlipNo;IIC;Signature
+//	K Mac;ZReport;SlipSerial;DailySlipNo;Tin;Name;Address
+//	L Mac;ZReport;SlipSerial;DailySlipNo;Code
+//	N Text
+package sliplines
+
+import (
+	"errors"
+	"fmt"
+	v13 "nexusws/pkg/nexushttpclient/v13"
+	"reflect"
+	"strings"
+)
+
+// Message marshals to the v13.MessageG JSON, each record with the lines of
+// this package added.
+type Message struct {
+	Header   *v13.MessageGHeader
+	Records  []Record
+	Checksum string
+}
+
+// Record is a slip record. The lines of this package are left out of the
+// JSON when the slip has none, so that it stays the v13 JSON.
+type Record struct {
+	v13.SlipRecord
+	LineN []LineN `json:",omitempty"`
+	LineS *LineS  `json:",omitempty"`
+	LineK *LineK  `json:",omitempty"`
+	LineL *LineL  `json:",omitempty"`
+
+	// UnparsedLines are the lines the lenient parsing mode of sliprecord
+	// kept as text. They are not a line of the slip for EachLine.
+	UnparsedLines []string `json:",omitempty"`
+}
+
+// V13 returns msg without the lines of this package, for SlipClient.
+func (m *Message) V13() *v13.MessageG {
+	msg := &v13.MessageG{
+		Header:   m.Header,
+		Records:  make([]v13.SlipRecord, len(m.Records)),
+		Checksum: m.Checksum,
+	}
+	for i := range m.Records {
+		msg.Records[i] = m.Records[i].SlipRecord
+	}
+	return msg
+}
+
+// EachLine calls fn with the name and value of every LineX field of r, those
+// of the v13 record first. Single lines are pointers, lines that can repeat
+// are slices.
+func (r *Record) EachLine(fn func(name string, v reflect.Value) error) error {
+	for _, v := range []reflect.Value{reflect.ValueOf(&r.SlipRecord).Elem(), reflect.ValueOf(r).Elem()} {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Anonymous || !strings.HasPrefix(f.Name, "Line") {
+				continue
+			}
+			if err := fn(f.Name, v.Field(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// LineN is a line of text printed on the slip. v13 registers send it without
+// a record header, v14 registers with one, see package sliprecord.
+type LineN struct {
+	Text string
+}
+
+// NewLineN parses an N line after its record header, if it has one. The
+// text may hold any character, ';' included.
+func NewLineN(b []byte) *LineN {
+	return &LineN{Text: string(b)}
+}
+
+// ErrWrongNumberOfFields is wrapped by the errors of lines with too few or
+// too many fields, the other errors are about the value of a field.
+var ErrWrongNumberOfFields = errors.New("wrong number of fields")
+
+// Header is the record header of a line, the key of its slip record.
+type Header struct {
+	Mac         string
+	ZReport     string
+	SlipSerial  string
+	DailySlipNo string
+}
+
+// LineS holds the security codes of the slip, the IIC the E frame of the
+// slip sends as its MD5 and the signature of the IIC.
+type LineS struct {
+	IIC       string
+	Signature string
+}
+
+// LineK is the customer of an invoice slip.
+type LineK struct {
+	Tin     string
+	Name    string
+	Address string
+}
+
+// LineL is the lottery code printed on the slip.
+type LineL struct {
+	Code string
+}
+
+// NewLineS parses an S line after its type letter.
+func NewLineS(b []byte) (*LineS, *Header, error) {
+	h, f, err := split(b, 2)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &LineS{IIC: f[0], Signature: f[1]}, h, nil
+}
+
+// NewLineK parses a K line after its type letter. Name and Address may be
+// empty, the Tin may not.
+func NewLineK(b []byte) (*LineK, *Header, error) {
+	h, f, err := split(b, 3)
+	if err != nil {
+		return nil, nil, err
+	}
+	if f[0] == "" {
+		return nil, nil, errors.New("Tin is empty")
+	}
+	return &LineK{Tin: f[0], Name: f[1], Address: f[2]}, h, nil
+}
+
+// NewLineL parses an L line after its type letter.
+func NewLineL(b []byte) (*LineL, *Header, error) {
+	h, f, err := split(b, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &LineL{Code: f[0]}, h, nil
+}
+
+// split returns the header of a line and the n fields after it.
+func split(b []byte, n int) (*Header, []string, error) {
+	f := strings.Split(string(b), ";")
+	if len(f) != 4+n {
+		return nil, nil, fmt.Errorf("%w: %d, want %d", ErrWrongNumberOfFields, len(f), 4+n)
+	}
+	h := &Header{Mac: f[0], ZReport: f[1], SlipSerial: f[2], DailySlipNo: f[3]}
+	for i, name := range []string{"Mac", "ZReport", "SlipSerial", "DailySlipNo"} {
+		if f[i] == "" {
+			return nil, nil, fmt.Errorf("%s is empty", name)
+		}
+	}
+	return h, f[4:], nil
+}
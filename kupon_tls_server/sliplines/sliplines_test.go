@@ -0,0 +1,125 @@
+package sliplines
+
+import (
+	"encoding/json"
+	"errors"
+	v13 "nexusws/pkg/nexushttpclient/v13"
+	"reflect"
+	"testing"
+)
+
+func TestNewLineN(t *testing.T) {
+	for _, text := range []string{"Falemnderit", "Ju faleminderit për blerjen!", "Tel; 04 222 333", ""} {
+		if n := NewLineN([]byte(text)); n.Text != text {
+			t.Errorf("%q: Text %q", text, n.Text)
+		}
+	}
+}
+
+func TestRecordJSON(t *testing.T) {
+	msg := &Message{Header: &v13.MessageGHeader{EcrSerial: "ECR0000001"}, Records: make([]Record, 1)}
+	rec := &msg.Records[0]
+	rec.Mac, rec.ZReport, rec.SlipSerial, rec.DailySlipNo = "MAC1", "12", "100", "1"
+	rec.LineM = &v13.LineM{RecordNo: "7"}
+
+	// without the lines of this package the JSON is that of v13
+	got, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := json.Marshal(msg.V13())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("JSON\n%s\nwant\n%s", got, want)
+	}
+
+	rec.LineN = []LineN{{Text: "Falemnderit"}}
+	got, _ = json.Marshal(msg)
+	var m struct {
+		Records []struct {
+			Mac   string
+			LineN []LineN
+		}
+	}
+	if err = json.Unmarshal(got, &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Records) != 1 || m.Records[0].Mac != "MAC1" || len(m.Records[0].LineN) != 1 || m.Records[0].LineN[0].Text != "Falemnderit" {
+		t.Errorf("JSON %s", got)
+	}
+	if v := msg.V13(); v.Records[0].LineM != rec.LineM {
+		t.Errorf("V13 lost the v13 lines: %+v", v.Records[0])
+	}
+}
+
+func TestEachLine(t *testing.T) {
+	rec := &Record{LineN: []LineN{{Text: "x"}}, UnparsedLines: []string{"Xx"}}
+	rec.LineM = &v13.LineM{RecordNo: "7"}
+
+	set := make(map[string]bool)
+	rec.EachLine(func(name string, v reflect.Value) error {
+		set[name] = !v.IsNil()
+		return nil
+	})
+	if !set["LineM"] || !set["LineN"] || set["LineA"] || len(set) != 16 {
+		t.Errorf("lines %v", set)
+	}
+}
+
+func TestNewLineSKL(t *testing.T) {
+	parse := map[byte]func([]byte) (interface{}, *Header, error){
+		'S': func(b []byte) (interface{}, *Header, error) { return NewLineS(b) },
+		'K': func(b []byte) (interface{}, *Header, error) { return NewLineK(b) },
+		'L': func(b []byte) (interface{}, *Header, error) { return NewLineL(b) },
+	}
+	header := Header{Mac: "MAC1", ZReport: "12", SlipSerial: "100", DailySlipNo: "1"}
+
+	tests := []struct {
+		name      string
+		line      string
+		want      interface{}
+		wantCount bool
+		wantErr   bool
+	}{
+		{"S fields", "SMAC1;12;100;1;82BDED;SIG=", &LineS{IIC: "82BDED", Signature: "SIG="}, false, false},
+		{"S empty signature", "SMAC1;12;100;1;82BDED;", &LineS{IIC: "82BDED"}, false, false},
+		{"S missing field", "SMAC1;12;100;1;82BDED", nil, true, true},
+		{"S extra field", "SMAC1;12;100;1;82BDED;SIG=;x", nil, true, true},
+		{"K fields", "KMAC1;12;100;1;L12345678A;Shitore;Rr. Nëna Terezë 1", &LineK{Tin: "L12345678A", Name: "Shitore", Address: "Rr. Nëna Terezë 1"}, false, false},
+		{"K empty name and address", "KMAC1;12;100;1;L12345678A;;", &LineK{Tin: "L12345678A"}, false, false},
+		{"K empty Tin", "KMAC1;12;100;1;;Shitore;Rr. 1", nil, false, true},
+		{"K missing field", "KMAC1;12;100;1;L12345678A;Shitore", nil, true, true},
+		{"L fields", "LMAC1;12;100;1;A1B2C3", &LineL{Code: "A1B2C3"}, false, false},
+		{"L missing field", "LMAC1;12;100;1", nil, true, true},
+		{"L extra field", "LMAC1;12;100;1;A1B2C3;x", nil, true, true},
+		{"empty Mac", "L;12;100;1;A1B2C3", nil, false, true},
+		{"empty ZReport", "LMAC1;;100;1;A1B2C3", nil, false, true},
+		{"empty SlipSerial", "LMAC1;12;;1;A1B2C3", nil, false, true},
+		{"empty DailySlipNo", "LMAC1;12;100;;A1B2C3", nil, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, h, err := parse[tt.line[0]]([]byte(tt.line[1:]))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("no error, got %+v", got)
+				}
+				if errors.Is(err, ErrWrongNumberOfFields) != tt.wantCount {
+					t.Errorf("err %v, wrong number of fields %v", err, tt.wantCount)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if *h != header {
+				t.Errorf("header %+v", *h)
+			}
+		})
+	}
+}
@@ -1,5 +1,7 @@
 package sliprecord
 
+import "nexusws/cmd/kupon_tls_server/framecheck"
+
 const (
 	SlipMaxMessageLength = 2048
 	// SlipRecordBodyOffset   = 24
@@ -7,6 +9,10 @@ const (
 	SlipRecordMessageIdentifier     = 71 //'G'
 	SlipValidationMessageIdentifier = 69 // 'E'
 
+	// signed frames, see package signing
+	SlipRecordSignedMessageIdentifier     = 103 // 'g'
+	SlipValidationSignedMessageIdentifier = 101 // 'e'
+
 	SlipRecordIdentifierLength = 1
 	SlipRecordIdentifierOffset = 0
 	SlipRecordIdentifierLast   = SlipRecordIdentifierLength +
@@ -46,3 +52,63 @@ const (
 
 	SlipRecordProtocolACK = "A0000"
 )
+
+// Protocol versions of G frames with a parser.
+const (
+	ProtocolV13 = "13"
+	ProtocolV14 = "14"
+	ProtocolV15 = framecheck.ProtocolVersionCRC32 // v14 frames with a CRC32 checksum
+)
+
+// v14 G frame header:
+//
+//	'G', protocol version (2), body length (4), type (1), EcrSerial (10), flags (1)
+//
+// The body length is little endian. Every body line has a header, N lines
+// included. Like E and W frames, v14 frames have the 2 chars XOR checksum and
+// v15 frames a CRC32, see framecheck. SlipRecordV14FlagResend declares that
+// the register reads a resend request after the ACK, no other register is
+// sent one. The other flags are ignored.
+const (
+	SlipV14MaxMessageLength = 1 << 20
+
+	SlipRecordV14LengthFieldLength = 4
+	SlipRecordV14LengthFieldOffset = 3
+	SlipRecordV14LengthFieldLast   = SlipRecordV14LengthFieldLength + SlipRecordV14LengthFieldOffset
+
+	SlipRecordV14TypeOffset = 7
+	SlipRecordV14TypeLast   = SlipRecordTypeLength + SlipRecordV14TypeOffset
+
+	SlipRecordV14EcrSerialOffset = 8
+	SlipRecordV14EcrSerialLast   = SlipRecordEcrSerialLength + SlipRecordV14EcrSerialOffset
+
+	SlipRecordV14FlagsOffset = 18
+
+	SlipRecordV14HeaderLength = SlipRecordIdentifierLength +
+		SlipRecordProtocolLength +
+		SlipRecordV14LengthFieldLength +
+		SlipRecordTypeLength +
+		SlipRecordEcrSerialLength +
+		1
+
+	SlipRecordV14FlagResend = 1 << 2
+)
+
+// What parseV13 does with unknown and malformed lines.
+const (
+	ParsingStrict  = "strict"  // NACK the message
+	ParsingLenient = "lenient" // keep the line as text in UnparsedLines of the record
+)
+
+// Resend request frame, see NewResendResponse:
+//
+//	'R', protocol version (2), range type (1), ZReport (4), from (4), to (4), checksum (2 to 8)
+//
+// Numbers are little endian, from and to are both included. The checksum is
+// the one of the G frame answered.
+const (
+	ResendMessageIdentifier = 82 // 'R'
+
+	ResendRangeSlipSerial  = 83 // 'S', From and To are SlipSerial numbers
+	ResendRangeDailySlipNo = 68 // 'D', From and To are DailySlipNo numbers of ZReport
+)
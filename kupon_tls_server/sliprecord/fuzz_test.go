@@ -0,0 +1,77 @@
+package sliprecord
+
+import (
+	"bytes"
+	"context"
+	"github.com/go-kit/kit/log"
+	"nexusws/cmd/kupon_tls_server/frametest"
+	"nexusws/cmd/kupon_tls_server/sliplines"
+	"testing"
+)
+
+// addCaptured seeds f with the G frames of the capture files in
+// frametest.CaptureDir.
+func addCaptured(f *testing.F) {
+	frames, err := frametest.Captured(frametest.CaptureDir, SlipRecordMessageIdentifier, SlipRecordSignedMessageIdentifier)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, frame := range frames {
+		f.Add(frame)
+	}
+}
+
+func FuzzParseMessageGV13Header(f *testing.F) {
+	f.Add(frametest.G13(frametest.SlipBody))
+	f.Add([]byte("G13"))
+	addCaptured(f)
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		if len(msg) > SlipMaxMessageLength {
+			return
+		}
+		s := New(log.NewNopLogger(), nil, nil, nil, &Options{}, msg, len(msg))
+		err := s.parseMessageGV13Header(SlipRecordV13HeaderLength)
+		if err == nil && len(s.Header13.EcrSerial) != SlipRecordEcrSerialLength {
+			t.Errorf("EcrSerial %q", s.Header13.EcrSerial)
+		}
+	})
+}
+
+func FuzzParseV13(f *testing.F) {
+	f.Add([]byte(frametest.SlipBody))
+	f.Add([]byte("N1;Shenim\n"))
+	f.Add([]byte("\n\x00\x00\nX1;2;3\n"))
+	f.Fuzz(func(t *testing.T, body []byte) {
+		for _, parsing := range []string{ParsingStrict, ParsingLenient} {
+			s := &RawEcrSlipRecord{
+				l:       log.NewNopLogger(),
+				message: &sliplines.Message{Records: make([]sliplines.Record, 0)},
+				opts:    &Options{Parsing: parsing},
+			}
+			s.parseV13(body)
+		}
+	})
+}
+
+func FuzzHandleMsgG(f *testing.F) {
+	f.Add(frametest.G13(frametest.SlipBody))
+	f.Add(frametest.G14(ProtocolV14, frametest.SlipBodyV14))
+	f.Add(frametest.G14(ProtocolV15, frametest.SlipBodyV14))
+	f.Add([]byte("G"))
+	addCaptured(f)
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		// the connection handler reads at most SlipMaxMessageLength bytes,
+		// the handler reads the rest
+		msg := frame
+		if len(msg) > SlipMaxMessageLength {
+			msg = msg[:SlipMaxMessageLength]
+		}
+		c := frametest.NewConn(frame[len(msg):])
+		b := &frametest.Backend{}
+		s := New(log.NewNopLogger(), b, nil, nil, &Options{Parsing: ParsingLenient}, msg, len(msg))
+		s.HandleMsgG(context.Background(), c)
+		if bytes.HasPrefix(c.Out.Bytes(), []byte(SlipRecordProtocolACK)) && b.Stored == 0 {
+			t.Errorf("ACK for a frame not stored")
+		}
+	})
+}
@@ -0,0 +1,69 @@
+package sliprecord
+
+import (
+	"bytes"
+	"nexusws/cmd/kupon_tls_server/sliplines"
+	"strings"
+)
+
+// recordKey identifies the slip record a line belongs to.
+type recordKey struct {
+	Mac         string
+	ZReport     string
+	SlipSerial  string
+	DailySlipNo string
+}
+
+// find returns the index of the record k belongs to, -1 when there is none
+// or k is nil.
+func (k *recordKey) find(records []sliplines.Record) int {
+	if k == nil {
+		return -1
+	}
+	for i, t := range records {
+		if t.DailySlipNo == k.DailySlipNo &&
+			t.SlipSerial == k.SlipSerial &&
+			t.ZReport == k.ZReport &&
+			t.Mac == k.Mac {
+			return i
+		}
+	}
+	return -1
+}
+
+// recordFor returns the record k belongs to, adding a new one when the
+// message has none yet.
+func (s *RawEcrSlipRecord) recordFor(k *recordKey, isTransmittedInBackground bool) *sliplines.Record {
+	i := k.find(s.message.Records)
+	if i < 0 {
+		sr := sliplines.Record{}
+		sr.IsTransmittedInBackground = isTransmittedInBackground
+		sr.Mac = k.Mac
+		sr.ZReport = k.ZReport
+		sr.SlipSerial = k.SlipSerial
+		sr.DailySlipNo = k.DailySlipNo
+		s.message.Records = append(s.message.Records, sr)
+		i = len(s.message.Records) - 1
+	}
+	return &s.message.Records[i]
+}
+
+// lineKey reads the record header of a line whose type is in headed.
+// hasHeader is true for such lines, k is nil when the header is cut short.
+func lineKey(r []byte, headed string) (k *recordKey, hasHeader bool) {
+	if len(r) == 0 {
+		return nil, false
+	}
+	c := r[0]
+	if 'a' <= c && c <= 'z' {
+		c -= 'a' - 'A'
+	}
+	if strings.IndexByte(headed, c) < 0 {
+		return nil, false
+	}
+	f := bytes.SplitN(r[1:], []byte{';'}, 5)
+	if len(f) < 4 {
+		return nil, true
+	}
+	return &recordKey{Mac: string(f[0]), ZReport: string(f[1]), SlipSerial: string(f[2]), DailySlipNo: string(f[3])}, true
+}
@@ -0,0 +1,199 @@
+package sliprecord
+
+import (
+	"fmt"
+	"github.com/go-kit/kit/log"
+	"nexusws/cmd/kupon_tls_server/sliplines"
+	"nexusws/pkg/nexus_errors"
+	"strings"
+	"testing"
+)
+
+func TestRecordKeyFind(t *testing.T) {
+	records := make([]sliplines.Record, 2)
+	records[0].Mac, records[0].ZReport, records[0].SlipSerial, records[0].DailySlipNo = "MAC1", "12", "100", "1"
+	records[1].Mac, records[1].ZReport, records[1].SlipSerial, records[1].DailySlipNo = "MAC1", "12", "101", "2"
+
+	tests := []struct {
+		name string
+		key  *recordKey
+		want int
+	}{
+		{"no previous header", nil, -1},
+		{"first", &recordKey{Mac: "MAC1", ZReport: "12", SlipSerial: "100", DailySlipNo: "1"}, 0},
+		{"second", &recordKey{Mac: "MAC1", ZReport: "12", SlipSerial: "101", DailySlipNo: "2"}, 1},
+		{"other Z report", &recordKey{Mac: "MAC1", ZReport: "13", SlipSerial: "100", DailySlipNo: "1"}, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.key.find(records)
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseV13LineNWithoutHeader(t *testing.T) {
+	s := &RawEcrSlipRecord{
+		l:       log.NewNopLogger(),
+		message: &sliplines.Message{Records: make([]sliplines.Record, 0)},
+		opts:    &Options{Parsing: ParsingStrict},
+	}
+	// the N line is dropped, the slip after it is kept
+	err := s.parseV13([]byte("NFalemnderit\nAMAC1;12;100;1;1;20230727;125624;0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.message.Records) != 1 || len(s.message.Records[0].LineN) != 0 {
+		t.Errorf("records %+v", s.message.Records)
+	}
+}
+
+func TestParseV13LineN(t *testing.T) {
+	s := &RawEcrSlipRecord{
+		l:       log.NewNopLogger(),
+		message: &sliplines.Message{Records: make([]sliplines.Record, 0)},
+		opts:    &Options{Parsing: ParsingStrict},
+	}
+	body := "AMAC1;12;100;1;1;20230727;125624;0\n" +
+		"BMAC1;12;100;1;1;Kafe;1;100;100;0;1\n" +
+		"NFalemnderit\n" +
+		"NMirupafshim\n" +
+		"AMAC1;12;101;2;1;20230727;125931;0\n" +
+		"NFalemnderit\n"
+	err := s.parseV13([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := s.message.Records
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	if len(records[0].LineN) != 2 || len(records[1].LineN) != 1 {
+		t.Errorf("N lines per record: %d, %d, want 2, 1", len(records[0].LineN), len(records[1].LineN))
+	}
+}
+
+func TestRecordFor(t *testing.T) {
+	k1 := &recordKey{Mac: "MAC1", ZReport: "12", SlipSerial: "100", DailySlipNo: "1"}
+	k2 := &recordKey{Mac: "MAC1", ZReport: "12", SlipSerial: "101", DailySlipNo: "2"}
+
+	tests := []struct {
+		name        string
+		keys        []*recordKey
+		wantSerials []string
+	}{
+		{"one line", []*recordKey{k1}, []string{"100"}},
+		{"S K L of the same slip", []*recordKey{k1, k1, k1}, []string{"100"}},
+		{"two slips", []*recordKey{k1, k2, k1}, []string{"100", "101"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &RawEcrSlipRecord{message: &sliplines.Message{Records: make([]sliplines.Record, 0)}}
+			for _, k := range tt.keys {
+				r := s.recordFor(k, true)
+				if r.SlipSerial != k.SlipSerial || r.DailySlipNo != k.DailySlipNo || !r.IsTransmittedInBackground {
+					t.Fatalf("record %s/%s for key %+v", r.SlipSerial, r.DailySlipNo, *k)
+				}
+			}
+			if len(s.message.Records) != len(tt.wantSerials) {
+				t.Fatalf("got %d records, want %d", len(s.message.Records), len(tt.wantSerials))
+			}
+			for i, serial := range tt.wantSerials {
+				if s.message.Records[i].SlipSerial != serial {
+					t.Errorf("record %d SlipSerial %s, want %s", i, s.message.Records[i].SlipSerial, serial)
+				}
+			}
+		})
+	}
+}
+
+func TestParseLineV13SKL(t *testing.T) {
+	has := map[byte]func(r *sliplines.Record) bool{
+		'S': func(r *sliplines.Record) bool { return r.LineS != nil },
+		'K': func(r *sliplines.Record) bool { return r.LineK != nil },
+		'L': func(r *sliplines.Record) bool { return r.LineL != nil },
+	}
+	// the fields after the header, put in place of x
+	body := map[byte]string{'S': "IIC;SIG", 'K': "TIN;Name;Address", 'L': "CODE"}
+	const a = "AMAC1;12;100;1;1;20230727;125624;0"
+
+	tests := []struct {
+		name       string
+		lines      []string
+		wantKeys   []recordKey
+		background bool
+		wantErr    bool
+	}{
+		{"header fields", []string{"%cMAC1;12;100;1;x"}, []recordKey{{"MAC1", "12", "100", "1"}}, false, false},
+		{"sent in background", []string{"%cMAC1;12;100;1;x"}, []recordKey{{"MAC1", "12", "100", "1"}}, true, false},
+		{"same slip as A", []string{a, "%cMAC1;12;100;1;x"}, []recordKey{{"MAC1", "12", "100", "1"}}, false, false},
+		{"other Mac", []string{a, "%cMAC2;12;100;1;x"}, []recordKey{{"MAC1", "12", "100", "1"}, {"MAC2", "12", "100", "1"}}, false, false},
+		{"other ZReport", []string{a, "%cMAC1;13;100;1;x"}, []recordKey{{"MAC1", "12", "100", "1"}, {"MAC1", "13", "100", "1"}}, false, false},
+		{"other SlipSerial", []string{a, "%cMAC1;12;101;1;x"}, []recordKey{{"MAC1", "12", "100", "1"}, {"MAC1", "12", "101", "1"}}, false, false},
+		{"other DailySlipNo", []string{a, "%cMAC1;12;100;2;x"}, []recordKey{{"MAC1", "12", "100", "1"}, {"MAC1", "12", "100", "2"}}, false, false},
+		{"missing field", []string{"%cMAC1;12;100"}, nil, false, true},
+	}
+	for line, set := range has {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%c %s", line, tt.name), func(t *testing.T) {
+				s := &RawEcrSlipRecord{message: &sliplines.Message{Records: make([]sliplines.Record, 0)}}
+				l := line
+				if tt.background {
+					l += 'a' - 'A'
+				}
+				for _, f := range tt.lines {
+					if strings.Contains(f, "%c") {
+						f = strings.Replace(fmt.Sprintf(f, l), ";x", ";"+body[line], 1)
+					}
+					err := s.parseLineV13([]byte(f))
+					if tt.wantErr {
+						if err == nil || s.errorCode != nexus_errors.ErrWrongNumberOfFields {
+							t.Errorf("err %v, code %d", err, s.errorCode)
+						}
+						return
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				records := s.message.Records
+				if len(records) != len(tt.wantKeys) {
+					t.Fatalf("got %d records, want %d", len(records), len(tt.wantKeys))
+				}
+				for i, k := range tt.wantKeys {
+					if got := (recordKey{records[i].Mac, records[i].ZReport, records[i].SlipSerial, records[i].DailySlipNo}); got != k {
+						t.Errorf("record %d key %+v, want %+v", i, got, k)
+					}
+				}
+				last := &records[len(records)-1]
+				if !set(last) || last.IsTransmittedInBackground != tt.background {
+					t.Errorf("line not set or background %v on %+v", tt.background, *last)
+				}
+			})
+		}
+	}
+}
+
+func TestLineKey(t *testing.T) {
+	k := &recordKey{Mac: "MAC1", ZReport: "12", SlipSerial: "100", DailySlipNo: "1"}
+	tests := []struct {
+		line          string
+		want          *recordKey
+		wantHasHeader bool
+	}{
+		{"BMAC1;12;100;1;x;y", k, true},
+		{"sMAC1;12;100;1", k, true},
+		{"BMAC1;12", nil, true},
+		{"NMAC1;12;100;1;x", nil, false},
+		{"X1;2;3;4", nil, false},
+	}
+	for _, tt := range tests {
+		got, hasHeader := lineKey([]byte(tt.line), headedLinesV13)
+		if hasHeader != tt.wantHasHeader || (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+			t.Errorf("%q: key %+v header %v", tt.line, got, hasHeader)
+		}
+	}
+}
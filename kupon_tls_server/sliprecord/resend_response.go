@@ -0,0 +1,67 @@
+package sliprecord
+
+import (
+	"bytes"
+	"encoding/binary"
+	"nexusws/cmd/kupon_tls_server/framecheck"
+	"nexusws/cmd/kupon_tls_server/sequence"
+)
+
+// NewResendResponse asks the register to send the slips of gap again. It is
+// sent after the ACK of a G message while the register has open gaps.
+func NewResendResponse(protocolVersion string, check framecheck.Algorithm, gap *sequence.Gap) *resendResponse {
+	r := &resendResponse{
+		MessageIdentifier: ResendMessageIdentifier,
+		ProtocolVersion:   protocolVersion,
+		check:             check,
+		RangeType:         ResendRangeSlipSerial,
+		ZReport:           uint32(gap.ZReport),
+		From:              uint32(gap.From),
+		To:                uint32(gap.To),
+	}
+	if gap.Kind == sequence.KindDailySlipNo {
+		r.RangeType = ResendRangeDailySlipNo
+	}
+	return r
+}
+
+type resendResponse struct {
+	MessageIdentifier uint8
+	ProtocolVersion   string
+	RangeType         uint8
+	ZReport           uint32 // 0 for ResendRangeSlipSerial
+	From              uint32
+	To                uint32
+	Checksum          string
+
+	check framecheck.Algorithm
+}
+
+func (r resendResponse) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+
+	err := binary.Write(buf, binary.LittleEndian, r.MessageIdentifier)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = buf.Write([]byte(r.ProtocolVersion))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range []interface{}{r.RangeType, r.ZReport, r.From, r.To} {
+		err = binary.Write(buf, binary.LittleEndian, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cs := r.check.Sum(buf.Bytes())
+	_, err = buf.Write([]byte(cs))
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
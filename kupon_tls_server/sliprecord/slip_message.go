@@ -2,19 +2,55 @@ package sliprecord
 
 import (
 	"github.com/go-kit/kit/log"
-	"nexusws/pkg/nexushttpclient"
+	"nexusws/cmd/kupon_tls_server/backend"
+	"nexusws/cmd/kupon_tls_server/charset"
+	"nexusws/cmd/kupon_tls_server/eventsink"
+	"nexusws/cmd/kupon_tls_server/framecheck"
+	"nexusws/cmd/kupon_tls_server/registry"
+	"nexusws/cmd/kupon_tls_server/sequence"
+	"nexusws/cmd/kupon_tls_server/signing"
+	"nexusws/cmd/kupon_tls_server/slipcheck"
+	"nexusws/cmd/kupon_tls_server/slipfields"
+	"nexusws/cmd/kupon_tls_server/sliplines"
 	v13 "nexusws/pkg/nexushttpclient/v13"
 )
 
 type RawEcrSlipRecord struct {
-	Header13      *v13.MessageGHeader
-	v13SlipRecord *v13.MessageG
-	Checksum      string
+	Header13 *v13.MessageGHeader
+	message  *sliplines.Message
+	typed    *slipfields.Message // set for slipfields.FormatTyped
+	Checksum string
 
 	rawMessage        []byte
 	rawMessageDataLen int //holds the actual number of data, not the message length
 	l                 log.Logger
-	nexusCl           *nexushttpclient.SlipClient
+	backend           backend.Backend
+	sink              eventsink.Sink
+	sequence          *sequence.Tracker
+	opts              *Options
+	prev              *recordKey // last line with a header, for lines that have none
+	unparsed          []string   // lenient lines before the first slip of the message
 	errorCode         int
 	protVersion       string
+	check             framecheck.Algorithm
+	resend            bool // the register reads a resend request after the ACK
+	signed            bool
+}
+
+type Options struct {
+	// Parsing is ParsingStrict or ParsingLenient, strict when empty.
+	Parsing string
+	// JSONFormat is slipfields.FormatV13 or slipfields.FormatTyped, it
+	// selects the event sink payload.
+	JSONFormat string
+	// Schema gives the kinds of fields for FormatTyped and Validator.
+	Schema slipfields.Schema
+	// Validator checks the figures of each record, nil when off.
+	Validator *slipcheck.Validator
+	// Charset gives the code page of text fields, UTF-8 when nil.
+	Charset *charset.Config
+	// Keys verifies signed frames, nil accepts every frame as it is.
+	Keys *signing.Store
+	// Registry admits devices, nil admits every device.
+	Registry *registry.Registry
 }
@@ -11,17 +11,29 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"io"
-	"nexusws/pkg/checksum"
+	"nexusws/cmd/kupon_tls_server/backend"
+	"nexusws/cmd/kupon_tls_server/charset"
+	"nexusws/cmd/kupon_tls_server/eventsink"
+	"nexusws/cmd/kupon_tls_server/kupon_errors"
+	"nexusws/cmd/kupon_tls_server/registry"
+	"nexusws/cmd/kupon_tls_server/sequence"
+	"nexusws/cmd/kupon_tls_server/signing"
+	"nexusws/cmd/kupon_tls_server/slipcheck"
+	"nexusws/cmd/kupon_tls_server/slipfields"
+	"nexusws/cmd/kupon_tls_server/sliplines"
 	"nexusws/pkg/nexus_errors"
-	"nexusws/pkg/nexushttpclient"
 	v13 "nexusws/pkg/nexushttpclient/v13"
+	"time"
 )
 
-func New(l log.Logger, nexusCl *nexushttpclient.SlipClient, msg []byte, msgLen int) *RawEcrSlipRecord {
+func New(l log.Logger, b backend.Backend, sink eventsink.Sink, seq *sequence.Tracker, opts *Options, msg []byte, msgLen int) *RawEcrSlipRecord {
 	e := &RawEcrSlipRecord{
 		rawMessage: make([]byte, SlipMaxMessageLength),
 		l:          l,
-		nexusCl:    nexusCl,
+		backend:    b,
+		sink:       sink,
+		sequence:   seq,
+		opts:       opts,
 	}
 	copy(e.rawMessage, msg)
 	e.rawMessageDataLen = msgLen
@@ -32,6 +44,14 @@ func (s *RawEcrSlipRecord) RawMessage() []byte {
 	return s.rawMessage[:s.rawMessageDataLen]
 }
 
+// EcrSerial is empty until the header is parsed.
+func (s *RawEcrSlipRecord) EcrSerial() string {
+	if s.Header13 == nil {
+		return ""
+	}
+	return s.Header13.EcrSerial
+}
+
 func (s *RawEcrSlipRecord) parseMessageGV13Header(headerLength int) error {
 	if s.rawMessageDataLen < headerLength {
 		return errors.New("header data less then expected")
@@ -50,42 +70,52 @@ func (s *RawEcrSlipRecord) parseMessageGV13Header(headerLength int) error {
 
 func (s *RawEcrSlipRecord) HandleMsgG(ctx context.Context, r io.ReadWriter) error {
 
+	// the protocol version gives the header length, it may not have been
+	// read yet
+	err := s.readAtLeast(r, SlipRecordProtocolLast)
+	if err != nil {
+		return err
+	}
 	s.protVersion = string(s.rawMessage[SlipRecordProtocolOffset:SlipRecordProtocolLast])
 
-	headerLength := SlipRecordV13HeaderLength
+	var headerLength, maxLength int
+	switch s.protVersion {
+	case ProtocolV13:
+		headerLength, maxLength = SlipRecordV13HeaderLength, SlipMaxMessageLength
+	case ProtocolV14, ProtocolV15:
+		headerLength, maxLength = SlipRecordV14HeaderLength, SlipV14MaxMessageLength
+	default:
+		s.errorCode = kupon_errors.ErrUnsupportedProtocolVersion
+		s.sendNack(r, s.errorCode)
+		return fmt.Errorf("unsupported protocol version %q", s.protVersion)
+	}
+	s.signed = s.rawMessage[SlipRecordIdentifierOffset] == SlipRecordSignedMessageIdentifier
 
 	//if we haven't read the whole header, try to read it now
-	if s.rawMessageDataLen < headerLength {
-		for {
-			headerLen, rerr := r.Read(s.rawMessage[s.rawMessageDataLen:])
-			if rerr != nil {
-				if rerr == io.EOF {
-					s.rawMessageDataLen += headerLen
-					break
-				}
-				s.errorCode = nexus_errors.ErrUnableToReadDataFromNetwork
-				s.sendNack(r, s.errorCode)
-				return rerr
-			}
-
-			s.rawMessageDataLen += headerLen
-			if s.rawMessageDataLen >= headerLength { //meaning we have already read past the header
-				break
-			}
-		}
+	err = s.readAtLeast(r, headerLength)
+	if err != nil {
+		return err
 	}
 
-	err := s.parseMessageGV13Header(headerLength)
+	if s.protVersion != ProtocolV13 {
+		err = s.parseMessageGV14Header(headerLength)
+	} else {
+		err = s.parseMessageGV13Header(headerLength)
+	}
 	if err != nil {
 		return err
 	}
 
-	totalMessageLengthExpected := s.Header13.MessageLength + headerLength + SlipRecordCheckSumLength
+	totalMessageLengthExpected := s.Header13.MessageLength + headerLength + s.check.Length()
+	if s.signed {
+		totalMessageLengthExpected += signing.TrailerLength
+	}
 
-	if totalMessageLengthExpected > SlipMaxMessageLength {
+	if totalMessageLengthExpected > maxLength {
 		err := errors.New("total message length is bigger then maximum allowed")
 		return err
 	}
+	s.grow(totalMessageLengthExpected)
 
 	// if we haven't reveived the total message then try here
 	if s.rawMessageDataLen < totalMessageLengthExpected {
@@ -135,9 +165,9 @@ func (s *RawEcrSlipRecord) HandleMsgG(ctx context.Context, r io.ReadWriter) erro
 
 	cOffset := headerLength + s.Header13.MessageLength
 
-	s.Checksum = string(s.rawMessage[cOffset:s.rawMessageDataLen])
+	s.Checksum = string(s.rawMessage[cOffset : cOffset+s.check.Length()])
 
-	cs := checksum.CalcXorChecksum(s.rawMessage[SlipRecordIdentifierOffset : headerLength+s.Header13.MessageLength])
+	cs := s.check.Sum(s.rawMessage[SlipRecordIdentifierOffset : headerLength+s.Header13.MessageLength])
 	if cs != s.Checksum {
 		err = errors.New("checksums do not match")
 		s.sendNack(r, nexus_errors.ErrChecksumError)
@@ -146,50 +176,94 @@ func (s *RawEcrSlipRecord) HandleMsgG(ctx context.Context, r io.ReadWriter) erro
 		return err
 	}
 
-	body, _ := json.Marshal(s.v13SlipRecord)
-	//level.Info(s.l).Log("info", string(body))
-
-	sr := &nexushttpclient.SlipDataRawInsertReq{
-		Ecridentificationnumber: s.v13SlipRecord.Header.EcrSerial,
-		Firstrecordnumber:       "",
-		Lastrecordnumber:        "",
-		Recordtype:              s.v13SlipRecord.Header.TypeIdentifier,
-		RawSlipData:             hex.EncodeToString(s.rawMessage[:s.rawMessageDataLen]),
+	ctx, s.l, err = s.opts.Registry.AdmitFrame(ctx, s.l, s.Header13.EcrSerial, s.protVersion)
+	if err != nil {
+		level.Error(s.l).Log("error", err)
+		s.errorCode = registry.NackCode(err, nexus_errors.ErrUnableToSaveSlipData)
+		s.sendNack(r, s.errorCode)
+		return err
 	}
-	sresp, err := s.nexusCl.SlipRawInsert(ctx, sr)
+
+	err = s.opts.Keys.Check(s.Header13.EcrSerial, s.RawMessage(), s.signed, time.Now())
 	if err != nil {
+		level.Error(s.l).Log("error", err, "signed", s.signed)
+		s.errorCode = signing.NackCode(err)
+		s.sendNack(r, s.errorCode)
 		return err
 	}
-	if sresp.ErrorCode != 0 {
-		err = errors.New(sresp.ErrorMessage)
 
-		level.Error(s.l).Log("info", string(body))
-		level.Error(s.l).Log("error", errors.New(sresp.ErrorMessage))
-		s.sendNack(r, nexus_errors.ErrWSSlipError)
+	if s.opts.JSONFormat == slipfields.FormatTyped {
+		s.typed, err = slipfields.Convert(s.message, s.opts.Schema)
+		if err != nil {
+			level.Error(s.l).Log("error", err)
+			s.errorCode = kupon_errors.ErrInvalidFieldValue
+			s.sendNack(r, s.errorCode)
+			return err
+		}
+	}
+
+	err = s.validate()
+	if err != nil {
+		level.Error(s.l).Log("error", err)
+		s.sendNack(r, s.errorCode)
 		return err
 	}
 
-	sresp, err = s.nexusCl.SlipJSONInsert13(ctx, s.v13SlipRecord)
+	body, _ := json.Marshal(s.message)
+	//level.Info(s.l).Log("info", string(body))
 
+	err = s.backend.InsertSlip(ctx, s.message, s.typed, s.RawMessage())
 	if err != nil {
-		level.Info(s.l).Log("info", string(body))
+		level.Error(s.l).Log("info", string(body))
 		level.Error(s.l).Log("error", err)
 
-		s.sendNack(r, nexus_errors.ErrUnableToSaveSlipData)
+		s.sendNack(r, backend.NackCode(err, nexus_errors.ErrUnableToSaveSlipData))
 		return err
 	}
-	if sresp.ErrorCode != 0 {
-		level.Error(s.l).Log("err", string(body))
-		level.Error(s.l).Log("err", errors.New(sresp.ErrorMessage))
 
-		s.sendNack(r, nexus_errors.ErrWSSlipError)
-		return errors.New(sresp.ErrorMessage)
+	if s.sink != nil {
+		var payload interface{} = s.message
+		if s.typed != nil {
+			payload = s.typed
+		}
+		e := eventsink.NewEvent(ctx, eventsink.EventSlipRecord, s.message.Header.EcrSerial, payload, s.RawMessage())
+		err = s.sink.Write(ctx, e)
+		if err != nil {
+			level.Error(s.l).Log("msg", "event sink", "trace_id", e.TraceID, "ecrSerial", e.EcrSerial, "error", err)
+		}
+	}
+
+	if s.sequence != nil {
+		// gaps are only reported, they never fail a message that was saved
+		err = s.sequence.Observe(s.Header13.EcrSerial, s.message.Records)
+		if err != nil {
+			level.Error(s.l).Log("error", err)
+		}
 	}
 
 	err = s.sendAck(r)
 	if err != nil {
 		return err
 	}
+
+	return s.sendResendRequest(r)
+}
+
+// readAtLeast reads until n bytes of the frame are in, or the register
+// stops sending. A frame that is too short fails later on its length.
+func (s *RawEcrSlipRecord) readAtLeast(r io.ReadWriter, n int) error {
+	for s.rawMessageDataLen < n {
+		l, rerr := r.Read(s.rawMessage[s.rawMessageDataLen:])
+		s.rawMessageDataLen += l
+		if rerr == io.EOF {
+			return nil
+		}
+		if rerr != nil {
+			s.errorCode = nexus_errors.ErrUnableToReadDataFromNetwork
+			s.sendNack(r, s.errorCode)
+			return rerr
+		}
+	}
 	return nil
 }
 
@@ -199,11 +273,14 @@ func (s *RawEcrSlipRecord) parseBody(ctx context.Context, headerLength int) erro
 
 	if s.Header13.TypeIdentifier == "4" { // multi record
 
-		s.v13SlipRecord = &v13.MessageG{
+		s.message = &sliplines.Message{
 			Header:   s.Header13,
-			Records:  make([]v13.SlipRecord, 0),
+			Records:  make([]sliplines.Record, 0),
 			Checksum: s.Checksum,
 		}
+		if s.protVersion != ProtocolV13 {
+			return s.parseV14(body)
+		}
 		return s.parseV13(body)
 
 	} else if s.Header13.TypeIdentifier == "5" { // request lottery data
@@ -240,521 +317,372 @@ func (s *RawEcrSlipRecord) sendAck(r io.ReadWriter) error {
 	return nil
 }
 
-func (s *RawEcrSlipRecord) parseV13(data []byte) error {
+// validate runs the configured slip checks. Failures are logged, in reject
+// mode the first one is returned with s.errorCode set to its NACK code.
+func (s *RawEcrSlipRecord) validate() error {
+	v := s.opts.Validator
+	if v == nil || v.Mode() == slipcheck.ModeOff {
+		return nil
+	}
 
-	splitLinesFunc := func(c rune) bool {
-		return c == '\n'
+	typed := s.typed
+	if typed == nil {
+		var err error
+		typed, err = slipfields.Convert(s.message, s.opts.Schema)
+		if err != nil {
+			if v.Mode() == slipcheck.ModeReject {
+				s.errorCode = kupon_errors.ErrInvalidFieldValue
+				return err
+			}
+			// check what did convert
+			level.Warn(s.l).Log("validation", err)
+		}
 	}
-	rawlines := bytes.FieldsFunc(data, splitLinesFunc)
+
+	failures := v.Check(typed)
+	for _, f := range failures {
+		level.Warn(s.l).Log("validation", f.Error(), "mode", v.Mode())
+	}
+	if len(failures) > 0 && v.Mode() == slipcheck.ModeReject {
+		s.errorCode = failures[0].Code
+		return failures[0]
+	}
+	return nil
+}
+
+// sendResendRequest follows the ACK with a resend request for the oldest open
+// gap of the register, if there is one. Only registers that set
+// SlipRecordV14FlagResend read it, the gaps of the others are left open for
+// the operators.
+func (s *RawEcrSlipRecord) sendResendRequest(r io.ReadWriter) error {
+	if s.sequence == nil || !s.resend {
+		return nil
+	}
+	gap, err := s.sequence.NextRequest(s.Header13.EcrSerial)
+	if err != nil {
+		level.Error(s.l).Log("error", err)
+		return nil
+	}
+	if gap == nil {
+		return nil
+	}
+
+	resp, err := NewResendResponse(s.protVersion, s.check, gap).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = r.Write(resp)
+	if err != nil {
+		level.Error(s.l).Log("err", err)
+		return err
+	}
+	level.Info(s.l).Log("resend", gap.Kind, "zReport", gap.ZReport, "from", gap.From, "to", gap.To)
+	return nil
+}
+
+// headedLinesV13 are the v13 lines that start with a record header.
+const headedLinesV13 = "ABCDEFGHIJKLMST"
+
+func (s *RawEcrSlipRecord) parseV13(data []byte) error {
+	return s.parseLines(data, s.parseLineV13, headedLinesV13)
+}
+
+// parseLines splits the body in lines and parses them with parseLine,
+// keeping the lines that fail in lenient parsing. headed are the lines that
+// start with a record header.
+func (s *RawEcrSlipRecord) parseLines(data []byte, parseLine func([]byte) error, headed string) error {
+
+	rawlines := bytes.Split(data, []byte{'\n'})
 
 	isNull := func(c rune) bool {
 		return c == 0
 	}
-	for _, r := range rawlines {
+	// text fields are decoded to UTF-8 here, RawMessage keeps the bytes as sent
+	var tc *charset.Transcoder
+	if s.opts.Charset != nil {
+		var err error
+		tc, err = s.opts.Charset.For(s.Header13.EcrSerial, s.protVersion)
+		if err != nil {
+			s.errorCode = kupon_errors.ErrUnsupportedCharset
+			return err
+		}
+	}
+
+	s.prev = nil
+	s.unparsed = nil
+	for i, r := range rawlines {
 		// remove null characters
 		r = bytes.TrimFunc(r, isNull)
-		if r != nil {
-			switch line := r[0]; line {
-			case 'A', 'a':
-				lineA, h, err := v13.NewLineA(r[1:])
-				if err != nil {
-					s.errorCode = nexus_errors.ErrWrongNumberOfFields
-					return err
-				}
-				foundLine := false
-				for i, t := range s.v13SlipRecord.Records {
-					if t.DailySlipNo == h.DailySlipNo &&
-						t.SlipSerial == h.SlipSerial &&
-						t.ZReport == h.ZReport &&
-						t.Mac == h.Mac {
-						s.v13SlipRecord.Records[i].LineA = lineA
-						foundLine = true
-					}
-				}
-				if !foundLine {
-					sr := v13.SlipRecord{
-						LineA:                     lineA,
-						IsTransmittedInBackground: line == 'a',
-					}
-					sr.Mac = h.Mac
-					sr.ZReport = h.ZReport
-					sr.SlipSerial = h.SlipSerial
-					sr.DailySlipNo = h.DailySlipNo
-					s.v13SlipRecord.Records = append(s.v13SlipRecord.Records, sr)
-				}
-			case 'B', 'b':
-				{
-					line1, h, err := v13.NewLineB(r[1:])
-					if err != nil {
-						s.errorCode = nexus_errors.ErrWrongNumberOfFields
-						return err
-					}
-					foundLine := false
-
-					for i, t := range s.v13SlipRecord.Records {
-						if t.DailySlipNo == h.DailySlipNo &&
-							t.SlipSerial == h.SlipSerial &&
-							t.ZReport == h.ZReport &&
-							t.Mac == h.Mac {
-							s.v13SlipRecord.Records[i].LineB = append(s.v13SlipRecord.Records[i].LineB, *line1)
-							foundLine = true
-						}
-					}
-
-					if !foundLine {
-						sr := v13.SlipRecord{
-							LineB:                     make([]v13.LineB, 0),
-							IsTransmittedInBackground: line == 'b',
-						}
-						sr.Mac = h.Mac
-						sr.ZReport = h.ZReport
-						sr.SlipSerial = h.SlipSerial
-						sr.DailySlipNo = h.DailySlipNo
-						s.v13SlipRecord.Records = append(s.v13SlipRecord.Records, sr)
-						recordIndex := len(s.v13SlipRecord.Records) - 1
-						s.v13SlipRecord.Records[recordIndex].LineB = append(s.v13SlipRecord.Records[recordIndex].LineB, *line1)
-					}
-				}
-			case 'C', 'c':
-				{
-					line2, h, err := v13.NewLineC(r[1:])
-					if err != nil {
-						s.errorCode = nexus_errors.ErrWrongNumberOfFields
-						return err
-					}
-					foundLine := false
-					for i, t := range s.v13SlipRecord.Records {
-						if t.DailySlipNo == h.DailySlipNo &&
-							t.SlipSerial == h.SlipSerial &&
-							t.ZReport == h.ZReport &&
-							t.Mac == h.Mac {
-							s.v13SlipRecord.Records[i].LineC = append(s.v13SlipRecord.Records[i].LineC, *line2)
-
-							foundLine = true
-						}
-					}
-					if !foundLine {
-						sr := v13.SlipRecord{
-							LineC:                     make([]v13.LineC, 0),
-							IsTransmittedInBackground: line == 'c',
-						}
-						sr.Mac = h.Mac
-						sr.ZReport = h.ZReport
-						sr.SlipSerial = h.SlipSerial
-						sr.DailySlipNo = h.DailySlipNo
-						s.v13SlipRecord.Records = append(s.v13SlipRecord.Records, sr)
-						recordIndex := len(s.v13SlipRecord.Records) - 1
-						s.v13SlipRecord.Records[recordIndex].LineC = append(s.v13SlipRecord.Records[recordIndex].LineC, *line2)
-					}
-				}
-			case 'D', 'd':
-				{
-					line5, h, err := v13.NewLineD(r[1:])
-					if err != nil {
-						s.errorCode = nexus_errors.ErrWrongNumberOfFields
-						return err
-					}
-
-					foundLine := false
-
-					for i, t := range s.v13SlipRecord.Records {
-						if t.DailySlipNo == h.DailySlipNo &&
-							t.SlipSerial == h.SlipSerial &&
-							t.ZReport == h.ZReport &&
-							t.Mac == h.Mac {
-							s.v13SlipRecord.Records[i].LineD = line5
-							foundLine = true
-						}
-					}
-					if !foundLine {
-						sr := v13.SlipRecord{
-							LineD:                     line5,
-							IsTransmittedInBackground: line == 'd',
-						}
-						sr.Mac = h.Mac
-						sr.ZReport = h.ZReport
-						sr.SlipSerial = h.SlipSerial
-						sr.DailySlipNo = h.DailySlipNo
-						s.v13SlipRecord.Records = append(s.v13SlipRecord.Records, sr)
-					}
-				}
-			case 'E', 'e':
-				{
-					line6, h, err := v13.NewLineE(r[1:])
-					if err != nil {
-						s.errorCode = nexus_errors.ErrWrongNumberOfFields
-						return err
-					}
-
-					foundLine := false
-
-					for i, t := range s.v13SlipRecord.Records {
-						if t.DailySlipNo == h.DailySlipNo &&
-							t.SlipSerial == h.SlipSerial &&
-							t.ZReport == h.ZReport &&
-							t.Mac == h.Mac {
-							s.v13SlipRecord.Records[i].LineE = line6
-
-							foundLine = true
-						}
-					}
-
-					if !foundLine {
-						sr := v13.SlipRecord{
-							LineE:                     line6,
-							IsTransmittedInBackground: line == 'e',
-						}
-						sr.Mac = h.Mac
-						sr.ZReport = h.ZReport
-						sr.SlipSerial = h.SlipSerial
-						sr.DailySlipNo = h.DailySlipNo
-						s.v13SlipRecord.Records = append(s.v13SlipRecord.Records, sr)
-					}
+		if len(r) == 0 {
+			continue
+		}
+		text, err := tc.Bytes(r)
+		if err != nil {
+			s.errorCode = kupon_errors.ErrInvalidFieldValue
+		} else {
+			r = text
+			err = parseLine(r)
+		}
+		if err != nil {
+			if s.opts.Parsing != ParsingLenient {
+				return fmt.Errorf("line %d: %w", i+1, err)
+			}
+			level.Warn(s.l).Log("msg", "keeping unparsed slip line", "line", i+1, "err", err, "raw", string(r))
+			s.errorCode = 0
+			s.keepUnparsed(r, headed)
+		}
 
+		// lines before the first slip are kept on it
+		if len(s.unparsed) > 0 {
+			if j := s.prev.find(s.message.Records); j >= 0 {
+				rec := &s.message.Records[j]
+				rec.UnparsedLines = append(s.unparsed, rec.UnparsedLines...)
+				s.unparsed = nil
+			}
+		}
+	}
+	if len(s.unparsed) > 0 {
+		level.Warn(s.l).Log("msg", "dropping unparsed slip lines without record", "lines", len(s.unparsed))
+		s.unparsed = nil
+	}
+	return nil
+}
+
+// keepUnparsed stores a line that could not be parsed on the record of its
+// slip. A line with a header belongs to the slip in it, other lines to the
+// slip of the last line with a header, or to the first slip when they come
+// before it.
+func (s *RawEcrSlipRecord) keepUnparsed(r []byte, headed string) {
+	k, hasHeader := lineKey(r, headed)
+	switch {
+	case k != nil:
+		s.prev = k
+		rec := s.recordFor(k, r[0] >= 'a')
+		rec.UnparsedLines = append(rec.UnparsedLines, string(r))
+		return
+	case hasHeader:
+		// the slip of the line is not known, neither is that of the
+		// lines without a header after it
+		s.prev = &recordKey{}
+	case s.prev == nil:
+		s.unparsed = append(s.unparsed, string(r))
+		return
+	}
+
+	i := s.prev.find(s.message.Records)
+	if i < 0 {
+		level.Warn(s.l).Log("msg", "dropping unparsed slip line without record", "raw", string(r))
+		return
+	}
+	s.message.Records[i].UnparsedLines = append(s.message.Records[i].UnparsedLines, string(r))
+}
+
+// parseLineV13 parses one line and adds it to its record. On failure
+// s.errorCode is set to the NACK code for the line.
+func (s *RawEcrSlipRecord) parseLineV13(r []byte) error {
+	switch line := r[0]; line {
+	case 'A', 'a':
+		{
+			lineA, h, err := v13.NewLineA(r[1:])
+			if err != nil {
+				s.errorCode = nexus_errors.ErrWrongNumberOfFields
+				return err
+			}
+			s.prev = &recordKey{Mac: h.Mac, ZReport: h.ZReport, SlipSerial: h.SlipSerial, DailySlipNo: h.DailySlipNo}
+			s.recordFor(s.prev, line == 'a').LineA = lineA
+		}
+	case 'B', 'b':
+		{
+			lineB, h, err := v13.NewLineB(r[1:])
+			if err != nil {
+				s.errorCode = nexus_errors.ErrWrongNumberOfFields
+				return err
+			}
+			s.prev = &recordKey{Mac: h.Mac, ZReport: h.ZReport, SlipSerial: h.SlipSerial, DailySlipNo: h.DailySlipNo}
+			rec := s.recordFor(s.prev, line == 'b')
+			rec.LineB = append(rec.LineB, *lineB)
+		}
+	case 'C', 'c':
+		{
+			lineC, h, err := v13.NewLineC(r[1:])
+			if err != nil {
+				s.errorCode = nexus_errors.ErrWrongNumberOfFields
+				return err
+			}
+			s.prev = &recordKey{Mac: h.Mac, ZReport: h.ZReport, SlipSerial: h.SlipSerial, DailySlipNo: h.DailySlipNo}
+			rec := s.recordFor(s.prev, line == 'c')
+			rec.LineC = append(rec.LineC, *lineC)
+		}
+	case 'D', 'd':
+		{
+			lineD, h, err := v13.NewLineD(r[1:])
+			if err != nil {
+				s.errorCode = nexus_errors.ErrWrongNumberOfFields
+				return err
+			}
+			s.prev = &recordKey{Mac: h.Mac, ZReport: h.ZReport, SlipSerial: h.SlipSerial, DailySlipNo: h.DailySlipNo}
+			s.recordFor(s.prev, line == 'd').LineD = lineD
+		}
+	case 'E', 'e':
+		{
+			lineE, h, err := v13.NewLineE(r[1:])
+			if err != nil {
+				s.errorCode = nexus_errors.ErrWrongNumberOfFields
+				return err
+			}
+			s.prev = &recordKey{Mac: h.Mac, ZReport: h.ZReport, SlipSerial: h.SlipSerial, DailySlipNo: h.DailySlipNo}
+			s.recordFor(s.prev, line == 'e').LineE = lineE
+		}
+	case 'F', 'f':
+		{
+			lineF, h, err := v13.NewLineF(r[1:])
+			if err != nil {
+				s.errorCode = nexus_errors.ErrWrongNumberOfFields
+				return err
+			}
+			s.prev = &recordKey{Mac: h.Mac, ZReport: h.ZReport, SlipSerial: h.SlipSerial, DailySlipNo: h.DailySlipNo}
+			s.recordFor(s.prev, line == 'f').LineF = lineF
+		}
+	case 'G', 'g':
+		{
+			lineG, h, err := v13.NewLineG(r[1:])
+			if err != nil {
+				s.errorCode = nexus_errors.ErrWrongNumberOfFields
+				return err
+			}
+			s.prev = &recordKey{Mac: h.Mac, ZReport: h.ZReport, SlipSerial: h.SlipSerial, DailySlipNo: h.DailySlipNo}
+			s.recordFor(s.prev, line == 'g').LineG = lineG
+		}
+	case 'H', 'h':
+		{
+			lineH, h, err := v13.NewLineH(r[1:])
+			if err != nil {
+				s.errorCode = nexus_errors.ErrWrongNumberOfFields
+				return err
+			}
+			s.prev = &recordKey{Mac: h.Mac, ZReport: h.ZReport, SlipSerial: h.SlipSerial, DailySlipNo: h.DailySlipNo}
+			s.recordFor(s.prev, line == 'h').LineH = lineH
+		}
+	case 'I', 'i':
+		{
+			lineI, h, err := v13.NewLineI(r[1:])
+			if err != nil {
+				s.errorCode = nexus_errors.ErrWrongNumberOfFields
+				return err
+			}
+			s.prev = &recordKey{Mac: h.Mac, ZReport: h.ZReport, SlipSerial: h.SlipSerial, DailySlipNo: h.DailySlipNo}
+			s.recordFor(s.prev, line == 'i').LineI = lineI
+		}
+	case 'J', 'j':
+		{
+			lineJ, h, err := v13.NewLineJ(r[1:])
+			if err != nil {
+				s.errorCode = nexus_errors.ErrWrongNumberOfFields
+				return err
+			}
+			s.prev = &recordKey{Mac: h.Mac, ZReport: h.ZReport, SlipSerial: h.SlipSerial, DailySlipNo: h.DailySlipNo}
+			s.recordFor(s.prev, line == 'j').LineJ = lineJ
+		}
+	case 'K', 'k':
+		{
+			lineK, h, err := sliplines.NewLineK(r[1:])
+			if err != nil {
+				s.errorCode = lineErrorCode(err)
+				return err
+			}
+			s.prev = &recordKey{Mac: h.Mac, ZReport: h.ZReport, SlipSerial: h.SlipSerial, DailySlipNo: h.DailySlipNo}
+			s.recordFor(s.prev, line == 'k').LineK = lineK
+		}
+	case 'L', 'l':
+		{
+			lineL, h, err := sliplines.NewLineL(r[1:])
+			if err != nil {
+				s.errorCode = lineErrorCode(err)
+				return err
+			}
+			s.prev = &recordKey{Mac: h.Mac, ZReport: h.ZReport, SlipSerial: h.SlipSerial, DailySlipNo: h.DailySlipNo}
+			s.recordFor(s.prev, line == 'l').LineL = lineL
+		}
+	case 'M', 'm':
+		{
+			line9, h, err := v13.NewLineM(r[1:])
+			if err != nil {
+				s.errorCode = nexus_errors.ErrWrongNumberOfFields
+				return err
+			}
+			s.prev = &recordKey{Mac: h.Mac, ZReport: h.ZReport, SlipSerial: h.SlipSerial, DailySlipNo: h.DailySlipNo}
+
+			foundLine := false
+			for i, t := range s.message.Records {
+				if t.ZReport == h.ZReport &&
+					t.Mac == h.Mac &&
+					t.LineM != nil &&
+					t.LineM.RecordNo == line9.RecordNo {
+					s.message.Records[i].LineM = line9
+
+					foundLine = true
 				}
-			case 'F', 'f':
-				{
-					line7, h, err := v13.NewLineF(r[1:])
-					if err != nil {
-						s.errorCode = nexus_errors.ErrWrongNumberOfFields
-						return err
-					}
-					foundLine := false
-					for i, t := range s.v13SlipRecord.Records {
-						if t.DailySlipNo == h.DailySlipNo &&
-							t.SlipSerial == h.SlipSerial &&
-							t.ZReport == h.ZReport &&
-							t.Mac == h.Mac {
-							s.v13SlipRecord.Records[i].LineF = line7
-
-							foundLine = true
-						}
-					}
-					if !foundLine {
-						sr := v13.SlipRecord{
-							LineF:                     line7,
-							IsTransmittedInBackground: line == 'f',
-						}
-						sr.Mac = h.Mac
-						sr.ZReport = h.ZReport
-						sr.SlipSerial = h.SlipSerial
-						sr.DailySlipNo = h.DailySlipNo
-						s.v13SlipRecord.Records = append(s.v13SlipRecord.Records, sr)
-					}
-				}
-			case 'G', 'g':
-				{
-					line8, h, err := v13.NewLineG(r[1:])
-					if err != nil {
-						s.errorCode = nexus_errors.ErrWrongNumberOfFields
-						return err
-					}
-
-					foundLine := false
-					for i, t := range s.v13SlipRecord.Records {
-						if t.DailySlipNo == h.DailySlipNo &&
-							t.SlipSerial == h.SlipSerial &&
-							t.ZReport == h.ZReport &&
-							t.Mac == h.Mac {
-							s.v13SlipRecord.Records[i].LineG = line8
-
-							foundLine = true
-						}
-					}
-
-					if !foundLine {
-						sr := v13.SlipRecord{
-							LineG:                     line8,
-							IsTransmittedInBackground: line == 'g',
-						}
-						sr.Mac = h.Mac
-						sr.ZReport = h.ZReport
-						sr.SlipSerial = h.SlipSerial
-						sr.DailySlipNo = h.DailySlipNo
-						s.v13SlipRecord.Records = append(s.v13SlipRecord.Records, sr)
-					}
-				}
-			case 'H', 'h':
-				{
-					line9, h, err := v13.NewLineH(r[1:])
-					if err != nil {
-						s.errorCode = nexus_errors.ErrWrongNumberOfFields
-						return err
-					}
-
-					foundLine := false
-					for i, t := range s.v13SlipRecord.Records {
-						if t.DailySlipNo == h.DailySlipNo &&
-							t.SlipSerial == h.SlipSerial &&
-							t.ZReport == h.ZReport &&
-							t.Mac == h.Mac {
-							s.v13SlipRecord.Records[i].LineH = line9
-
-							foundLine = true
-						}
-					}
-					if !foundLine {
-						sr := v13.SlipRecord{
-							LineH:                     line9,
-							IsTransmittedInBackground: line == 'h',
-						}
-						sr.Mac = h.Mac
-						sr.ZReport = h.ZReport
-						sr.SlipSerial = h.SlipSerial
-						sr.DailySlipNo = h.DailySlipNo
-						s.v13SlipRecord.Records = append(s.v13SlipRecord.Records, sr)
-					}
-				}
-			case 'I', 'i':
-				{
-					line9, h, err := v13.NewLineI(r[1:])
-					if err != nil {
-						return err
-					}
-
-					foundLine := false
-					for i, t := range s.v13SlipRecord.Records {
-						if t.DailySlipNo == h.DailySlipNo &&
-							t.SlipSerial == h.SlipSerial &&
-							t.ZReport == h.ZReport &&
-							t.Mac == h.Mac {
-							s.v13SlipRecord.Records[i].LineI = line9
-
-							foundLine = true
-						}
-					}
-					if !foundLine {
-						sr := v13.SlipRecord{
-							LineI:                     line9,
-							IsTransmittedInBackground: line == 'i',
-						}
-						sr.Mac = h.Mac
-						sr.ZReport = h.ZReport
-						sr.SlipSerial = h.SlipSerial
-						sr.DailySlipNo = h.DailySlipNo
-						s.v13SlipRecord.Records = append(s.v13SlipRecord.Records, sr)
-					}
-				}
-			case 'J', 'j':
-				{
-					line9, h, err := v13.NewLineJ(r[1:])
-					if err != nil {
-						return err
-					}
-
-					foundLine := false
-					for i, t := range s.v13SlipRecord.Records {
-						if t.DailySlipNo == h.DailySlipNo &&
-							t.SlipSerial == h.SlipSerial &&
-							t.ZReport == h.ZReport &&
-							t.Mac == h.Mac {
-							s.v13SlipRecord.Records[i].LineJ = line9
-
-							foundLine = true
-						}
-					}
-					if !foundLine {
-						sr := v13.SlipRecord{
-							LineJ:                     line9,
-							IsTransmittedInBackground: line == 'j',
-						}
-						sr.Mac = h.Mac
-						sr.ZReport = h.ZReport
-						sr.SlipSerial = h.SlipSerial
-						sr.DailySlipNo = h.DailySlipNo
-						s.v13SlipRecord.Records = append(s.v13SlipRecord.Records, sr)
-					}
-				}
-			//case 'K', 'k':
-			//	{
-			//		line9, h, err := v13.NewLine9(r[1:])
-			//		if err != nil {
-			//			return err
-			//		}
-			//
-			//		foundLine := false
-			//		for i, t := range s.v13SlipRecord.Records {
-			//			if t.DailySlipNo == h.DailySlipNo &&
-			//				t.SlipSerial == h.SlipSerial &&
-			//				t.ZReport == h.ZReport &&
-			//				t.Mac == h.Mac {
-			//				s.v13SlipRecord.Records[i].L9 = line9
-			//
-			//				foundLine = true
-			//			}
-			//		}
-			//		if !foundLine {
-			//			sr := v13.SlipRecord{
-			//				L9: line9,
-			//			}
-			//			sr.Mac = h.Mac
-			//			sr.ZReport = h.ZReport
-			//			sr.SlipSerial = h.SlipSerial
-			//			sr.DailySlipNo = h.DailySlipNo
-			//			sr.EcrSerial = h.EcrSerial
-			//			s.v13SlipRecord.Records = append(s.v13SlipRecord.Records, sr)
-			//		}
-			//	}
-			//case 'L', 'l':
-			//	{
-			//		line9, h, err := v13.NewLine9(r[1:])
-			//		if err != nil {
-			//			return err
-			//		}
-			//
-			//		foundLine := false
-			//		for i, t := range s.v13SlipRecord.Records {
-			//			if t.DailySlipNo == h.DailySlipNo &&
-			//				t.SlipSerial == h.SlipSerial &&
-			//				t.ZReport == h.ZReport &&
-			//				t.Mac == h.Mac {
-			//				s.v13SlipRecord.Records[i].L9 = line9
-			//
-			//				foundLine = true
-			//			}
-			//		}
-			//		if !foundLine {
-			//			sr := v13.SlipRecord{
-			//				L9: line9,
-			//			}
-			//			sr.Mac = h.Mac
-			//			sr.ZReport = h.ZReport
-			//			sr.SlipSerial = h.SlipSerial
-			//			sr.DailySlipNo = h.DailySlipNo
-			//			sr.EcrSerial = h.EcrSerial
-			//			s.v13SlipRecord.Records = append(s.v13SlipRecord.Records, sr)
-			//		}
-			//	}
-			case 'M', 'm':
-				{
-					line9, h, err := v13.NewLineM(r[1:])
-					if err != nil {
-						s.errorCode = nexus_errors.ErrWrongNumberOfFields
-						return err
-					}
-
-					foundLine := false
-					for i, t := range s.v13SlipRecord.Records {
-						if t.ZReport == h.ZReport &&
-							t.Mac == h.Mac &&
-							t.LineM != nil &&
-							t.LineM.RecordNo == line9.RecordNo {
-							s.v13SlipRecord.Records[i].LineM = line9
-
-							foundLine = true
-						}
-					}
-					if !foundLine {
-						sr := v13.SlipRecord{
-							LineM:                     line9,
-							IsTransmittedInBackground: line == 'm',
-						}
-						sr.Mac = h.Mac
-						sr.ZReport = h.ZReport
-						sr.SlipSerial = h.SlipSerial
-						sr.DailySlipNo = h.DailySlipNo
-						s.v13SlipRecord.Records = append(s.v13SlipRecord.Records, sr)
-					}
-				}
-			case 'N', 'n':
-				{
-					//TODO versioni aktual i protokollit nuk ka header per kete rresht
-					//line9, h, err := v13.NewLineN(r[1:])
-					//if err != nil {
-					//	return err
-					//}
-					//
-					//foundLine := false
-					//for i, t := range s.v13SlipRecord.Records {
-					//	if t.DailySlipNo == h.DailySlipNo &&
-					//		t.SlipSerial == h.SlipSerial &&
-					//		t.ZReport == h.ZReport &&
-					//		t.Mac == h.Mac {
-					//		s.v13SlipRecord.Records[i].LineN = line9
-					//
-					//		foundLine = true
-					//	}
-					//}
-					//if !foundLine {
-					//	sr := v13.SlipRecord{
-					//		LineN:                     line9,
-					//		IsTransmittedInBackground: line == 'n',
-					//	}
-					//	sr.Mac = h.Mac
-					//	sr.ZReport = h.ZReport
-					//	sr.SlipSerial = h.SlipSerial
-					//	sr.DailySlipNo = h.DailySlipNo
-					//	s.v13SlipRecord.Records = append(s.v13SlipRecord.Records, sr)
-					//}
-				}
-			case 'S', 's':
-				{
-					level.Info(s.l).Log("LineS", hex.EncodeToString(r[1:]))
-					//line9, h, err := v13.NewLine9(r[1:])
-					//if err != nil {
-					//	return err
-					//}
-					//
-					//foundLine := false
-					//for i, t := range s.v13SlipRecord.Records {
-					//	if t.DailySlipNo == h.DailySlipNo &&
-					//		t.SlipSerial == h.SlipSerial &&
-					//		t.ZReport == h.ZReport &&
-					//		t.Mac == h.Mac {
-					//		s.v13SlipRecord.Records[i].L9 = line9
-					//
-					//		foundLine = true
-					//	}
-					//}
-					//if !foundLine {
-					//	sr := v13.SlipRecord{
-					//		L9: line9,
-					//	}
-					//	sr.Mac = h.Mac
-					//	sr.ZReport = h.ZReport
-					//	sr.SlipSerial = h.SlipSerial
-					//	sr.DailySlipNo = h.DailySlipNo
-					//	sr.EcrSerial = h.EcrSerial
-					//	s.v13SlipRecord.Records = append(s.v13SlipRecord.Records, sr)
-					//}
-				}
-			case 'T', 't':
-				{
-					line9, h, err := v13.NewLineT(r[1:])
-					if err != nil {
-						return err
-					}
-
-					foundLine := false
-					for i, t := range s.v13SlipRecord.Records {
-						if t.DailySlipNo == h.DailySlipNo &&
-							t.SlipSerial == h.SlipSerial &&
-							t.ZReport == h.ZReport &&
-							t.Mac == h.Mac {
-							s.v13SlipRecord.Records[i].LineT = line9
-
-							foundLine = true
-						}
-					}
-					if !foundLine {
-						sr := v13.SlipRecord{
-							LineT: line9,
-						}
-						sr.Mac = h.Mac
-						sr.ZReport = h.ZReport
-						sr.SlipSerial = h.SlipSerial
-						sr.DailySlipNo = h.DailySlipNo
-						s.v13SlipRecord.Records = append(s.v13SlipRecord.Records, sr)
-					}
-				}
-			default:
-				{
-					//TODO duhet
-					//s.errorCode = nexus_errors.ErrUnknownSlipLine
-					//return fmt.Errorf("unknown slip line %X", line)
-				}
 			}
+			if !foundLine {
+				sr := sliplines.Record{}
+				sr.LineM = line9
+				sr.IsTransmittedInBackground = line == 'm'
+				sr.Mac = h.Mac
+				sr.ZReport = h.ZReport
+				sr.SlipSerial = h.SlipSerial
+				sr.DailySlipNo = h.DailySlipNo
+				s.message.Records = append(s.message.Records, sr)
+			}
+		}
+	case 'N', 'n':
+		{
+			// N lines have no header in v13, they belong to the record
+			// of the last line before them that had one. A slip can have
+			// several.
+			lineN := sliplines.NewLineN(r[1:])
+			i := s.prev.find(s.message.Records)
+			if i < 0 {
+				// dropped like before N lines were parsed, the rest of the
+				// message is fine
+				level.Warn(s.l).Log("msg", "dropping N line without a preceding line with header", "raw", string(r))
+				return nil
+			}
+			s.message.Records[i].LineN = append(s.message.Records[i].LineN, *lineN)
+		}
+	case 'S', 's':
+		{
+			lineS, h, err := sliplines.NewLineS(r[1:])
+			if err != nil {
+				s.errorCode = lineErrorCode(err)
+				return err
+			}
+			s.prev = &recordKey{Mac: h.Mac, ZReport: h.ZReport, SlipSerial: h.SlipSerial, DailySlipNo: h.DailySlipNo}
+			s.recordFor(s.prev, line == 's').LineS = lineS
+		}
+	case 'T', 't':
+		{
+			lineT, h, err := v13.NewLineT(r[1:])
+			if err != nil {
+				s.errorCode = nexus_errors.ErrWrongNumberOfFields
+				return err
+			}
+			s.prev = &recordKey{Mac: h.Mac, ZReport: h.ZReport, SlipSerial: h.SlipSerial, DailySlipNo: h.DailySlipNo}
+			// T lines do not mark the record as sent in background
+			s.recordFor(s.prev, false).LineT = lineT
+		}
+	default:
+		{
+			s.errorCode = nexus_errors.ErrUnknownSlipLine
+			return fmt.Errorf("unknown slip line %q", line)
 		}
 	}
 	return nil
 }
+
+// lineErrorCode is the NACK code for an error of a sliplines parser.
+func lineErrorCode(err error) int {
+	if errors.Is(err, sliplines.ErrWrongNumberOfFields) {
+		return nexus_errors.ErrWrongNumberOfFields
+	}
+	return kupon_errors.ErrInvalidFieldValue
+}
@@ -0,0 +1,71 @@
+package sliprecord
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"nexusws/cmd/kupon_tls_server/framecheck"
+	"nexusws/cmd/kupon_tls_server/sliplines"
+	"nexusws/pkg/nexus_errors"
+	v13 "nexusws/pkg/nexushttpclient/v13"
+)
+
+// parseMessageGV14Header parses the v14 and v15 header into Header13, the
+// records of all versions are the same.
+func (s *RawEcrSlipRecord) parseMessageGV14Header(headerLength int) error {
+	if s.rawMessageDataLen < headerLength {
+		return errors.New("header data less then expected")
+	}
+
+	bodyLen := binary.LittleEndian.Uint32(s.rawMessage[SlipRecordV14LengthFieldOffset:SlipRecordV14LengthFieldLast])
+	if bodyLen > SlipV14MaxMessageLength {
+		return errors.New("total message length is bigger then maximum allowed")
+	}
+	s.Header13 = &v13.MessageGHeader{
+		MessageIdentifier: string(s.rawMessage[SlipRecordIdentifierOffset:SlipRecordIdentifierLast]),
+		ProtocolVersion:   string(s.rawMessage[SlipRecordProtocolOffset:SlipRecordProtocolLast]),
+		MessageLength:     int(bodyLen),
+		TypeIdentifier:    string(s.rawMessage[SlipRecordV14TypeOffset:SlipRecordV14TypeLast]),
+		EcrSerial:         string(s.rawMessage[SlipRecordV14EcrSerialOffset:SlipRecordV14EcrSerialLast]),
+	}
+	s.resend = s.rawMessage[SlipRecordV14FlagsOffset]&SlipRecordV14FlagResend != 0
+	s.check = framecheck.ForProtocolVersion(s.protVersion)
+	return nil
+}
+
+// grow makes room for a frame of n bytes, v14 frames can be larger than
+// the buffer New allocates.
+func (s *RawEcrSlipRecord) grow(n int) {
+	if n <= len(s.rawMessage) {
+		return
+	}
+	b := make([]byte, n)
+	copy(b, s.rawMessage[:s.rawMessageDataLen])
+	s.rawMessage = b
+}
+
+func (s *RawEcrSlipRecord) parseV14(data []byte) error {
+	return s.parseLines(data, s.parseLineV14, headedLinesV13+"N")
+}
+
+// parseLineV14 parses a v14 line. Only N lines differ from v13, they start
+// with the record header:
+//
+//	N Mac;ZReport;SlipSerial;DailySlipNo;<v13 N line fields>
+func (s *RawEcrSlipRecord) parseLineV14(r []byte) error {
+	line := r[0]
+	if line != 'N' && line != 'n' {
+		return s.parseLineV13(r)
+	}
+
+	f := bytes.SplitN(r[1:], []byte{';'}, 5)
+	if len(f) < 5 {
+		s.errorCode = nexus_errors.ErrWrongNumberOfFields
+		return errors.New("N line without header")
+	}
+	lineN := sliplines.NewLineN(f[4])
+	s.prev = &recordKey{Mac: string(f[0]), ZReport: string(f[1]), SlipSerial: string(f[2]), DailySlipNo: string(f[3])}
+	rec := s.recordFor(s.prev, line == 'n')
+	rec.LineN = append(rec.LineN, *lineN)
+	return nil
+}
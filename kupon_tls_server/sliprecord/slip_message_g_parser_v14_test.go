@@ -0,0 +1,124 @@
+package sliprecord
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/go-kit/kit/log"
+	"nexusws/cmd/kupon_tls_server/framecheck"
+	"nexusws/cmd/kupon_tls_server/frametest"
+	"nexusws/cmd/kupon_tls_server/kupon_errors"
+	"nexusws/cmd/kupon_tls_server/sequence"
+	"nexusws/cmd/kupon_tls_server/sliplines"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMessageGV14Header(t *testing.T) {
+	msg := []byte("G14\x00\x00\x00\x004ECR0000001\x01")
+	binary.LittleEndian.PutUint32(msg[SlipRecordV14LengthFieldOffset:], 70000)
+
+	s := New(log.NewNopLogger(), nil, nil, nil, &Options{}, msg, len(msg))
+	err := s.parseMessageGV14Header(SlipRecordV14HeaderLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.Header13
+	if h.ProtocolVersion != "14" || h.MessageLength != 70000 || h.TypeIdentifier != "4" || h.EcrSerial != "ECR0000001" {
+		t.Errorf("header %+v", h)
+	}
+	if s.check != framecheck.XOR || s.resend {
+		t.Errorf("checksum %s, resend %v", s.check, s.resend)
+	}
+
+	s.grow(70000 + SlipRecordV14HeaderLength + 4)
+	if !bytes.Equal(s.RawMessage(), msg) {
+		t.Errorf("grow lost the data read")
+	}
+
+	// the checksum only depends on the version
+	s.protVersion = ProtocolV15
+	s.rawMessage[SlipRecordV14FlagsOffset] = SlipRecordV14FlagResend
+	if err = s.parseMessageGV14Header(SlipRecordV14HeaderLength); err != nil || s.check != framecheck.CRC32 || !s.resend {
+		t.Errorf("v15: err %v, checksum %s, resend %v", err, s.check, s.resend)
+	}
+}
+
+func TestParseLineV14N(t *testing.T) {
+	s := &RawEcrSlipRecord{
+		l:       log.NewNopLogger(),
+		message: &sliplines.Message{},
+		opts:    &Options{},
+	}
+	err := s.parseLineV14([]byte("N1;12;345;6;free text"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := recordKey{Mac: "1", ZReport: "12", SlipSerial: "345", DailySlipNo: "6"}
+	if len(s.message.Records) != 1 || *s.prev != want {
+		t.Fatalf("records %+v, prev %+v", s.message.Records, s.prev)
+	}
+	if n := s.message.Records[0].LineN; len(n) != 1 {
+		t.Errorf("LineN %+v", n)
+	}
+
+	if err = s.parseLineV14([]byte("Nfree text")); err == nil {
+		t.Errorf("N line without header parsed")
+	}
+}
+
+func TestHandleMsgGUnsupportedVersion(t *testing.T) {
+	msg := []byte("G12\x00\x004ECR0000001")
+	s := New(log.NewNopLogger(), nil, nil, nil, &Options{}, msg, len(msg))
+
+	c := &frametest.Conn{}
+	if err := s.HandleMsgG(context.Background(), c); err == nil {
+		t.Fatal("no error for protocol version 12")
+	}
+	if got := c.Out.String(); got != "A9009" || s.errorCode != kupon_errors.ErrUnsupportedProtocolVersion {
+		t.Errorf("sent %q, error code %d", got, s.errorCode)
+	}
+}
+
+func TestHandleMsgGVersionNotRead(t *testing.T) {
+	// the first read only got the identifier
+	frame := frametest.G13(frametest.SlipBody)
+	s := New(log.NewNopLogger(), &frametest.Backend{}, nil, nil, &Options{}, frame[:1], 1)
+
+	c := frametest.NewConn(frame[1:])
+	if err := s.HandleMsgG(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Out.String(); got != SlipRecordProtocolACK {
+		t.Errorf("sent %q", got)
+	}
+}
+
+func TestHandleMsgGResendFlag(t *testing.T) {
+	for _, flags := range []byte{0, SlipRecordV14FlagResend} {
+		seq, err := sequence.NewTracker(log.NewNopLogger(), t.TempDir(), time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// slip 101 is missing when the second frame arrives
+		var out string
+		for _, body := range []string{"AMAC1;12;100;1;1;20230727;125624;0\n", "AMAC1;12;102;3;1;20230727;130211;0\n"} {
+			frame := frametest.G14Flags("14", flags, body)
+			s := New(log.NewNopLogger(), &frametest.Backend{}, nil, seq, &Options{}, frame, len(frame))
+			c := &frametest.Conn{}
+			if err = s.HandleMsgG(context.Background(), c); err != nil {
+				t.Fatal(err)
+			}
+			out = c.Out.String()
+		}
+
+		resend := flags&SlipRecordV14FlagResend != 0
+		if !strings.HasPrefix(out, SlipRecordProtocolACK) || (len(out) > len(SlipRecordProtocolACK)) != resend {
+			t.Errorf("flags %#x: sent %q", flags, out)
+		}
+		if resend && out[len(SlipRecordProtocolACK)] != ResendMessageIdentifier {
+			t.Errorf("flags %#x: no resend request after the ACK: %q", flags, out)
+		}
+	}
+}
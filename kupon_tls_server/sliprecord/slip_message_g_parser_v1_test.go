@@ -0,0 +1,105 @@
+package sliprecord
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kit/kit/log"
+	"nexusws/cmd/kupon_tls_server/charset"
+	"nexusws/cmd/kupon_tls_server/eventsink"
+	"nexusws/cmd/kupon_tls_server/frametest"
+	"nexusws/cmd/kupon_tls_server/kupon_errors"
+	"nexusws/cmd/kupon_tls_server/sliplines"
+	"nexusws/pkg/nexus_errors"
+	v13 "nexusws/pkg/nexushttpclient/v13"
+	"strings"
+	"testing"
+)
+
+func TestParseV13UnknownLine(t *testing.T) {
+	newRecord := func(parsing string) *RawEcrSlipRecord {
+		return &RawEcrSlipRecord{
+			l:       log.NewNopLogger(),
+			message: &sliplines.Message{Records: make([]sliplines.Record, 0)},
+			opts:    &Options{Parsing: parsing},
+		}
+	}
+
+	s := newRecord(ParsingStrict)
+	err := s.parseLineV13([]byte("X1;2;3"))
+	if err == nil || s.errorCode != nexus_errors.ErrUnknownSlipLine {
+		t.Fatalf("strict line: err %v code %d", err, s.errorCode)
+	}
+	s = newRecord(ParsingStrict)
+	err = s.parseV13([]byte("\n\x00\x00\nX1;2;3\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 3:") {
+		t.Fatalf("strict: err %v, want it to start with the line index", err)
+	}
+
+	const (
+		a100 = "AMAC1;12;100;1;1;20230727;125624;0"
+		a101 = "AMAC1;12;101;2;1;20230727;125931;0"
+	)
+	// raw text of the lines kept per record
+	tests := []struct {
+		name  string
+		lines []string
+		want  [][]string
+	}{
+		{"first line", []string{"X1;2;3", a100}, [][]string{{"X1;2;3"}}},
+		{"after a slip", []string{a100, "X1;2;3", a101}, [][]string{{"X1;2;3"}, nil}},
+		{"cut header", []string{a100, "AMAC1;12", "X1;2;3", a101}, [][]string{nil, nil}},
+		{"no slip", []string{"X1;2;3"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newRecord(ParsingLenient)
+			err := s.parseV13([]byte(strings.Join(tt.lines, "\n")))
+			if err != nil || s.errorCode != 0 {
+				t.Fatalf("err %v code %d", err, s.errorCode)
+			}
+			records := s.message.Records
+			if len(records) != len(tt.want) {
+				t.Fatalf("got %d records, want %d", len(records), len(tt.want))
+			}
+			for i, want := range tt.want {
+				if got := records[i].UnparsedLines; strings.Join(got, "|") != strings.Join(want, "|") {
+					t.Errorf("record %d: UnparsedLines %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseV13UnsupportedCharset(t *testing.T) {
+	s := &RawEcrSlipRecord{
+		l:        log.NewNopLogger(),
+		Header13: &v13.MessageGHeader{EcrSerial: "ECR0000001"},
+		message:  &sliplines.Message{Records: make([]sliplines.Record, 0)},
+		opts:     &Options{Charset: &charset.Config{Devices: map[string]string{"ECR0000001": "koi8-r"}}},
+	}
+	err := s.parseV13([]byte(frametest.SlipBody))
+	if err == nil || s.errorCode != kupon_errors.ErrUnsupportedCharset {
+		t.Errorf("err %v, code %d", err, s.errorCode)
+	}
+}
+
+type failSink struct{}
+
+func (failSink) Write(ctx context.Context, e *eventsink.Event) error {
+	return errors.New("disk full")
+}
+
+func TestHandleMsgGSinkError(t *testing.T) {
+	// the backend has the slip, a NACK would only get it sent again
+	frame := frametest.G13(frametest.SlipBody)
+	b := &frametest.Backend{}
+	s := New(log.NewNopLogger(), b, failSink{}, nil, &Options{}, frame, len(frame))
+
+	c := &frametest.Conn{}
+	if err := s.HandleMsgG(context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Out.String(); got != SlipRecordProtocolACK || b.Stored != 1 {
+		t.Errorf("sent %q, stored %d", got, b.Stored)
+	}
+}
@@ -38,7 +38,7 @@ const (
 	SlipValidationMD5Offset = 32
 	SlipValidationMD5Last   = SlipValidationMD5Length + SlipValidationMD5Offset
 
-	SlipValidationCheckSumLength = 2
+	SlipValidationCheckSumLength = 2 // XOR, v15 frames have a CRC32, see framecheck
 	SlipValidationCheckSumOffset = 64
 	SlipValidationCheckSumLast   = SlipValidationCheckSumLength + SlipValidationCheckSumOffset
 
@@ -0,0 +1,59 @@
+package slipvalidation
+
+import (
+	"bytes"
+	"context"
+	"github.com/go-kit/kit/log"
+	"nexusws/cmd/kupon_tls_server/frametest"
+	"nexusws/cmd/kupon_tls_server/sliprecord"
+	"testing"
+)
+
+// addCaptured seeds f with the E frames of the capture files in
+// frametest.CaptureDir.
+func addCaptured(f *testing.F) {
+	frames, err := frametest.Captured(frametest.CaptureDir, sliprecord.SlipValidationMessageIdentifier, sliprecord.SlipValidationSignedMessageIdentifier)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, frame := range frames {
+		f.Add(frame)
+	}
+}
+
+func FuzzParseMessageEV1(f *testing.F) {
+	f.Add(frametest.E(sliprecord.ProtocolV14))
+	f.Add(frametest.E(sliprecord.ProtocolV15))
+	addCaptured(f)
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		if len(msg) > sliprecord.SlipMaxMessageLength {
+			return
+		}
+		s := New(log.NewNopLogger(), nil, nil, &Options{}, msg, len(msg))
+		err := s.parseMessageEV1()
+		if err == nil && len(s.Header.EcrSerial) != SlipValidationEcrSerialLength {
+			t.Errorf("EcrSerial %q", s.Header.EcrSerial)
+		}
+	})
+}
+
+func FuzzHandle(f *testing.F) {
+	f.Add(frametest.E(sliprecord.ProtocolV13))
+	f.Add(frametest.E(sliprecord.ProtocolV14))
+	f.Add(frametest.E(sliprecord.ProtocolV15))
+	f.Add([]byte("E"))
+	addCaptured(f)
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		msg := frame
+		if len(msg) > sliprecord.SlipMaxMessageLength {
+			msg = msg[:sliprecord.SlipMaxMessageLength]
+		}
+		c := frametest.NewConn(frame[len(msg):])
+		b := &frametest.Backend{URL: "http://www.kasat.al/k1/4841625c-b566-4c9d-95be-42d87ec6243a"}
+		s := New(log.NewNopLogger(), b, nil, &Options{}, msg, len(msg))
+		s.Handle(context.Background(), c)
+		if bytes.HasPrefix(c.Out.Bytes(), []byte(SlipValidationProtocolACK)) && b.Stored == 0 {
+			t.Errorf("ACK for a frame not stored")
+		}
+	})
+}
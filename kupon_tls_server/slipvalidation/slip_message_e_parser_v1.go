@@ -7,19 +7,26 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"io"
+	"nexusws/cmd/kupon_tls_server/backend"
+	"nexusws/cmd/kupon_tls_server/eventsink"
+	"nexusws/cmd/kupon_tls_server/framecheck"
+	"nexusws/cmd/kupon_tls_server/kupon_errors"
+	"nexusws/cmd/kupon_tls_server/registry"
+	"nexusws/cmd/kupon_tls_server/signing"
+	"nexusws/cmd/kupon_tls_server/slipfields"
 	"nexusws/cmd/kupon_tls_server/sliprecord"
-	"nexusws/pkg/checksum"
 	"nexusws/pkg/nexus_errors"
-	"nexusws/pkg/nexushttpclient"
 	v13 "nexusws/pkg/nexushttpclient/v13"
-	"strings"
+	"time"
 )
 
-func New(l log.Logger, nexusCl *nexushttpclient.SlipClient, msg []byte, msgLen int) *EcrSlipValidation {
+func New(l log.Logger, b backend.Backend, sink eventsink.Sink, opts *Options, msg []byte, msgLen int) *EcrSlipValidation {
 	e := &EcrSlipValidation{
 		rawMessage: make([]byte, sliprecord.SlipMaxMessageLength),
 		l:          l,
-		nexusCl:    nexusCl,
+		backend:    b,
+		sink:       sink,
+		opts:       opts,
 	}
 	copy(e.rawMessage, msg)
 	e.rawMessageDataLen = msgLen
@@ -29,10 +36,18 @@ func New(l log.Logger, nexusCl *nexushttpclient.SlipClient, msg []byte, msgLen i
 func (s *EcrSlipValidation) RawMessage() ([]byte, int) {
 	return s.rawMessage, s.rawMessageDataLen
 }
+
+// EcrSerial is empty until the frame is parsed.
+func (s *EcrSlipValidation) EcrSerial() string {
+	if s.Header == nil {
+		return ""
+	}
+	return s.Header.EcrSerial
+}
 func (s *EcrSlipValidation) Handle(ctx context.Context, r io.ReadWriter) error {
 
 	//if we haven't read the message, try to read it now
-	if s.rawMessageDataLen < SlipValidationMaxMessageLength {
+	if s.rawMessageDataLen < s.frameLength() {
 		for {
 			msgLen, rerr := r.Read(s.rawMessage[s.rawMessageDataLen:])
 			if rerr != nil {
@@ -46,9 +61,9 @@ func (s *EcrSlipValidation) Handle(ctx context.Context, r io.ReadWriter) error {
 			}
 
 			s.rawMessageDataLen += msgLen
-			if s.rawMessageDataLen == SlipValidationMaxMessageLength {
+			if s.rawMessageDataLen == s.frameLength() {
 				break
-			} else if uint(s.rawMessageDataLen) > SlipValidationMaxMessageLength {
+			} else if s.rawMessageDataLen > s.frameLength() {
 				s.errorCode = nexus_errors.ErrReceivedMoreDataThenExpected
 				s.sendNack(r, s.errorCode)
 
@@ -58,7 +73,17 @@ func (s *EcrSlipValidation) Handle(ctx context.Context, r io.ReadWriter) error {
 		}
 	}
 
-	err := s.parseMessageEV1()
+	var err error
+	switch v := string(s.rawMessage[SlipValidationProtocolOffset:SlipValidationProtocolLast]); v {
+	case sliprecord.ProtocolV13, sliprecord.ProtocolV14, sliprecord.ProtocolV15:
+		// the E frame of v13 only got a longer checksum since, it has no
+		// length field and no lines
+		s.check = framecheck.ForProtocolVersion(v)
+		err = s.parseMessageEV1()
+	default:
+		s.errorCode = kupon_errors.ErrUnsupportedProtocolVersion
+		err = fmt.Errorf("unsupported protocol version %q", v)
+	}
 	if err != nil {
 		s.sendNack(r, s.errorCode)
 		return err
@@ -68,8 +93,8 @@ func (s *EcrSlipValidation) Handle(ctx context.Context, r io.ReadWriter) error {
 
 	//todo check md5
 
-	s.Checksum = string(s.rawMessage[SlipValidationCheckSumOffset:SlipValidationCheckSumLast])
-	cs := checksum.CalcXorChecksum(s.rawMessage[SlipValidationIdentifierOffset:SlipValidationMD5Last])
+	s.Checksum = string(s.rawMessage[SlipValidationCheckSumOffset : SlipValidationCheckSumOffset+s.check.Length()])
+	cs := s.check.Sum(s.rawMessage[SlipValidationIdentifierOffset:SlipValidationMD5Last])
 	if cs != s.Checksum {
 		err = errors.New("checksums do not match")
 		s.errorCode = nexus_errors.ErrChecksumError
@@ -77,7 +102,22 @@ func (s *EcrSlipValidation) Handle(ctx context.Context, r io.ReadWriter) error {
 		return err
 	}
 
-	res, err := s.nexusCl.SlipValidationInsert(ctx, &v13.SlipValidationInsertReq{
+	ctx, s.l, err = s.opts.Registry.AdmitFrame(ctx, s.l, s.Header.EcrSerial, s.Header.ProtocolVersion)
+	if err != nil {
+		level.Error(s.l).Log("error", err)
+		s.errorCode = registry.NackCode(err, nexus_errors.ErrUnableToSaveSlipData)
+		s.sendNack(r, s.errorCode)
+		return err
+	}
+
+	err = s.opts.Keys.Check(s.Header.EcrSerial, s.rawMessage[:s.rawMessageDataLen], s.signed(), time.Now())
+	if err != nil {
+		s.errorCode = signing.NackCode(err)
+		s.sendNack(r, s.errorCode)
+		return err
+	}
+
+	qrCode, err := s.backend.InsertSlipValidation(ctx, &v13.SlipValidationInsertReq{
 		Identificationnumber: s.Header.EcrSerial,
 		Nrmac:                s.Header.NrMac,
 		Nrzreport:            s.Header.RapZ,
@@ -86,13 +126,18 @@ func (s *EcrSlipValidation) Handle(ctx context.Context, r io.ReadWriter) error {
 		Md5:                  s.MD5,
 	})
 	if err != nil {
+		level.Error(s.l).Log("error", err)
+		s.errorCode = backend.NackCode(err, nexus_errors.ErrUnableToSaveSlipData)
 		s.sendNack(r, s.errorCode)
 		return err
 	}
 
-	if res.ErrorCode != 0 {
-		s.sendNack(r, res.ErrorCode)
-		return fmt.Errorf("%v", res)
+	if s.sink != nil {
+		e := eventsink.NewEvent(ctx, eventsink.EventSlipValidation, s.Header.EcrSerial, s, s.rawMessage[:s.rawMessageDataLen])
+		err = s.sink.Write(ctx, e)
+		if err != nil {
+			level.Error(s.l).Log("msg", "event sink", "trace_id", e.TraceID, "ecrSerial", e.EcrSerial, "error", err)
+		}
 	}
 
 	err = s.sendAck(r)
@@ -101,7 +146,7 @@ func (s *EcrSlipValidation) Handle(ctx context.Context, r io.ReadWriter) error {
 	}
 
 	//slipRes := NewResponse(res.Data)
-	slipRes := NewResponse(s.Header.ProtocolVersion, res.QrCode)
+	slipRes := NewResponse(s.Header.ProtocolVersion, s.check, qrCode)
 	resp, err := slipRes.MarshalBinary()
 	if err != nil {
 		s.sendNack(r, s.errorCode)
@@ -114,8 +159,27 @@ func (s *EcrSlipValidation) Handle(ctx context.Context, r io.ReadWriter) error {
 	return nil
 }
 
+// frameLength is the length of the E frame, SlipValidationMaxMessageLength
+// until the protocol version has been read.
+func (s *EcrSlipValidation) frameLength() int {
+	if s.rawMessageDataLen < SlipValidationProtocolLast {
+		return SlipValidationMaxMessageLength
+	}
+	v := string(s.rawMessage[SlipValidationProtocolOffset:SlipValidationProtocolLast])
+	n := SlipValidationCheckSumOffset + framecheck.ForProtocolVersion(v).Length()
+	if s.signed() {
+		n += signing.TrailerLength
+	}
+	return n
+}
+
+func (s *EcrSlipValidation) signed() bool {
+	return s.rawMessage[SlipValidationIdentifierOffset] == sliprecord.SlipValidationSignedMessageIdentifier
+}
+
 func (s *EcrSlipValidation) parseMessageEV1() error {
-	if s.rawMessageDataLen < SlipValidationMaxMessageLength {
+	if s.rawMessageDataLen < s.frameLength() {
+		s.errorCode = nexus_errors.ErrUnableToReadDataFromNetwork
 		return errors.New("message E data less then expected")
 	}
 
@@ -123,10 +187,10 @@ func (s *EcrSlipValidation) parseMessageEV1() error {
 		MessageIdentifier: string(s.rawMessage[SlipValidationIdentifierOffset:SlipValidationIdentifierLast]),
 		ProtocolVersion:   string(s.rawMessage[SlipValidationProtocolOffset:SlipValidationProtocolLast]),
 		EcrSerial:         string(s.rawMessage[SlipValidationEcrSerialdOffset:SlipValidationEcrSerialLast]),
-		NrMac:             strings.TrimLeft(string(s.rawMessage[SlipValidationMacOffset:SlipValidationMacLast]), "0"),
-		RapZ:              strings.TrimLeft(string(s.rawMessage[SlipValidationRapZOffset:SlipValidationRapZLast]), "0"),
-		DailySlipNo:       strings.TrimLeft(string(s.rawMessage[SlipValidationDailySlipNoOffset:SlipValidationDailySlipNoLast]), "0"),
-		SerialSlip:        strings.TrimLeft(string(s.rawMessage[SlipValidationSerialOffset:SlipValidationSerialLast]), "0"),
+		NrMac:             slipfields.TrimZeros(string(s.rawMessage[SlipValidationMacOffset:SlipValidationMacLast])),
+		RapZ:              slipfields.TrimZeros(string(s.rawMessage[SlipValidationRapZOffset:SlipValidationRapZLast])),
+		DailySlipNo:       slipfields.TrimZeros(string(s.rawMessage[SlipValidationDailySlipNoOffset:SlipValidationDailySlipNoLast])),
+		SerialSlip:        slipfields.TrimZeros(string(s.rawMessage[SlipValidationSerialOffset:SlipValidationSerialLast])),
 	}
 	return nil
 }
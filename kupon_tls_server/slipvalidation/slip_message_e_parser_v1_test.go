@@ -1,11 +1,17 @@
 package slipvalidation
 
 import (
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/go-kit/kit/log"
 	goqr "github.com/nishant8887/go-qrcode"
 	"github.com/skip2/go-qrcode"
 	"math"
+	"nexusws/cmd/kupon_tls_server/frametest"
+	"nexusws/pkg/nexus_errors"
+	v13 "nexusws/pkg/nexushttpclient/v13"
 	"testing"
 )
 
@@ -60,3 +66,49 @@ func TestQrcodeGeneration(t *testing.T) {
 	fmt.Println(bytes)
 	fmt.Println(pngBytes)
 }
+
+func TestFrameLength(t *testing.T) {
+	for v, want := range map[string]int{"E": 66, "E13": 66, "E14": 66, "E15": 72, "e13": 100} {
+		msg := []byte(v)
+		s := New(nil, nil, nil, &Options{}, msg, len(msg))
+		if got := s.frameLength(); got != want {
+			t.Errorf("%q: frame length %d, want %d", v, got, want)
+		}
+	}
+}
+
+func TestHandleShortFrame(t *testing.T) {
+	// a v15 frame cut in its CRC32 used to parse, short frames were ACKed
+	for _, msg := range [][]byte{[]byte("E13"), frametest.E("15")[:68]} {
+		b := &frametest.Backend{}
+		c := &frametest.Conn{}
+		s := New(log.NewNopLogger(), b, nil, &Options{}, msg, len(msg))
+		if err := s.Handle(context.Background(), c); err == nil {
+			t.Errorf("%q: no error", msg)
+		}
+		if got := c.Out.String(); got != fmt.Sprintf("A%04d", nexus_errors.ErrUnableToReadDataFromNetwork) || b.Stored != 0 {
+			t.Errorf("%q: sent %q, stored %d", msg, got, b.Stored)
+		}
+	}
+}
+
+// downBackend fails like a NexusWS that cannot be reached.
+type downBackend struct {
+	frametest.Backend
+}
+
+func (b *downBackend) InsertSlipValidation(ctx context.Context, req *v13.SlipValidationInsertReq) (string, error) {
+	return "", errors.New("connection refused")
+}
+
+func TestHandleBackendError(t *testing.T) {
+	msg := frametest.E("14")
+	c := &frametest.Conn{}
+	s := New(log.NewNopLogger(), &downBackend{}, nil, &Options{}, msg, len(msg))
+	if err := s.Handle(context.Background(), c); err == nil {
+		t.Error("no error")
+	}
+	if got := c.Out.String(); got != fmt.Sprintf("A%04d", nexus_errors.ErrUnableToSaveSlipData) {
+		t.Errorf("sent %q", got)
+	}
+}
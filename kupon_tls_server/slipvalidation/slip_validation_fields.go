@@ -2,7 +2,11 @@ package slipvalidation
 
 import (
 	"github.com/go-kit/kit/log"
-	"nexusws/pkg/nexushttpclient"
+	"nexusws/cmd/kupon_tls_server/backend"
+	"nexusws/cmd/kupon_tls_server/eventsink"
+	"nexusws/cmd/kupon_tls_server/framecheck"
+	"nexusws/cmd/kupon_tls_server/registry"
+	"nexusws/cmd/kupon_tls_server/signing"
 )
 
 type EcrSlipValidation struct {
@@ -12,8 +16,18 @@ type EcrSlipValidation struct {
 	rawMessage        []byte
 	rawMessageDataLen int //holds the actual number of data, not the length
 	l                 log.Logger
-	nexusCl           *nexushttpclient.SlipClient
+	backend           backend.Backend
+	sink              eventsink.Sink
 	errorCode         int
+	check             framecheck.Algorithm
+	opts              *Options
+}
+
+type Options struct {
+	// Keys verifies signed frames, nil accepts every frame as it is.
+	Keys *signing.Store
+	// Registry admits devices, nil admits every device.
+	Registry *registry.Registry
 }
 
 type SlipRecordHeader struct {
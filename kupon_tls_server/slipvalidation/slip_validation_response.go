@@ -3,13 +3,14 @@ package slipvalidation
 import (
 	"bytes"
 	"encoding/binary"
-	"nexusws/pkg/checksum"
+	"nexusws/cmd/kupon_tls_server/framecheck"
 )
 
-func NewResponse(protocolVersion string, url string) *response {
+func NewResponse(protocolVersion string, check framecheck.Algorithm, url string) *response {
 	return &response{
 		MessageIdentifier: 72, //H
 		ProtocolVersion:   protocolVersion,
+		check:             check,
 		QrCodeType:        QrCodeTypeUrl,
 		QrCodeUrlLength:   uint16(len(url)),
 		UrlQrcode:         url,
@@ -28,6 +29,8 @@ type response struct {
 	QrCodeType        uint8
 	UrlQrcode         string
 	Checksum          string
+
+	check framecheck.Algorithm
 }
 
 func (r response) MarshalBinary() ([]byte, error) {
@@ -57,7 +60,7 @@ func (r response) MarshalBinary() ([]byte, error) {
 		return nil, err
 	}
 
-	cs := checksum.CalcXorChecksum(buf.Bytes())
+	cs := r.check.Sum(buf.Bytes())
 	_, err = buf.Write([]byte(cs))
 	if err != nil {
 		return nil, err
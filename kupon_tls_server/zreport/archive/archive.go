@@ -0,0 +1,179 @@
+package archive
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// Forwarding status of an archived Z report.
+const (
+	StatusReceived  = "received"  // archived, not yet forwarded to the backend
+	StatusForwarded = "forwarded" // accepted by the backend and ACKed
+	StatusFailed    = "failed"    // NACKed, the register will resend
+)
+
+const metaSuffix = ".meta.json"
+
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// Meta is the sidecar written next to every archived file as
+// <FileName>.meta.json.
+type Meta struct {
+	EcrSerial  string    `json:"EcrSerial"`
+	FileName   string    `json:"FileName"`
+	ReceivedAt time.Time `json:"ReceivedAt"`
+	TraceID    string    `json:"TraceID"`
+	Checksum   string    `json:"Checksum"` // frame checksum as sent by the register
+	SHA256     string    `json:"SHA256"`
+	Size       int       `json:"Size"`
+	Status     string    `json:"Status"`
+	Error      string    `json:"Error,omitempty"`
+	UpdatedAt  time.Time `json:"UpdatedAt"`
+}
+
+// Entry is an archived file.
+type Entry struct {
+	Path string
+	Meta Meta
+}
+
+// Archive writes received Z report files under
+// <root>/<EcrSerial>/<yyyy>/<mm>/<FileName>. A file received again under the
+// same name is kept as <FileName>.1, <FileName>.2 and so on.
+type Archive struct {
+	root string
+}
+
+func New(root string) (*Archive, error) {
+	err := os.MkdirAll(root, 0750)
+	if err != nil {
+		return nil, err
+	}
+	return &Archive{root: root}, nil
+}
+
+func (a *Archive) Store(ecrSerial string, fileName string, content []byte, checksum string, traceID string, received time.Time) (*Entry, error) {
+	received = received.UTC()
+	dir := filepath.Join(a.root, safeName(ecrSerial), received.Format("2006"), received.Format("01"))
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+
+	// the name is taken with O_EXCL, two reports stored at the same time never
+	// get the same one
+	name := safeName(fileName)
+	path := filepath.Join(dir, name)
+	for i := 1; ; i++ {
+		if !exists(path + ".gz") {
+			err = reserve(path)
+			if err == nil {
+				break
+			}
+			if !os.IsExist(err) {
+				return nil, err
+			}
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s.%d", name, i))
+	}
+
+	err = writeFile(path, content)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(content)
+	e := &Entry{
+		Path: path,
+		Meta: Meta{
+			EcrSerial:  ecrSerial,
+			FileName:   fileName,
+			ReceivedAt: received,
+			TraceID:    traceID,
+			Checksum:   checksum,
+			SHA256:     hex.EncodeToString(sum[:]),
+			Size:       len(content),
+			Status:     StatusReceived,
+			UpdatedAt:  received,
+		},
+	}
+	err = a.writeMeta(e)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// SetStatus records the forwarding outcome of e. cause is kept for
+// StatusFailed.
+func (a *Archive) SetStatus(e *Entry, status string, cause error) error {
+	e.Meta.Status = status
+	e.Meta.Error = ""
+	if cause != nil {
+		e.Meta.Error = cause.Error()
+	}
+	e.Meta.UpdatedAt = time.Now().UTC()
+	return a.writeMeta(e)
+}
+
+func (a *Archive) writeMeta(e *Entry) error {
+	b, err := json.MarshalIndent(&e.Meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(e.Path+metaSuffix, b)
+}
+
+// reserve creates name empty, failing when it exists.
+func reserve(name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeFile replaces name through a temp file of its own, writers of
+// different names never share one.
+func writeFile(name string, b []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	err = f.Chmod(0640)
+	if err == nil {
+		_, err = f.Write(b)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func safeName(s string) string {
+	s = unsafeChars.ReplaceAllString(s, "_")
+	if s == "" || s == "." || s == ".." {
+		return "unknown"
+	}
+	return s
+}
+
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
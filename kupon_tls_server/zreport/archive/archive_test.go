@@ -0,0 +1,117 @@
+package archive
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestArchive(t *testing.T) {
+	root := t.TempDir()
+	a, err := New(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := time.Date(2024, 3, 1, 23, 59, 0, 0, time.UTC)
+
+	e1, err := a.Store("ECR1", "z0012.txt", []byte("first"), "4F", "trace-1", received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e2, err := a.Store("ECR1", "z0012.txt", []byte("second"), "50", "trace-2", received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(root, "ECR1", "2024", "03", "z0012.txt")
+	if e1.Path != want || e2.Path != want+".1" {
+		t.Fatalf("paths %s %s", e1.Path, e2.Path)
+	}
+
+	err = a.SetStatus(e2, StatusFailed, errors.New("backend down"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(e2.Path + metaSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Meta{}
+	err = json.Unmarshal(b, m)
+	if err != nil || m.Status != StatusFailed || m.TraceID != "trace-2" || m.Error != "backend down" {
+		t.Fatalf("meta %+v %v", m, err)
+	}
+
+	old := time.Now().Add(-48 * time.Hour)
+	err = os.Chtimes(e1.Path, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := a.Sweep(24*time.Hour, RetentionCompress)
+	if err != nil || res.Compressed != 1 {
+		t.Fatalf("compress %+v %v", res, err)
+	}
+	_, err = os.Stat(e1.Path + ".gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = a.Sweep(24*time.Hour, RetentionDelete)
+	if err != nil || res.Deleted != 1 {
+		t.Fatalf("delete %+v %v", res, err)
+	}
+	for _, name := range []string{e1.Path + ".gz", e1.Path + metaSuffix} {
+		_, err = os.Stat(name)
+		if !os.IsNotExist(err) {
+			t.Errorf("%s still exists", name)
+		}
+	}
+	_, err = os.Stat(e2.Path)
+	if err != nil {
+		t.Errorf("recent file removed: %v", err)
+	}
+}
+
+func TestArchiveConcurrentStore(t *testing.T) {
+	a, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := time.Date(2024, 3, 1, 23, 59, 0, 0, time.UTC)
+
+	const n = 20
+	var wg sync.WaitGroup
+	entries := make([]*Entry, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			e, err := a.Store("ECR1", "z0012.txt", []byte(strconv.Itoa(i)), "4F", "trace", received)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			entries[i] = e
+		}(i)
+	}
+	wg.Wait()
+
+	paths := map[string]bool{}
+	for i, e := range entries {
+		if e == nil {
+			continue
+		}
+		paths[e.Path] = true
+		b, err := os.ReadFile(e.Path)
+		if err != nil || string(b) != strconv.Itoa(i) {
+			t.Errorf("%s: %q %v, want %d", e.Path, b, err, i)
+		}
+	}
+	if len(paths) != n {
+		t.Errorf("%d files for %d reports", len(paths), n)
+	}
+}
@@ -0,0 +1,119 @@
+package archive
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// What the retention sweep does with files older than the maximum age.
+const (
+	RetentionDelete   = "delete"   // remove the file and its sidecar
+	RetentionCompress = "compress" // gzip the file, keep the sidecar
+)
+
+// SweepResult counts the files touched by one sweep.
+type SweepResult struct {
+	Deleted    int
+	Compressed int
+}
+
+// Sweep applies action to every archived file last modified before
+// now - maxAge. Compressed files are only removed by RetentionDelete.
+func (a *Archive) Sweep(maxAge time.Duration, action string) (*SweepResult, error) {
+	if action != RetentionDelete && action != RetentionCompress {
+		return nil, fmt.Errorf("unknown retention action %q", action)
+	}
+	res := &SweepResult{}
+	cutoff := time.Now().Add(-maxAge)
+
+	err := filepath.WalkDir(a.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, metaSuffix) || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.ModTime().Before(cutoff) {
+			return nil
+		}
+
+		compressed := strings.HasSuffix(path, ".gz")
+		switch action {
+		case RetentionDelete:
+			meta := strings.TrimSuffix(path, ".gz") + metaSuffix
+			err = os.Remove(path)
+			if err != nil {
+				return err
+			}
+			err = os.Remove(meta)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			res.Deleted++
+		case RetentionCompress:
+			if compressed {
+				return nil
+			}
+			err = compress(path, info.ModTime())
+			if err != nil {
+				return err
+			}
+			res.Compressed++
+		}
+		return nil
+	})
+	return res, err
+}
+
+// compress replaces path with path.gz, keeping the modification time so a
+// later delete sweep still sees the age of the original file.
+func compress(path string, modTime time.Time) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz.tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(path)
+	zw.ModTime = modTime
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	cerr := out.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz.tmp")
+		return err
+	}
+
+	err = os.Chtimes(path+".gz.tmp", modTime, modTime)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+".gz.tmp", path+".gz")
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
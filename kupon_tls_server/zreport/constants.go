@@ -5,7 +5,8 @@ const (
 
 	ZReportHeaderLength = 54
 
-	ZReportMessageIdentifier = 87 // 'W'
+	ZReportMessageIdentifier       = 87  // 'W'
+	ZReportSignedMessageIdentifier = 119 // 'w', see package signing
 
 	ZReportIdentifierLength = 1
 	ZReportIdentifierOffset = 0
@@ -34,7 +35,52 @@ const (
 
 	ZReportEcrFileContentOffset = 54
 
-	ZReportCheckSumLength = 2
+	ZReportCheckSumLength = 2 // XOR, v15 frames have a CRC32, see framecheck
 
 	ZReportProtocolACK = "A0000"
 )
+
+// How the Z report file content is checked, see zfile.Parse.
+const (
+	ContentParsingOff     = "off"     // forward the file only
+	ContentParsingLenient = "lenient" // forward the summary when the file parses, log otherwise
+	ContentParsingStrict  = "strict"  // NACK files that do not parse
+)
+
+// Multi-part uploads. A W frame with type ZReportTypeMultiPart carries one
+// part of a file too large for a single frame. Its body starts with a part
+// header, the rest of the body is the part content:
+//
+//	upload ID    16 bytes, chosen by the register, the same for every part
+//	part index    2 bytes, little endian, starting at 0
+//	total parts   2 bytes, little endian
+//	digest       32 bytes, SHA-256 of the whole file, the same for every part
+//
+// Every part is ACKed once stored. Parts can be sent in any order and resent
+// after a reconnect, the report is forwarded when the last missing part
+// arrives. The parts are kept until the report is ACKed, a report NACKed
+// after its last part is forwarded again when that part is resent.
+const (
+	ZReportTypeMultiPart = 'P'
+
+	ZReportUploadIDLength = 16
+	ZReportUploadIDOffset = 0
+	ZReportUploadIDLast   = ZReportUploadIDOffset + ZReportUploadIDLength
+
+	ZReportPartIndexLength = 2
+	ZReportPartIndexOffset = 16
+	ZReportPartIndexLast   = ZReportPartIndexOffset + ZReportPartIndexLength
+
+	ZReportTotalPartsLength = 2
+	ZReportTotalPartsOffset = 18
+	ZReportTotalPartsLast   = ZReportTotalPartsOffset + ZReportTotalPartsLength
+
+	ZReportDigestLength = 32
+	ZReportDigestOffset = 20
+	ZReportDigestLast   = ZReportDigestOffset + ZReportDigestLength
+
+	ZReportPartHeaderLength = ZReportDigestLast
+
+	// ZReportMaxParts caps an upload at roughly 16 MB.
+	ZReportMaxParts = 4096
+)
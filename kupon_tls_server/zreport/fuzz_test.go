@@ -0,0 +1,67 @@
+package zreport
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"github.com/go-kit/kit/log"
+	"nexusws/cmd/kupon_tls_server/frametest"
+	"testing"
+	"time"
+)
+
+// addCaptured seeds f with the W frames of the capture files in
+// frametest.CaptureDir.
+func addCaptured(f *testing.F) {
+	frames, err := frametest.Captured(frametest.CaptureDir, ZReportMessageIdentifier, ZReportSignedMessageIdentifier)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, frame := range frames {
+		f.Add(frame)
+	}
+}
+
+func FuzzParseMessage(f *testing.F) {
+	f.Add(frametest.W("14", '1', frametest.ZReportBody))
+	f.Add(frametest.W("15", '1', frametest.ZReportBody))
+	addCaptured(f)
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		if len(msg) > ZReportMaxMessageLength {
+			return
+		}
+		s := New(log.NewNopLogger(), nil, nil, &Options{}, msg, len(msg))
+		err := s.parseMessage()
+		if err == nil && s.frameLength() > ZReportMaxMessageLength {
+			t.Errorf("frame length %d", s.frameLength())
+		}
+	})
+}
+
+func FuzzHandle(f *testing.F) {
+	f.Add(frametest.W("14", '1', frametest.ZReportBody))
+	f.Add(frametest.W("15", '1', frametest.ZReportBody))
+	digest := sha256.Sum256([]byte(frametest.ZReportBody))
+	f.Add(frametest.W("14", ZReportTypeMultiPart, "upload-000000001\x00\x00\x01\x00"+string(digest[:])+frametest.ZReportBody))
+	f.Add([]byte("W"))
+	addCaptured(f)
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		// the connection handler reads at most 2048 bytes, the handler
+		// reads the rest
+		msg := frame
+		if len(msg) > 2048 {
+			msg = msg[:2048]
+		}
+		c := frametest.NewConn(frame[len(msg):])
+		uploads, err := NewUploads(t.TempDir(), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := &frametest.Backend{}
+		s := New(log.NewNopLogger(), b, nil, &Options{ContentParsing: ContentParsingStrict, Uploads: uploads}, msg, len(msg))
+		s.Handle(context.Background(), c)
+		if bytes.HasPrefix(c.Out.Bytes(), []byte(ZReportProtocolACK)) && b.Stored == 0 && s.rawMessage[ZReportTypeOffset] != ZReportTypeMultiPart {
+			t.Errorf("ACK for a frame not stored")
+		}
+	})
+}
@@ -2,18 +2,50 @@ package zreport
 
 import (
 	"github.com/go-kit/kit/log"
-	"nexusws/pkg/nexushttpclient"
+	"nexusws/cmd/kupon_tls_server/backend"
+	"nexusws/cmd/kupon_tls_server/eventsink"
+	"nexusws/cmd/kupon_tls_server/framecheck"
+	"nexusws/cmd/kupon_tls_server/registry"
+	"nexusws/cmd/kupon_tls_server/signing"
+	"nexusws/cmd/kupon_tls_server/zreport/archive"
+	"nexusws/cmd/kupon_tls_server/zreport/zfile"
 	"nexusws/pkg/nexushttpclient/zreport"
 )
 
 type RawZReport struct {
 	Report   *zreport.ZReport
+	Summary  *zfile.Summary
 	Checksum string
 
 	rawMessage        []byte
 	rawMessageDataLen int //holds the actual number of data, not the message length
 	bodyLength        int
+	content           []byte // reassembled multi-part file
+	upload            *Part  // last part of the upload, removed once the report is ACKed
+	archived          *archive.Entry
 	l                 log.Logger
-	nexusCl           *nexushttpclient.SlipClient
+	backend           backend.Backend
+	sink              eventsink.Sink
+	opts              *Options
 	errorCode         int
+	check             framecheck.Algorithm
+	signed            bool
+}
+
+type Options struct {
+	ContentParsing string
+	// Uploads holds multi-part uploads, multi-part frames are NACKed when nil.
+	Uploads *Uploads
+	// Archive keeps a copy of every received file, nothing is kept when nil.
+	Archive *archive.Archive
+	// Keys verifies signed frames, nil accepts every frame as it is.
+	Keys *signing.Store
+	// Registry admits devices, nil admits every device.
+	Registry *registry.Registry
+}
+
+// ZReportEvent is the event sink payload, the report with its parsed summary.
+type ZReportEvent struct {
+	*zreport.ZReport
+	Summary *zfile.Summary `json:"Summary,omitempty"`
 }
@@ -10,18 +10,27 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"io"
-	"nexusws/pkg/checksum"
+	"nexusws/cmd/kupon_tls_server/backend"
+	"nexusws/cmd/kupon_tls_server/eventsink"
+	"nexusws/cmd/kupon_tls_server/framecheck"
+	"nexusws/cmd/kupon_tls_server/kupon_errors"
+	"nexusws/cmd/kupon_tls_server/registry"
+	"nexusws/cmd/kupon_tls_server/signing"
+	"nexusws/cmd/kupon_tls_server/zreport/archive"
+	"nexusws/cmd/kupon_tls_server/zreport/zfile"
 	context2 "nexusws/pkg/context"
 	"nexusws/pkg/nexus_errors"
-	"nexusws/pkg/nexushttpclient"
 	"nexusws/pkg/nexushttpclient/zreport"
+	"time"
 )
 
-func New(l log.Logger, nexusCl *nexushttpclient.SlipClient, msg []byte, msgLen int) *RawZReport {
+func New(l log.Logger, b backend.Backend, sink eventsink.Sink, opts *Options, msg []byte, msgLen int) *RawZReport {
 	e := &RawZReport{
 		rawMessage: make([]byte, ZReportMaxMessageLength),
 		l:          l,
-		nexusCl:    nexusCl,
+		backend:    b,
+		sink:       sink,
+		opts:       opts,
 	}
 	copy(e.rawMessage, msg)
 	e.rawMessageDataLen = msgLen
@@ -31,29 +40,65 @@ func New(l log.Logger, nexusCl *nexushttpclient.SlipClient, msg []byte, msgLen i
 func (s *RawZReport) RawMessage() []byte {
 	return s.rawMessage[:s.rawMessageDataLen]
 }
+
+// EcrSerial is empty until the frame is parsed.
+func (s *RawZReport) EcrSerial() string {
+	if s.Report == nil {
+		return ""
+	}
+	return s.Report.ECRSerial
+}
+func (s *RawZReport) frameContent() []byte {
+	return s.rawMessage[ZReportEcrFileContentOffset : ZReportEcrFileContentOffset+s.bodyLength]
+}
+
+// fileContent is the reassembled file of a multi-part upload, the frame
+// content otherwise.
+func (s *RawZReport) fileContent() []byte {
+	if s.content != nil {
+		return s.content
+	}
+	return s.frameContent()
+}
+
+// frameLength is the length of the frame once parseMessage has read the
+// header.
+func (s *RawZReport) frameLength() int {
+	n := ZReportHeaderLength + s.bodyLength + s.check.Length()
+	if s.signed {
+		n += signing.TrailerLength
+	}
+	return n
+}
+
 func (s *RawZReport) parseMessage() error {
 
-	bodyLen := binary.LittleEndian.Uint16(s.rawMessage[ZReportLengthFieldOffset:ZReportLengthFieldLast])
+	s.check = framecheck.ForProtocolVersion(string(s.rawMessage[ZReportProtocolOffset:ZReportProtocolLast]))
+	s.signed = s.rawMessage[ZReportIdentifierOffset] == ZReportSignedMessageIdentifier
+	lengthField := int(binary.LittleEndian.Uint16(s.rawMessage[ZReportLengthFieldOffset:ZReportLengthFieldLast]))
 
-	//level.Info(s.l).Log("length field value", fmt.Sprintf("%d", bodyLen))
+	//level.Info(s.l).Log("length field value", fmt.Sprintf("%d", lengthField))
 
-	bodyLen = bodyLen -
-		ZReportLengthFieldLength -
-		ZReportTypeLength -
-		ZReportEcrSerialLength -
-		ZReportEcrFileNameLength -
-		ZReportCheckSumLength
+	fixedLen := ZReportLengthFieldLength +
+		ZReportTypeLength +
+		ZReportEcrSerialLength +
+		ZReportEcrFileNameLength +
+		s.check.Length()
+	if lengthField < fixedLen {
+		err := fmt.Errorf("length field %d is smaller then the fixed fields", lengthField)
+		return err
+	}
+	bodyLen := lengthField - fixedLen
 
 	//level.Info(s.l).Log("zreport data length", fmt.Sprintf("%d", bodyLen))
 
-	if bodyLen > ZReportMaxMessageLength {
+	s.bodyLength = bodyLen
+	if s.frameLength() > ZReportMaxMessageLength {
 		err := errors.New("total message length is bigger then maximum allowed")
 		return err
 	}
-	s.bodyLength = int(bodyLen)
 
-	fileContent := s.rawMessage[ZReportEcrFileContentOffset : ZReportEcrFileContentOffset+bodyLen]
-	enc := base64.StdEncoding.EncodeToString(fileContent)
+	enc := base64.StdEncoding.EncodeToString(s.frameContent())
 
 	isNull := func(c rune) bool {
 		return c == 0
@@ -85,7 +130,7 @@ func (s *RawZReport) Handle(ctx context.Context, r io.ReadWriter) error {
 			}
 			//level.Info(logger).Log("raw message length", fmt.Sprintf("%d", s.rawMessageDataLen))
 			//level.Info(logger).Log("ZReportHeaderLength + s.bodyLength + ZReportCheckSumLength", fmt.Sprintf("%d", ZReportHeaderLength+s.bodyLength+ZReportCheckSumLength))
-			if s.rawMessageDataLen >= (ZReportHeaderLength + s.bodyLength + ZReportCheckSumLength) {
+			if s.rawMessageDataLen >= s.frameLength() {
 				break
 			}
 			//level.Info(logger).Log("reading more data", "reading more data")
@@ -126,9 +171,9 @@ func (s *RawZReport) Handle(ctx context.Context, r io.ReadWriter) error {
 	//var cs string
 	cOffset := ZReportHeaderLength + s.bodyLength
 
-	s.Checksum = string(s.rawMessage[cOffset:s.rawMessageDataLen])
+	s.Checksum = string(s.rawMessage[cOffset : cOffset+s.check.Length()])
 
-	cs := checksum.CalcXorChecksum(s.rawMessage[ZReportIdentifierOffset : ZReportHeaderLength+s.bodyLength])
+	cs := s.check.Sum(s.rawMessage[ZReportIdentifierOffset : ZReportHeaderLength+s.bodyLength])
 
 	//body, _ := json.Marshal(s.Report)
 	//level.Info(logger).Log("info", string(body))
@@ -139,31 +184,164 @@ func (s *RawZReport) Handle(ctx context.Context, r io.ReadWriter) error {
 		return err
 	}
 
-	req := nexushttpclient.ZReportReq{}
-	req.ECRSerial = s.Report.ECRSerial
-	req.FileName = s.Report.FileName
-	req.FileContentBase64 = s.Report.FileContentBase64
+	ctx, logger, err = s.opts.Registry.AdmitFrame(ctx, logger, s.Report.ECRSerial, s.Report.ProtocolVersion)
+	if err != nil {
+		level.Error(logger).Log("error", err)
+		s.errorCode = registry.NackCode(err, nexus_errors.ErrErrorSavingZReport)
+		s.sendNack(ctx, r, s.errorCode)
+		return err
+	}
+
+	err = s.opts.Keys.Check(s.Report.ECRSerial, s.RawMessage(), s.signed, time.Now())
+	if err != nil {
+		s.errorCode = signing.NackCode(err)
+		s.sendNack(ctx, r, s.errorCode)
+		return err
+	}
 
 	level.Info(logger).Log("filename", s.Report.FileName)
-	//_, err = s.nexusCl.ZReportInsert(ctx, &req)
-	////TODO hiq komentin me poshte dhe implement endpoont zReportInsert
-	//if err != nil {
-	//	//s.sendNack(r, nexus_errors.ErrErrorSavingZReport)
-	//	level.Error(logger).Log("err", err)
-	//	//return err
-	//}
-	//if resp.ErrorCode != 0 {
-	//	s.sendNack(r, nexus_errors.ErrErrorSavingZReport)
-	//	return fmt.Errorf("%v", resp)
-	//}
+
+	if s.rawMessage[ZReportTypeOffset] == ZReportTypeMultiPart {
+		complete, err := s.handlePart(ctx)
+		if err != nil {
+			level.Error(logger).Log("filename", s.Report.FileName, "err", err)
+			s.sendNack(ctx, r, s.errorCode)
+			return err
+		}
+		if !complete {
+			return s.sendAck(ctx, r)
+		}
+	}
+
+	s.archiveFile(ctx)
+
+	if s.opts.ContentParsing == ContentParsingLenient || s.opts.ContentParsing == ContentParsingStrict {
+		s.Summary, err = zfile.Parse(s.fileContent())
+		if err != nil {
+			level.Error(logger).Log("filename", s.Report.FileName, "err", err)
+			if s.opts.ContentParsing == ContentParsingStrict {
+				s.errorCode = kupon_errors.ErrMalformedZReport
+				s.sendNack(ctx, r, s.errorCode)
+				s.archiveStatus(ctx, err)
+				return err
+			}
+		}
+	}
+
+	err = s.backend.InsertZReport(ctx, s.Report, s.Summary)
+	if err != nil {
+		level.Error(logger).Log("err", err)
+		s.sendNack(ctx, r, backend.NackCode(err, nexus_errors.ErrErrorSavingZReport))
+		s.archiveStatus(ctx, err)
+		return err
+	}
+
+	if s.sink != nil {
+		payload := &ZReportEvent{ZReport: s.Report, Summary: s.Summary}
+		e := eventsink.NewEvent(ctx, eventsink.EventZReport, s.Report.ECRSerial, payload, s.RawMessage())
+		err = s.sink.Write(ctx, e)
+		if err != nil {
+			level.Error(logger).Log("msg", "event sink", "ecrSerial", e.EcrSerial, "err", err)
+		}
+	}
 
 	err = s.sendAck(ctx, r)
+	s.archiveStatus(ctx, err)
 	if err != nil {
 		return err
 	}
+	if s.upload != nil {
+		err = s.opts.Uploads.Done(s.upload.EcrSerial, s.upload.UploadID)
+		if err != nil {
+			level.Error(logger).Log("upload", s.upload.UploadID, "err", err)
+		}
+	}
 	return nil
 }
 
+// archiveFile keeps a copy of the file when an archive is configured. The
+// archive is a trace only, failing to write it does not NACK the report.
+func (s *RawZReport) archiveFile(ctx context.Context) {
+	if s.opts.Archive == nil {
+		return
+	}
+	logger := log.With(s.l, "zreport", "archiveFile", "trace_id", context2.GetTraceId(ctx))
+
+	var err error
+	s.archived, err = s.opts.Archive.Store(s.Report.ECRSerial, s.Report.FileName, s.fileContent(), s.Checksum,
+		context2.GetTraceId(ctx), time.Now())
+	if err != nil {
+		level.Error(logger).Log("filename", s.Report.FileName, "err", err)
+		return
+	}
+	level.Info(logger).Log("archived", s.archived.Path)
+}
+
+// archiveStatus records in the archive sidecar whether the report was
+// forwarded, cause is the error the report was NACKed for.
+func (s *RawZReport) archiveStatus(ctx context.Context, cause error) {
+	if s.archived == nil {
+		return
+	}
+	status := archive.StatusForwarded
+	if cause != nil {
+		status = archive.StatusFailed
+	}
+	err := s.opts.Archive.SetStatus(s.archived, status, cause)
+	if err != nil {
+		logger := log.With(s.l, "zreport", "archiveStatus", "trace_id", context2.GetTraceId(ctx))
+		level.Error(logger).Log("path", s.archived.Path, "err", err)
+	}
+}
+
+// handlePart stores the part carried by the frame. It reports whether the
+// upload is complete, the reassembled file is then in s.content.
+func (s *RawZReport) handlePart(ctx context.Context) (bool, error) {
+	logger := log.With(s.l, "zreport", "handlePart", "trace_id", context2.GetTraceId(ctx))
+
+	if s.opts.Uploads == nil {
+		s.errorCode = nexus_errors.ErrUnimplementedFunction
+		return false, errors.New("multi-part z report uploads are not enabled")
+	}
+	body := s.frameContent()
+	if len(body) < ZReportPartHeaderLength {
+		s.errorCode = kupon_errors.ErrZReportPartInvalid
+		return false, fmt.Errorf("part of %d bytes is shorter then the part header", len(body))
+	}
+
+	p := &Part{
+		EcrSerial: s.Report.ECRSerial,
+		UploadID:  string(body[ZReportUploadIDOffset:ZReportUploadIDLast]),
+		FileName:  s.Report.FileName,
+		Index:     int(binary.LittleEndian.Uint16(body[ZReportPartIndexOffset:ZReportPartIndexLast])),
+		Total:     int(binary.LittleEndian.Uint16(body[ZReportTotalPartsOffset:ZReportTotalPartsLast])),
+		Digest:    body[ZReportDigestOffset:ZReportDigestLast],
+		Content:   body[ZReportPartHeaderLength:],
+	}
+	level.Info(logger).Log("upload", p.UploadID, "part", p.Index, "total", p.Total)
+
+	content, complete, err := s.opts.Uploads.Put(p)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrPartInvalid):
+			s.errorCode = kupon_errors.ErrZReportPartInvalid
+		case errors.Is(err, ErrDigestMismatch):
+			s.errorCode = kupon_errors.ErrZReportDigestMismatch
+		default:
+			s.errorCode = nexus_errors.ErrErrorSavingZReport
+		}
+		return false, err
+	}
+	if !complete {
+		return false, nil
+	}
+
+	s.content = content
+	s.upload = p
+	s.Report.FileContentBase64 = base64.StdEncoding.EncodeToString(content)
+	return true, nil
+}
+
 func (s *RawZReport) sendNack(ctx context.Context, r io.ReadWriter, errorCode int) {
 	logger := log.With(s.l, "zreport", "sendNack", "trace_id", context2.GetTraceId(ctx))
 	ackMsg := fmt.Sprintf("A%04d", errorCode)
@@ -0,0 +1,263 @@
+package zreport
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrPartInvalid is returned for a part that does not fit its upload.
+	ErrPartInvalid = errors.New("invalid z report part")
+	// ErrDigestMismatch is returned when the reassembled file does not match
+	// the upload digest.
+	ErrDigestMismatch = errors.New("z report digest mismatch")
+)
+
+var uploadNameUnsafeChars = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// Part is one frame of a multi-part upload.
+type Part struct {
+	EcrSerial string
+	UploadID  string
+	FileName  string
+	Index     int
+	Total     int
+	Digest    []byte
+	Content   []byte
+}
+
+type uploadMeta struct {
+	FileName string    `json:"FileName"`
+	Total    int       `json:"Total"`
+	Digest   string    `json:"Digest"`
+	Started  time.Time `json:"Started"`
+}
+
+// Uploads keeps the parts of multi-part Z reports on disk under
+// <dir>/<EcrSerial>/<upload ID>/ so an upload survives reconnects and
+// restarts. Uploads not completed within ttl are removed.
+type Uploads struct {
+	dir string
+	ttl time.Duration
+	mu  sync.Mutex
+}
+
+func NewUploads(dir string, ttl time.Duration) (*Uploads, error) {
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, err
+	}
+	return &Uploads{dir: dir, ttl: ttl}, nil
+}
+
+// uploadDir names the directory of an upload. The upload ID is binary and
+// always hex encoded, EcrSerials only when they have unsafe characters, so
+// two uploads never share a directory.
+func (u *Uploads) uploadDir(ecrSerial string, uploadID string) string {
+	if ecrSerial == "" || uploadNameUnsafeChars.MatchString(ecrSerial) {
+		ecrSerial = "x" + hex.EncodeToString([]byte(ecrSerial))
+	}
+	return filepath.Join(u.dir, ecrSerial, hex.EncodeToString([]byte(uploadID)))
+}
+
+// Put stores p. When the upload has all its parts, the reassembled file is
+// returned. The parts are kept until Done, so that an upload whose report
+// was not stored or ACKed is complete again when its last part is resent. A
+// resent part replaces the stored one.
+func (u *Uploads) Put(p *Part) ([]byte, bool, error) {
+	if p.Total < 1 || p.Total > ZReportMaxParts || p.Index < 0 || p.Index >= p.Total {
+		return nil, false, fmt.Errorf("%w: part %d of %d", ErrPartInvalid, p.Index, p.Total)
+	}
+	if len(p.Digest) != sha256.Size {
+		return nil, false, fmt.Errorf("%w: digest length %d", ErrPartInvalid, len(p.Digest))
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	dir := u.uploadDir(p.EcrSerial, p.UploadID)
+	meta, err := u.meta(dir)
+	if err != nil {
+		return nil, false, err
+	}
+	if meta != nil && u.ttl > 0 && time.Since(meta.Started) > u.ttl {
+		err = os.RemoveAll(dir)
+		if err != nil {
+			return nil, false, err
+		}
+		meta = nil
+	}
+	digest := hex.EncodeToString(p.Digest)
+	if meta == nil {
+		meta = &uploadMeta{FileName: p.FileName, Total: p.Total, Digest: digest, Started: time.Now().UTC()}
+		err = os.MkdirAll(dir, 0750)
+		if err != nil {
+			return nil, false, err
+		}
+		err = writeFileAtomic(filepath.Join(dir, "upload.json"), meta)
+		if err != nil {
+			return nil, false, err
+		}
+	} else if meta.Total != p.Total || meta.Digest != digest || meta.FileName != p.FileName {
+		return nil, false, fmt.Errorf("%w: part %d does not match upload %s", ErrPartInvalid, p.Index, p.UploadID)
+	}
+
+	err = writeFileAtomic(filepath.Join(dir, partName(p.Index)), p.Content)
+	if err != nil {
+		return nil, false, err
+	}
+
+	n, err := countParts(dir, meta.Total)
+	if err != nil {
+		return nil, false, err
+	}
+	if n < meta.Total {
+		return nil, false, nil
+	}
+
+	var content bytes.Buffer
+	for i := 0; i < meta.Total; i++ {
+		b, err := os.ReadFile(filepath.Join(dir, partName(i)))
+		if err != nil {
+			return nil, false, err
+		}
+		content.Write(b)
+	}
+
+	sum := sha256.Sum256(content.Bytes())
+	if !bytes.Equal(sum[:], p.Digest) {
+		// a part is corrupted and it is not known which, the register
+		// has to send the upload again
+		err = os.RemoveAll(dir)
+		if err != nil {
+			return nil, false, err
+		}
+		return nil, false, fmt.Errorf("%w: upload %s", ErrDigestMismatch, p.UploadID)
+	}
+	return content.Bytes(), true, nil
+}
+
+// Done removes a complete upload once its report is stored and ACKed.
+func (u *Uploads) Done(ecrSerial string, uploadID string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return os.RemoveAll(u.uploadDir(ecrSerial, uploadID))
+}
+
+// countParts counts the parts stored in dir, from the directory listing
+// alone.
+func countParts(dir string, total int) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range entries {
+		i, err := strconv.Atoi(strings.TrimPrefix(e.Name(), "part-"))
+		if err == nil && strings.HasPrefix(e.Name(), "part-") && i >= 0 && i < total {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Sweep removes uploads started more than ttl ago.
+func (u *Uploads) Sweep() error {
+	if u.ttl <= 0 {
+		return nil
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	dirs, err := filepath.Glob(filepath.Join(u.dir, "*", "*"))
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		meta, err := u.meta(dir)
+		if err != nil || meta == nil || time.Since(meta.Started) > u.ttl {
+			err = os.RemoveAll(dir)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (u *Uploads) meta(dir string) (*uploadMeta, error) {
+	b, err := os.ReadFile(filepath.Join(dir, "upload.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta := &uploadMeta{}
+	err = json.Unmarshal(b, meta)
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func partName(i int) string {
+	return "part-" + strconv.Itoa(i)
+}
+
+func writeFileAtomic(name string, v interface{}) error {
+	b, ok := v.([]byte)
+	if !ok {
+		var err error
+		b, err = json.Marshal(v)
+		if err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(name+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+	err = os.Rename(name+".tmp", name)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(name))
+}
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
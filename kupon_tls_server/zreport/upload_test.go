@@ -0,0 +1,201 @@
+package zreport
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/go-kit/kit/log"
+	"nexusws/cmd/kupon_tls_server/framecheck"
+	"nexusws/cmd/kupon_tls_server/frametest"
+	"nexusws/cmd/kupon_tls_server/zreport/zfile"
+	"nexusws/pkg/nexushttpclient/zreport"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUploadsPut(t *testing.T) {
+	u, err := NewUploads(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := []byte("Z;12;20240301000000;20240301235959\nS;3;100;102\n")
+	sum := sha256.Sum256(file)
+	parts := [][]byte{file[:10], file[10:20], file[20:]}
+	part := func(i int) *Part {
+		return &Part{EcrSerial: "ECR1", UploadID: "0123456789abcdef", FileName: "z12.txt",
+			Index: i, Total: len(parts), Digest: sum[:], Content: parts[i]}
+	}
+
+	// out of order and resent after a reconnect
+	for _, i := range []int{2, 0, 2} {
+		_, complete, err := u.Put(part(i))
+		if err != nil || complete {
+			t.Fatalf("part %d: complete %v err %v", i, complete, err)
+		}
+	}
+	content, complete, err := u.Put(part(1))
+	if err != nil || !complete || !bytes.Equal(content, file) {
+		t.Fatalf("last part: complete %v err %v content %q", complete, err, content)
+	}
+	// resent when the report was NACKed
+	content, complete, err = u.Put(part(1))
+	if err != nil || !complete || !bytes.Equal(content, file) {
+		t.Fatalf("last part resent: complete %v err %v content %q", complete, err, content)
+	}
+	err = u.Done("ECR1", "0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(u.uploadDir("ECR1", "0123456789abcdef")); !os.IsNotExist(err) {
+		t.Errorf("upload kept after Done: %v", err)
+	}
+
+	p := part(0)
+	p.Index = 3
+	_, _, err = u.Put(p)
+	if !errors.Is(err, ErrPartInvalid) {
+		t.Errorf("index out of range: %v", err)
+	}
+
+	_, _, err = u.Put(part(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = part(1)
+	p.Total = 4
+	_, _, err = u.Put(p)
+	if !errors.Is(err, ErrPartInvalid) {
+		t.Errorf("total changed: %v", err)
+	}
+
+	p = part(1)
+	p.Content = []byte("corrupted!")
+	u.Put(p)
+	_, _, err = u.Put(part(2))
+	if !errors.Is(err, ErrDigestMismatch) {
+		t.Errorf("corrupted part: %v", err)
+	}
+}
+
+func TestCountParts(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"upload.json", "part-0", "part-2", "part-2.tmp", "part-7", "part-x"} {
+		err := os.WriteFile(filepath.Join(dir, name), nil, 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := countParts(dir, 3)
+	if err != nil || n != 2 {
+		t.Errorf("%d parts, err %v", n, err)
+	}
+}
+
+// insertFailing fails InsertZReport while err is set.
+type insertFailing struct {
+	frametest.Backend
+	err error
+}
+
+func (b *insertFailing) InsertZReport(ctx context.Context, report *zreport.ZReport, summary *zfile.Summary) error {
+	if b.err != nil {
+		return b.err
+	}
+	return b.Backend.InsertZReport(ctx, report, summary)
+}
+
+func TestHandleKeepsUploadUntilACK(t *testing.T) {
+	uploads, err := NewUploads(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte(frametest.ZReportBody))
+	uploadID := "upload-000000001"
+	frame := frametest.W("14", ZReportTypeMultiPart, uploadID+"\x00\x00\x01\x00"+string(digest[:])+frametest.ZReportBody)
+	b := &insertFailing{err: errors.New("nexusws is down")}
+
+	handle := func() (*RawZReport, string) {
+		c := frametest.NewConn(nil)
+		s := New(log.NewNopLogger(), b, nil, &Options{Uploads: uploads}, frame, len(frame))
+		s.Handle(context.Background(), c)
+		return s, c.Out.String()
+	}
+
+	s, resp := handle()
+	if resp == ZReportProtocolACK {
+		t.Fatal("ACK while the insert fails")
+	}
+	dir := uploads.uploadDir(s.Report.ECRSerial, uploadID)
+	if _, err = os.Stat(dir); err != nil {
+		t.Fatalf("upload removed after the NACK: %v", err)
+	}
+
+	b.err = nil
+	_, resp = handle()
+	if resp != ZReportProtocolACK || b.Stored != 1 {
+		t.Fatalf("response %q, stored %d", resp, b.Stored)
+	}
+	if _, err = os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("upload kept after the ACK: %v", err)
+	}
+}
+
+func TestParseMessageShortLengthField(t *testing.T) {
+	// the fixed fields the length field counts, without the checksum
+	fixed := ZReportLengthFieldLength + ZReportTypeLength + ZReportEcrSerialLength + ZReportEcrFileNameLength
+	tests := []struct {
+		version     string
+		lengthField int
+		wantErr     bool
+	}{
+		{"14", 0, true},
+		{"14", 5, true},
+		{"14", fixed + 1, true},
+		{"14", fixed + 2, false},
+		{"15", fixed + 2, true},
+		{"15", fixed + 7, true},
+		{"15", fixed + 8, false},
+	}
+	for _, tt := range tests {
+		msg := make([]byte, ZReportHeaderLength)
+		copy(msg, "W"+tt.version)
+		binary.LittleEndian.PutUint16(msg[ZReportLengthFieldOffset:], uint16(tt.lengthField))
+		s := New(nil, nil, nil, &Options{}, msg, len(msg))
+		err := s.parseMessage()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("v%s length field %d: err %v, body length %d", tt.version, tt.lengthField, err, s.bodyLength)
+		}
+		if err == nil && s.bodyLength != 0 {
+			t.Errorf("v%s length field %d: body length %d", tt.version, tt.lengthField, s.bodyLength)
+		}
+	}
+}
+
+func TestParseMessageCRC32(t *testing.T) {
+	msg := make([]byte, ZReportHeaderLength)
+	copy(msg, "W15")
+	// length field counts the fixed fields, 3 content bytes and the CRC32
+	binary.LittleEndian.PutUint16(msg[ZReportLengthFieldOffset:], uint16(ZReportHeaderLength-ZReportLengthFieldOffset+3+8))
+	s := New(nil, nil, nil, &Options{}, msg, len(msg))
+	err := s.parseMessage()
+	if err != nil || s.bodyLength != 3 || s.check != framecheck.CRC32 {
+		t.Errorf("err %v, body length %d, checksum %s", err, s.bodyLength, s.check)
+	}
+}
+
+func TestUploadDir(t *testing.T) {
+	u := &Uploads{dir: "up"}
+	// sanitizing used to map both IDs to "upload_1"
+	a := u.uploadDir("ECR1", "upload\x001")
+	b := u.uploadDir("ECR1", "upload\x011")
+	if a == b {
+		t.Errorf("upload IDs share %s", a)
+	}
+	if got := u.uploadDir("ECR/1", "id"); got != filepath.Join("up", "x4543522f31", "6964") {
+		t.Errorf("got %s", got)
+	}
+}
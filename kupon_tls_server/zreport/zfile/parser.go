@@ -0,0 +1,174 @@
+package zfile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"nexusws/cmd/kupon_tls_server/slipfields"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Z report file is text, one record per line, fields separated by ';'. The
+// first field names the record:
+//
+//	Z;<report no>;<from>;<to>                      exactly once
+//	V;<vat group>;<rate>;<net>;<vat>;<gross>       once per VAT group
+//	P;<payment method>;<amount>                    once per payment method
+//	S;<slip count>;<first slip no>;<last slip no>  exactly once
+//
+// Dates are yyyymmddhhmmss, amounts and rates are decimals with '.' and at
+// most two fraction digits. Lines of any other record are ignored so newer
+// firmware can add records.
+//
+// This layout has not been checked against a Z file captured from a register
+// yet, the tests use hand-written files. Keep zreport.content_parsing off in
+// production until a captured file is in testdata.
+const (
+	FieldSeparator = ";"
+	DateLayout     = "20060102150405"
+
+	RecordReport  = "Z"
+	RecordVat     = "V"
+	RecordPayment = "P"
+	RecordSlips   = "S"
+)
+
+// MaxSlips bounds the slip count and the width of the slip number range of a
+// report, both come from the register and size what is checked against them.
+const MaxSlips = 1000000
+
+var ErrMalformed = errors.New("malformed z report file")
+
+func Parse(content []byte) (*Summary, error) {
+	s := &Summary{
+		VatGroups: make([]VatTotal, 0),
+		Payments:  make([]PaymentTotal, 0),
+	}
+	seenReport, seenSlips := false, false
+
+	lines := bytes.Split(content, []byte("\n"))
+	for i, raw := range lines {
+		line := strings.TrimRight(string(raw), "\r\x00")
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, FieldSeparator)
+
+		var err error
+		switch fields[0] {
+		case RecordReport:
+			if seenReport {
+				return nil, malformed(i, "duplicate %s record", RecordReport)
+			}
+			seenReport = true
+			err = parseReport(s, fields)
+		case RecordVat:
+			err = parseVat(s, fields)
+		case RecordPayment:
+			err = parsePayment(s, fields)
+		case RecordSlips:
+			if seenSlips {
+				return nil, malformed(i, "duplicate %s record", RecordSlips)
+			}
+			seenSlips = true
+			err = parseSlips(s, fields)
+		}
+		if err != nil {
+			return nil, malformed(i, "%v", err)
+		}
+	}
+
+	if !seenReport || !seenSlips {
+		return nil, fmt.Errorf("%w: missing %s or %s record", ErrMalformed, RecordReport, RecordSlips)
+	}
+	if s.To.Before(s.From) {
+		return nil, fmt.Errorf("%w: report ends before it starts", ErrMalformed)
+	}
+	if s.SlipCount < 0 || s.FirstSlipNo < 0 {
+		return nil, fmt.Errorf("%w: negative slip count or number", ErrMalformed)
+	}
+	if s.SlipCount > 0 && s.LastSlipNo < s.FirstSlipNo {
+		return nil, fmt.Errorf("%w: last slip %d before first slip %d", ErrMalformed, s.LastSlipNo, s.FirstSlipNo)
+	}
+	if s.SlipCount > MaxSlips || s.LastSlipNo-s.FirstSlipNo >= MaxSlips {
+		return nil, fmt.Errorf("%w: more than %d slips", ErrMalformed, MaxSlips)
+	}
+	return s, nil
+}
+
+func parseReport(s *Summary, fields []string) error {
+	if len(fields) != 4 {
+		return fmt.Errorf("expected 4 fields, got %d", len(fields))
+	}
+	var err error
+	s.ReportNo, err = strconv.Atoi(fields[1])
+	if err != nil {
+		return err
+	}
+	s.From, err = time.ParseInLocation(DateLayout, fields[2], time.Local)
+	if err != nil {
+		return err
+	}
+	s.To, err = time.ParseInLocation(DateLayout, fields[3], time.Local)
+	return err
+}
+
+func parseVat(s *Summary, fields []string) error {
+	if len(fields) != 6 {
+		return fmt.Errorf("expected 6 fields, got %d", len(fields))
+	}
+	v := VatTotal{Group: fields[1]}
+	amounts := []*int64{&v.Rate, &v.Net, &v.Vat, &v.Gross}
+	for i, a := range amounts {
+		var err error
+		*a, err = parseAmount(fields[i+2])
+		if err != nil {
+			return err
+		}
+	}
+	s.VatGroups = append(s.VatGroups, v)
+	return nil
+}
+
+func parsePayment(s *Summary, fields []string) error {
+	if len(fields) != 3 {
+		return fmt.Errorf("expected 3 fields, got %d", len(fields))
+	}
+	amount, err := parseAmount(fields[2])
+	if err != nil {
+		return err
+	}
+	s.Payments = append(s.Payments, PaymentTotal{Method: fields[1], Amount: amount})
+	return nil
+}
+
+func parseSlips(s *Summary, fields []string) error {
+	if len(fields) != 4 {
+		return fmt.Errorf("expected 4 fields, got %d", len(fields))
+	}
+	values := []*int{&s.SlipCount, &s.FirstSlipNo, &s.LastSlipNo}
+	for i, v := range values {
+		var err error
+		*v, err = strconv.Atoi(fields[i+1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseAmount parses a decimal with at most two fraction digits into
+// hundredths, "12.5" is 1250.
+func parseAmount(f string) (int64, error) {
+	d, err := slipfields.ParseDecimal(f, 2)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q: %v", f, err)
+	}
+	return d.Units, nil
+}
+
+func malformed(line int, format string, args ...interface{}) error {
+	return fmt.Errorf("%w: line %d: %s", ErrMalformed, line+1, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,72 @@
+package zfile
+
+import (
+	"errors"
+	"testing"
+)
+
+const validReport = "Z;42;20230727080000;20230727220000\r\n" +
+	"V;A;20;1000.00;200.00;1200.00\r\n" +
+	"V;B;6;100;6;106\r\n" +
+	"P;CASH;1006.00\r\n" +
+	"P;CARD;300\r\n" +
+	"S;17;1201;1217\r\n" +
+	"X;reserved for newer firmware\r\n"
+
+func TestParse(t *testing.T) {
+	s, err := Parse([]byte(validReport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ReportNo != 42 || s.SlipCount != 17 || s.FirstSlipNo != 1201 || s.LastSlipNo != 1217 {
+		t.Errorf("unexpected summary %+v", s)
+	}
+	if len(s.VatGroups) != 2 || s.VatGroups[0].Rate != 2000 || s.VatGroups[1].Gross != 10600 {
+		t.Errorf("unexpected vat groups %+v", s.VatGroups)
+	}
+	if s.Total() != 130600 {
+		t.Errorf("expected total 130600, got %d", s.Total())
+	}
+	if len(s.Payments) != 2 || s.Payments[0].Method != "CASH" || s.Payments[1].Amount != 30000 {
+		t.Errorf("unexpected payments %+v", s.Payments)
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"empty", ""},
+		{"missing slips", "Z;1;20230727080000;20230727220000\n"},
+		{"missing report", "S;1;1;1\n"},
+		{"duplicate report", "Z;1;20230727080000;20230727220000\nZ;2;20230727080000;20230727220000\nS;1;1;1\n"},
+		{"bad date", "Z;1;2023-07-27;20230727220000\nS;1;1;1\n"},
+		{"ends before start", "Z;1;20230727220000;20230727080000\nS;1;1;1\n"},
+		{"vat field count", "Z;1;20230727080000;20230727220000\nV;A;20;1\nS;1;1;1\n"},
+		{"three fraction digits", "Z;1;20230727080000;20230727220000\nP;CASH;1.005\nS;1;1;1\n"},
+		{"last before first", "Z;1;20230727080000;20230727220000\nS;2;9;3\n"},
+		{"slip range too wide", "Z;1;20230727080000;20230727220000\nS;1;1;2147483647\n"},
+		{"slip count too large", "Z;1;20230727080000;20230727220000\nS;2000000;1;2\n"},
+		{"negative slip number", "Z;1;20230727080000;20230727220000\nS;0;-5;3\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.content))
+			if !errors.Is(err, ErrMalformed) {
+				t.Errorf("expected ErrMalformed, got %v", err)
+			}
+		})
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add([]byte(validReport))
+	f.Add([]byte("Z;42;20230727080000;20230727220000\n"))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		s, err := Parse(b)
+		if err == nil && s == nil {
+			t.Error("no summary and no error")
+		}
+	})
+}
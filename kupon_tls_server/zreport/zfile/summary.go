@@ -0,0 +1,41 @@
+package zfile
+
+import (
+	"time"
+)
+
+// Summary holds the figures of a Z report file. Amounts are in the smallest
+// currency unit.
+type Summary struct {
+	ReportNo    int            `json:"ReportNo"`
+	From        time.Time      `json:"From"`
+	To          time.Time      `json:"To"`
+	VatGroups   []VatTotal     `json:"VatGroups"`
+	Payments    []PaymentTotal `json:"Payments"`
+	SlipCount   int            `json:"SlipCount"`
+	FirstSlipNo int            `json:"FirstSlipNo"`
+	LastSlipNo  int            `json:"LastSlipNo"`
+}
+
+type VatTotal struct {
+	Group string `json:"Group"`
+	// Rate in hundredths of a percent, 2000 is 20%
+	Rate  int64 `json:"Rate"`
+	Net   int64 `json:"Net"`
+	Vat   int64 `json:"Vat"`
+	Gross int64 `json:"Gross"`
+}
+
+type PaymentTotal struct {
+	Method string `json:"Method"`
+	Amount int64  `json:"Amount"`
+}
+
+// Total returns the gross total over all VAT groups.
+func (s *Summary) Total() int64 {
+	var t int64
+	for _, v := range s.VatGroups {
+		t += v.Gross
+	}
+	return t
+}